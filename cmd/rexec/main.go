@@ -0,0 +1,117 @@
+package main
+
+// rexec runs a command in a VM over a Hyper-V or virtio socket using
+// pkg/rexec. The guest runs a server and the host runs commands with
+// it, exiting with the exit status of the command.
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	fwd "github.com/linuxkit/virtsock/pkg/forward"
+	"github.com/linuxkit/virtsock/pkg/rexec"
+)
+
+// envFlag collects repeated -e flags
+type envFlag []string
+
+func (e *envFlag) String() string { return strings.Join(*e, ",") }
+
+func (e *envFlag) Set(v string) error {
+	if !strings.Contains(v, "=") {
+		return fmt.Errorf("expected KEY=value")
+	}
+	*e = append(*e, v)
+	return nil
+}
+
+var (
+	serve    string
+	allowAny bool
+	env      envFlag
+	dir      string
+	noStdin  bool
+	timeout  time.Duration
+)
+
+func init() {
+	flag.StringVar(&serve, "serve", "", "Serve requests on this endpoint, e.g. vsock://:5556")
+	flag.BoolVar(&allowAny, "allow-any", false, "With -serve, run commands for any peer, not just the host")
+	flag.Var(&env, "e", "Set an environment variable KEY=value for the command (repeatable)")
+	flag.StringVar(&dir, "C", "", "Working directory of the command")
+	flag.BoolVar(&noStdin, "n", false, "Don't forward stdin, the command reads EOF")
+	flag.DurationVar(&timeout, "timeout", 10*time.Second, "Timeout for connecting")
+
+	flag.Usage = func() {
+		prog := filepath.Base(os.Args[0])
+		fmt.Fprintf(os.Stderr, "USAGE: %s [options] <address> <command> [args...]\n", prog)
+		fmt.Fprintf(os.Stderr, "       %s -serve <address> [-allow-any]\n\n", prog)
+		fmt.Fprintf(os.Stderr, "Run a command in a VM, streaming its output and exiting with its\n")
+		fmt.Fprintf(os.Stderr, "exit status. Addresses are of the form vsock://CID:Port or\n")
+		fmt.Fprintf(os.Stderr, "hvsock://VMID:ServiceID.\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "Examples:\n")
+		fmt.Fprintf(os.Stderr, "  %s -serve vsock://:5556               Run commands for the host\n", prog)
+		fmt.Fprintf(os.Stderr, "  %s -serve tcp://127.0.0.1:5556 -allow-any\n", prog)
+		fmt.Fprintf(os.Stderr, "                                        Run commands for any local user\n")
+		fmt.Fprintf(os.Stderr, "  %s vsock://3:5556 uname -a            Run uname in the VM with CID 3\n", prog)
+	}
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix(filepath.Base(os.Args[0]) + ": ")
+	flag.Parse()
+
+	if serve != "" {
+		if flag.NArg() != 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		l, err := fwd.Listen(serve)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s := &rexec.Server{Allow: rexec.AllowHost, Env: env}
+		if allowAny {
+			s.Allow = rexec.AllowAny
+		}
+		log.Fatal(s.Serve(l))
+	}
+
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	d, err := fwd.Dialer(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	c, err := d(ctx)
+	cancel()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	req := &rexec.Request{Args: flag.Args()[1:], Env: env, Dir: dir}
+	var stdin io.Reader = os.Stdin
+	if noStdin {
+		stdin = nil
+	}
+	code, err := rexec.Run(c, req, stdin, os.Stdout, os.Stderr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(code)
+}
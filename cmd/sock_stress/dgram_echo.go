@@ -38,8 +38,12 @@ func (t dgramEcho) Server(s Sock) {
 }
 
 func (t dgramEcho) Client(s Sock, conid int) {
+	res := newConnResult(conid)
+	defer res.record()
+
 	c, err := s.Dial(conid)
 	if err != nil {
+		res.fail("dial: %v", err)
 		prError("[%05d] Failed to Dial: %s %s\n", conid, s, err)
 		return
 	}
@@ -126,10 +130,12 @@ func (t dgramEcho) Client(s Sock, conid int) {
 		select {
 		case err := <-e:
 			if err != nil {
+				res.fail("send: %v", err)
 				prError("[%05d] Failed to send: %s\n", conid, err)
 				break
 			}
 		case <-time.After(ioTimeout):
+			res.fail("send: timeout")
 			prError("[%05d] Send timed out\n", conid)
 			break
 		}
@@ -141,6 +147,8 @@ func (t dgramEcho) Client(s Sock, conid int) {
 	time.Sleep(time.Second / 10)
 	c.Close()
 	totalReceived := <-w
+	res.BytesSent = totalSent
+	res.BytesRecvd = totalReceived
 	txTime := time.Since(start)
 	prInfo("[%05d] TX=%10d RX=%10d bytes in %10.4f ms\n", conid, totalSent, totalReceived, txTime.Seconds()*1000)
 }
@@ -0,0 +1,155 @@
+package main
+
+// This implements a request/response latency test over a SOCK_STREAM
+// connection. The client sends fixed size messages, optionally at a
+// fixed rate, and waits for each to be echoed back by the stream echo
+// server. At the end the distribution of the round trip times over all
+// connections and the jitter, the mean difference between the round
+// trip times of consecutive messages, are reported.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+type latencyEcho struct {
+	lock   sync.Mutex
+	rtts   []time.Duration
+	jitter []time.Duration // mean jitter per connection
+}
+
+func newLatencyTest() *latencyEcho {
+	return &latencyEcho{}
+}
+
+func (t *latencyEcho) Server(s Sock) {
+	newStreamEchoTest().Server(s)
+}
+
+func (t *latencyEcho) Client(s Sock, conid int) {
+	res := newConnResult(conid)
+	defer res.record()
+
+	c, err := s.Dial(conid)
+	if err != nil {
+		res.fail("dial: %v", err)
+		prError("[%05d] Failed to Dial: %s %s\n", conid, s, err)
+		return
+	}
+	defer c.Close()
+
+	msg := randBuf(latencySize)
+	buf := make([]byte, latencySize)
+	rtts := make([]time.Duration, 0, latencyMsgs)
+
+	var tick <-chan time.Time
+	if latencyRate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(latencyRate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for i := 0; i < latencyMsgs; i++ {
+		if tick != nil {
+			<-tick
+		}
+		c.SetDeadline(time.Now().Add(ioTimeout))
+		start := time.Now()
+		if _, err := c.Write(msg); err != nil {
+			res.fail("send: %v", err)
+			prError("[%05d] Failed to send message %d: %s\n", conid, i, err)
+			break
+		}
+		res.BytesSent += len(msg)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			res.fail("receive: %v", err)
+			prError("[%05d] Failed to receive message %d: %s\n", conid, i, err)
+			break
+		}
+		rtts = append(rtts, time.Since(start))
+		res.BytesRecvd += len(buf)
+		if !bytes.Equal(buf, msg) {
+			res.fail("data mismatch")
+			prError("[%05d] Message %d does not match\n", conid, i)
+			break
+		}
+	}
+	c.CloseWrite()
+
+	j := jitter(rtts)
+	prInfo("[%05d] %d messages, jitter %s\n", conid, len(rtts), j)
+	t.lock.Lock()
+	t.rtts = append(t.rtts, rtts...)
+	if len(rtts) > 1 {
+		t.jitter = append(t.jitter, j)
+	}
+	t.lock.Unlock()
+}
+
+// jitter returns the mean absolute difference between consecutive
+// round trip times
+func jitter(rtts []time.Duration) time.Duration {
+	if len(rtts) < 2 {
+		return 0
+	}
+	var sum time.Duration
+	for i := 1; i < len(rtts); i++ {
+		d := rtts[i] - rtts[i-1]
+		if d < 0 {
+			d = -d
+		}
+		sum += d
+	}
+	return sum / time.Duration(len(rtts)-1)
+}
+
+// rttSummary holds the round trip time distribution in µs
+type rttSummary struct {
+	Messages int     `json:"messages"`
+	Min      float64 `json:"min"`
+	P50      float64 `json:"p50"`
+	P90      float64 `json:"p90"`
+	P99      float64 `json:"p99"`
+	P999     float64 `json:"p999"`
+	Max      float64 `json:"max"`
+	Jitter   float64 `json:"jitter"`
+}
+
+func (t *latencyEcho) summary() *rttSummary {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.rtts) == 0 {
+		return nil
+	}
+	rtts := append([]time.Duration(nil), t.rtts...)
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	usec := func(d time.Duration) float64 { return float64(d) / float64(time.Microsecond) }
+	pct := func(p float64) float64 {
+		return usec(rtts[int(float64(len(rtts)-1)*p/100)])
+	}
+	var j time.Duration
+	for _, cj := range t.jitter {
+		j += cj
+	}
+	if len(t.jitter) > 0 {
+		j /= time.Duration(len(t.jitter))
+	}
+	return &rttSummary{
+		Messages: len(rtts),
+		Min:      usec(rtts[0]),
+		P50:      pct(50),
+		P90:      pct(90),
+		P99:      pct(99),
+		P999:     pct(99.9),
+		Max:      usec(rtts[len(rtts)-1]),
+		Jitter:   usec(j),
+	}
+}
+
+func (s *rttSummary) String() string {
+	return fmt.Sprintf("%d messages: min=%.1fus p50=%.1fus p90=%.1fus p99=%.1fus p999=%.1fus max=%.1fus jitter=%.1fus",
+		s.Messages, s.Min, s.P50, s.P90, s.P99, s.P999, s.Max, s.Jitter)
+}
@@ -0,0 +1,194 @@
+package main
+
+// This implements a load generator. Up to -p connections each send
+// fixed size messages at -rate messages per second to the stream echo
+// server. The number of connections is ramped up over -ramp-up, held
+// for -hold and ramped down over -ramp-down. Every second the number
+// of active connections and the latency of the messages echoed in
+// that second are reported, which shows how many concurrent
+// connections a service sustains before latency degrades.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const loadInterval = time.Second
+
+// loadStep holds the results of one reporting interval
+type loadStep struct {
+	ElapsedS float64 `json:"elapsed_s"`
+	Conns    int     `json:"connections"`
+	Messages int     `json:"messages"`
+	Errors   int     `json:"errors"`
+	P50      float64 `json:"p50_us"`
+	P90      float64 `json:"p90_us"`
+	P99      float64 `json:"p99_us"`
+	Max      float64 `json:"max_us"`
+}
+
+func (s loadStep) String() string {
+	return fmt.Sprintf("%6.1fs conns=%4d msgs=%6d errors=%3d p50=%8.1fus p90=%8.1fus p99=%8.1fus max=%8.1fus",
+		s.ElapsedS, s.Conns, s.Messages, s.Errors, s.P50, s.P90, s.P99, s.Max)
+}
+
+type loadGen struct {
+	s     Sock
+	start time.Time
+	total time.Duration
+
+	active int32 // number of connected workers, accessed atomically
+
+	lock   sync.Mutex
+	rtts   []time.Duration // samples of the current interval
+	errors int
+}
+
+// target returns the number of connections which should be active at
+// elapsed time t
+func (g *loadGen) target(t time.Duration) int {
+	switch {
+	case t < loadRampUp:
+		return int(int64(parallel) * int64(t) / int64(loadRampUp))
+	case t < loadRampUp+loadHold:
+		return parallel
+	case t < g.total:
+		left := g.total - t
+		return int(int64(parallel) * int64(left) / int64(loadRampDown))
+	}
+	return 0
+}
+
+// runLoad runs the load profile and returns the results per interval
+func runLoad(s Sock) []loadStep {
+	g := &loadGen{
+		s:     s,
+		start: time.Now(),
+		total: loadRampUp + loadHold + loadRampDown,
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			g.worker(i)
+		}(i)
+	}
+
+	var steps []loadStep
+	ticker := time.NewTicker(loadInterval)
+	for now := range ticker.C {
+		st := g.step(now.Sub(g.start))
+		fmt.Printf("%s\n", st)
+		steps = append(steps, st)
+		if now.Sub(g.start) >= g.total {
+			break
+		}
+	}
+	ticker.Stop()
+	wg.Wait()
+	return steps
+}
+
+// step collects the samples of the interval ending at elapsed
+func (g *loadGen) step(elapsed time.Duration) loadStep {
+	g.lock.Lock()
+	rtts, errors := g.rtts, g.errors
+	g.rtts, g.errors = nil, 0
+	g.lock.Unlock()
+
+	st := loadStep{
+		ElapsedS: elapsed.Seconds(),
+		Conns:    int(atomic.LoadInt32(&g.active)),
+		Messages: len(rtts),
+		Errors:   errors,
+	}
+	if len(rtts) > 0 {
+		sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+		usec := func(p int) float64 {
+			return float64(rtts[(len(rtts)-1)*p/100]) / float64(time.Microsecond)
+		}
+		st.P50, st.P90, st.P99, st.Max = usec(50), usec(90), usec(99), usec(100)
+	}
+	return st
+}
+
+func (g *loadGen) record(rtt time.Duration, err error) {
+	g.lock.Lock()
+	if err != nil {
+		g.errors++
+	} else {
+		g.rtts = append(g.rtts, rtt)
+	}
+	g.lock.Unlock()
+}
+
+// worker i keeps a connection open and sends messages while the
+// profile asks for more than i connections
+func (g *loadGen) worker(i int) {
+	var interval time.Duration
+	if latencyRate > 0 {
+		interval = time.Second / time.Duration(latencyRate)
+	}
+	msg := randBuf(latencySize)
+	buf := make([]byte, latencySize)
+	var c Conn
+	defer func() {
+		if c != nil {
+			c.Close()
+			atomic.AddInt32(&g.active, -1)
+		}
+	}()
+
+	for {
+		elapsed := time.Since(g.start)
+		if elapsed >= g.total {
+			return
+		}
+		if g.target(elapsed) <= i {
+			if c != nil {
+				c.Close()
+				c = nil
+				atomic.AddInt32(&g.active, -1)
+			}
+			time.Sleep(loadInterval / 10)
+			continue
+		}
+		if c == nil {
+			var err error
+			c, err = g.s.Dial(i)
+			if err != nil {
+				prDebug("[%05d] Failed to Dial: %s %s\n", i, g.s, err)
+				g.record(0, err)
+				time.Sleep(loadInterval / 10)
+				continue
+			}
+			atomic.AddInt32(&g.active, 1)
+		}
+
+		next := time.Now().Add(interval)
+		c.SetDeadline(time.Now().Add(ioTimeout))
+		start := time.Now()
+		_, err := c.Write(msg)
+		if err == nil {
+			_, err = io.ReadFull(c, buf)
+		}
+		if err == nil && !bytes.Equal(buf, msg) {
+			err = fmt.Errorf("data mismatch")
+		}
+		g.record(time.Since(start), err)
+		if err != nil {
+			prDebug("[%05d] Message failed: %s\n", i, err)
+			c.Close()
+			c = nil
+			atomic.AddInt32(&g.active, -1)
+			continue
+		}
+		time.Sleep(time.Until(next))
+	}
+}
@@ -30,6 +30,18 @@ var (
 	verbose     int
 	exitOnError bool
 	parallel    int
+	outFormat   string
+	outFile     string
+
+	latencyMode bool
+	latencyRate int
+	latencyMsgs int
+	latencySize int
+
+	loadMode     bool
+	loadRampUp   time.Duration
+	loadHold     time.Duration
+	loadRampDown time.Duration
 
 	connCounter int32
 )
@@ -68,6 +80,16 @@ func init() {
 	flag.IntVar(&parallel, "p", 1, "Run n connections in parallel")
 	flag.BoolVar(&exitOnError, "e", false, "Exit when an error occurs")
 	flag.IntVar(&verbose, "v", 0, "Set the verbosity level")
+	flag.BoolVar(&latencyMode, "lat", false, "Measure request/response latency instead of echoing random data")
+	flag.IntVar(&latencyRate, "rate", 0, "Messages per second per connection in latency mode (0 for back to back)")
+	flag.IntVar(&latencyMsgs, "n", 1000, "Number of messages per connection in latency mode")
+	flag.IntVar(&latencySize, "size", 64, "Message size in latency mode")
+	flag.BoolVar(&loadMode, "load", false, "Generate load with up to -p connections sending -rate messages/s of -size bytes")
+	flag.DurationVar(&loadRampUp, "ramp-up", 10*time.Second, "Time to ramp up to -p connections in load mode")
+	flag.DurationVar(&loadHold, "hold", 30*time.Second, "Time to hold -p connections in load mode")
+	flag.DurationVar(&loadRampDown, "ramp-down", 10*time.Second, "Time to ramp down from -p connections in load mode")
+	flag.StringVar(&outFormat, "o", "", "Write client results as 'json' or 'csv'")
+	flag.StringVar(&outFile, "O", "", "File to write client results to (default stdout)")
 
 	flag.Usage = func() {
 		prog := filepath.Base(os.Args[0])
@@ -99,6 +121,12 @@ func init() {
 		fmt.Printf("  %s -s vsock            Start server in vsock mode on standard port\n", prog)
 		fmt.Printf("  %s -s vsock://:1235    Start server in vsock mode on a non-standard port\n", prog)
 		fmt.Printf("  %s -c hvsock://<vmid>  Start client in hvsock mode connecting to VM with <vmid>\n", prog)
+		fmt.Printf("  %s -c vsock://3 -lat -rate 100 -i 10\n", prog)
+		fmt.Printf("                         Measure latency percentiles and jitter at 100 msgs/s\n")
+		fmt.Printf("  %s -c vsock://3 -load -p 200 -rate 10\n", prog)
+		fmt.Printf("                         Ramp up to 200 connections sending 10 msgs/s each\n")
+		fmt.Printf("  %s -c vsock://3 -o json -O results.json\n", prog)
+		fmt.Printf("                         Run client and save results for later analysis\n")
 	}
 	rand.Seed(time.Now().UnixNano())
 }
@@ -121,7 +149,11 @@ func main() {
 	case "udp", "udp4", "udp6":
 		t = newDgramEchoTest()
 	default:
-		t = newStreamEchoTest()
+		if latencyMode {
+			t = newLatencyTest()
+		} else {
+			t = newStreamEchoTest()
+		}
 	}
 
 	if serverStr != "" {
@@ -130,6 +162,10 @@ func main() {
 		return
 	}
 
+	if (latencyMode || loadMode) && latencySize <= 0 {
+		fmt.Printf("Message size must be positive!")
+		return
+	}
 	if minDataLen > maxDataLen {
 		fmt.Printf("minDataLen > maxDataLen!")
 		return
@@ -139,23 +175,62 @@ func main() {
 		return
 	}
 
-	fmt.Printf("Client connecting to %s\n", s.String())
-	if parallel <= 1 {
+	// Keep stdout clean if results are written to it
+	out := os.Stdout
+	if outFormat != "" && outFile == "" {
+		out = os.Stderr
+	}
+	if outFormat != "" && outFormat != "json" && outFormat != "csv" {
+		log.Fatalf("Unknown output format: '%s'", outFormat)
+	}
+
+	fmt.Fprintf(out, "Client connecting to %s\n", s.String())
+	start := time.Now()
+	var steps []loadStep
+	if loadMode {
+		steps = runLoad(s)
+	} else if parallel <= 1 {
 		// No parallelism, run in the main thread.
 		for i := 0; i < connections; i++ {
 			t.Client(s, i)
 			time.Sleep(time.Duration(sleepTime) * time.Second)
 		}
-		return
+	} else {
+		// Parallel clients
+		var wg sync.WaitGroup
+		for i := 0; i < parallel; i++ {
+			wg.Add(1)
+			go parClient(t, &wg, s)
+		}
+		wg.Wait()
 	}
 
-	// Parallel clients
-	var wg sync.WaitGroup
-	for i := 0; i < parallel; i++ {
-		wg.Add(1)
-		go parClient(t, &wg, s)
+	sum := summarise(s.String(), time.Since(start))
+	sum.Load = steps
+	if lt, ok := t.(*latencyEcho); ok {
+		sum.RTT = lt.summary()
+		if sum.RTT != nil {
+			fmt.Fprintf(out, "Latency: %s\n", sum.RTT)
+		}
+	}
+	if outFormat != "" {
+		saveResults(sum)
+	}
+}
+
+func saveResults(sum summary) {
+	w := os.Stdout
+	if outFile != "" {
+		f, err := os.Create(outFile)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %v", outFile, err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := writeResults(w, outFormat, sum); err != nil {
+		log.Fatalf("Failed to write results: %v", err)
 	}
-	wg.Wait()
 }
 
 // parseSockStr parses a address of the form <proto>://foo where foo
@@ -0,0 +1,144 @@
+package main
+
+// Machine readable results of a client run, for CI pipelines and
+// dashboards comparing runs across OS builds. Every client connection
+// records a connResult and the summary is computed once all
+// connections are done.
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// connResult is the outcome of a single client connection
+type connResult struct {
+	ID         int     `json:"id"`
+	BytesSent  int     `json:"bytes_sent"`
+	BytesRecvd int     `json:"bytes_received"`
+	DurationMs float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+
+	start time.Time
+}
+
+// fail records the first error of a connection
+func (r *connResult) fail(format string, args ...interface{}) {
+	if r.Error == "" {
+		r.Error = fmt.Sprintf(format, args...)
+	}
+}
+
+// latencySummary holds percentiles of the connection durations in ms
+type latencySummary struct {
+	Min float64 `json:"min"`
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+type summary struct {
+	Address        string         `json:"address"`
+	Connections    int            `json:"connections"`
+	Errors         int            `json:"errors"`
+	BytesSent      int64          `json:"bytes_sent"`
+	BytesRecvd     int64          `json:"bytes_received"`
+	DurationMs     float64        `json:"duration_ms"`
+	ThroughputMBps float64        `json:"throughput_mbps"`
+	Latency        latencySummary `json:"latency_ms"`
+	RTT            *rttSummary    `json:"rtt_us,omitempty"` // only set in latency mode
+	Load           []loadStep     `json:"load,omitempty"`   // only set in load mode
+	Conns          []connResult   `json:"connections_detail"`
+}
+
+var (
+	resultsLock sync.Mutex
+	results     []connResult
+)
+
+func newConnResult(conid int) *connResult {
+	return &connResult{ID: conid, start: time.Now()}
+}
+
+// record completes r and adds it to the results
+func (r *connResult) record() {
+	r.DurationMs = msec(time.Since(r.start))
+	resultsLock.Lock()
+	results = append(results, *r)
+	resultsLock.Unlock()
+}
+
+func msec(d time.Duration) float64 {
+	return d.Seconds() * 1000
+}
+
+func summarise(addr string, d time.Duration) summary {
+	resultsLock.Lock()
+	conns := append([]connResult(nil), results...)
+	resultsLock.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+
+	s := summary{
+		Address:     addr,
+		Connections: len(conns),
+		DurationMs:  msec(d),
+		Conns:       conns,
+	}
+	var durations []float64
+	for _, c := range conns {
+		if c.Error != "" {
+			s.Errors++
+		}
+		s.BytesSent += int64(c.BytesSent)
+		s.BytesRecvd += int64(c.BytesRecvd)
+		durations = append(durations, c.DurationMs)
+	}
+	if d > 0 {
+		s.ThroughputMBps = float64(s.BytesSent+s.BytesRecvd) / d.Seconds() / (1000 * 1000)
+	}
+	if len(durations) > 0 {
+		sort.Float64s(durations)
+		pct := func(p int) float64 { return durations[(len(durations)-1)*p/100] }
+		s.Latency = latencySummary{
+			Min: durations[0],
+			P50: pct(50),
+			P90: pct(90),
+			P99: pct(99),
+			Max: durations[len(durations)-1],
+		}
+	}
+	return s
+}
+
+// writeResults writes s to w in the given format, "json" or "csv".
+// The CSV output has one row per connection, the summary can be
+// computed from it.
+func writeResults(w io.Writer, format string, s summary) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"id", "bytes_sent", "bytes_received", "duration_ms", "error"})
+		for _, c := range s.Conns {
+			cw.Write([]string{
+				strconv.Itoa(c.ID),
+				strconv.Itoa(c.BytesSent),
+				strconv.Itoa(c.BytesRecvd),
+				strconv.FormatFloat(c.DurationMs, 'f', 4, 64),
+				c.Error,
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown output format %q", format)
+}
@@ -61,8 +61,12 @@ func (t streamEcho) handleRequest(c net.Conn, connid int) {
 }
 
 func (t streamEcho) Client(s Sock, conid int) {
+	res := newConnResult(conid)
+	defer res.record()
+
 	c, err := s.Dial(conid)
 	if err != nil {
+		res.fail("dial: %v", err)
 		prError("[%05d] Failed to Dial: %s %s\n", conid, s, err)
 		return
 	}
@@ -82,6 +86,7 @@ func (t streamEcho) Client(s Sock, conid int) {
 	start := time.Now()
 
 	w := make(chan int)
+	var txErr string
 	go func() {
 		total := 0
 		remaining := buflen
@@ -115,10 +120,16 @@ func (t streamEcho) Client(s Sock, conid int) {
 			select {
 			case err := <-e:
 				if err != nil {
+					if txErr == "" {
+						txErr = fmt.Sprintf("send: %v", err)
+					}
 					prError("[%05d] Failed to send: %s\n", conid, err)
 					break
 				}
 			case <-time.After(ioTimeout):
+				if txErr == "" {
+					txErr = "send: timeout"
+				}
 				prError("[%05d] Send timed out\n", conid)
 				break
 			}
@@ -167,10 +178,12 @@ func (t streamEcho) Client(s Sock, conid int) {
 		select {
 		case err := <-e:
 			if err != nil {
+				res.fail("receive: %v", err)
 				prError("[%05d] Failed to receive after %d of %d bytes: %s\n", conid, totalReceived, buflen, err)
 				break
 			}
 		case <-time.After(ioTimeout):
+			res.fail("receive: timeout")
 			prError("[%05d] Receive timed out after %d of %d bytes\n", conid, totalReceived, buflen)
 			break
 		}
@@ -182,6 +195,11 @@ func (t streamEcho) Client(s Sock, conid int) {
 
 	rxTime = time.Since(start)
 	totalSent := <-w
+	res.BytesSent = totalSent
+	res.BytesRecvd = totalReceived
+	if txErr != "" {
+		res.fail("%s", txErr)
+	}
 
 	csum0 := md5Hash(hash0)
 	prDebug("[%05d] TX: %d bytes, md5=%02x in %s\n", conid, totalSent, csum0, txTime)
@@ -189,6 +207,7 @@ func (t streamEcho) Client(s Sock, conid int) {
 	csum1 := md5Hash(hash1)
 	prInfo("[%05d] TX/RX: %10d bytes in %10.4f ms\n", conid, totalReceived, rxTime.Seconds()*1000)
 	if csum0 != csum1 {
+		res.fail("checksum mismatch")
 		prError("[%05d] Checksums don't match", conid)
 	}
 }
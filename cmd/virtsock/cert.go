@@ -0,0 +1,100 @@
+package main
+
+// The cert command manages the certificates of pkg/vmtls channels. It
+// creates a CA in a directory on first use and issues certificates for
+// the identities given:
+//
+//	virtsock cert -dir /etc/virtsock/pki vsock://2 vsock://3
+//
+// writes ca.pem and ca-key.pem, and a certificate and key per
+// identity, e.g. vsock-3.pem and vsock-3-key.pem. The CA key should
+// stay on the host, only the certificate and key of a VM and ca.pem
+// are copied into it.
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/linuxkit/virtsock/pkg/hvsock"
+	"github.com/linuxkit/virtsock/pkg/vmtls"
+)
+
+func certCmd(args []string) int {
+	fs := flag.NewFlagSet("cert", flag.ExitOnError)
+	dir := fs.String("dir", ".", "Directory holding the CA and the certificates issued")
+	name := fs.String("ca-name", "virtsock CA", "Name of the CA, if it is created")
+	days := fs.Int("days", 365, "Validity of the certificates issued, in days")
+	caDays := fs.Int("ca-days", 3650, "Validity of the CA, if it is created, in days")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: cert [options] vsock://CID|hvsock://VMID ...\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var ids []vmtls.Identity
+	for _, arg := range fs.Args() {
+		id, err := parseIdentity(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 2
+		}
+		ids = append(ids, id)
+	}
+
+	caCert := filepath.Join(*dir, "ca.pem")
+	caKey := filepath.Join(*dir, "ca-key.pem")
+	ca, err := vmtls.LoadCA(caCert, caKey)
+	if os.IsNotExist(err) {
+		if ca, err = vmtls.NewCA(*name, time.Duration(*caDays)*24*time.Hour); err == nil {
+			if err = os.MkdirAll(*dir, 0700); err == nil {
+				err = ca.Save(caCert, caKey)
+			}
+		}
+		if err == nil {
+			fmt.Printf("created CA %s\n", caCert)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	for _, id := range ids {
+		cert, err := ca.Issue(id, time.Duration(*days)*24*time.Hour)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", id, err)
+			return 1
+		}
+		base := filepath.Join(*dir, strings.Replace(string(id), "://", "-", 1))
+		if err := vmtls.SaveCertificate(cert, base+".pem", base+"-key.pem"); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", id, err)
+			return 1
+		}
+		fmt.Printf("issued %s for %s\n", base+".pem", id)
+	}
+	return 0
+}
+
+// parseIdentity parses and normalises an identity given on the
+// command line
+func parseIdentity(s string) (vmtls.Identity, error) {
+	switch {
+	case strings.HasPrefix(s, "vsock://"):
+		lo, hi, err := parseRange(strings.TrimPrefix(s, "vsock://"))
+		if err != nil || lo != hi {
+			return "", fmt.Errorf("invalid identity %q, expected vsock://CID", s)
+		}
+		return vmtls.VsockIdentity(lo), nil
+	case strings.HasPrefix(s, "hvsock://"):
+		vmid, err := hvsock.GUIDFromString(strings.TrimPrefix(s, "hvsock://"))
+		if err != nil {
+			return "", fmt.Errorf("invalid identity %q: %v", s, err)
+		}
+		return vmtls.HvsockIdentity(vmid), nil
+	}
+	return "", fmt.Errorf("invalid identity %q, expected vsock://CID or hvsock://VMID", s)
+}
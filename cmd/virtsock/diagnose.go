@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// loopbackTimeout bounds the loopback connection attempt
+const loopbackTimeout = 5 * time.Second
+
+type severity int
+
+const (
+	sevOK severity = iota
+	sevInfo
+	sevWarn
+	sevError
+)
+
+func (s severity) String() string {
+	switch s {
+	case sevOK:
+		return "OK"
+	case sevInfo:
+		return "INFO"
+	case sevWarn:
+		return "WARN"
+	}
+	return "ERROR"
+}
+
+// finding is the result of a single check. hint tells the user what
+// to do about a problem.
+type finding struct {
+	sev  severity
+	msg  string
+	hint string
+}
+
+// findings collects the results of the platform specific checks
+type findings []finding
+
+func (f *findings) add(sev severity, hint, format string, args ...interface{}) {
+	*f = append(*f, finding{sev, fmt.Sprintf(format, args...), hint})
+}
+
+func diagnose(args []string) int {
+	fs := flag.NewFlagSet("diagnose", flag.ExitOnError)
+	noLoopback := fs.Bool("no-loopback", false, "Skip the loopback connection test")
+	fs.Parse(args)
+
+	var f findings
+	checkPlatform(&f, !*noLoopback)
+
+	worst := sevOK
+	for _, r := range f {
+		fmt.Printf("[%-5s] %s\n", r.sev, r.msg)
+		if r.hint != "" {
+			fmt.Printf("        -> %s\n", r.hint)
+		}
+		if r.sev > worst {
+			worst = r.sev
+		}
+	}
+	if worst >= sevError {
+		fmt.Fprintf(os.Stderr, "\nProblems found, see above\n")
+		return 1
+	}
+	return 0
+}
+
+// withTimeout runs f and returns an error if it does not complete
+// within loopbackTimeout. f keeps running in the background in that
+// case, as socket operations can't be aborted.
+func withTimeout(f func() error) error {
+	ch := make(chan error, 1)
+	go func() { ch <- f() }()
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(loopbackTimeout):
+		return fmt.Errorf("timed out after %s", loopbackTimeout)
+	}
+}
@@ -0,0 +1,14 @@
+// +build !linux,!windows
+
+package main
+
+import "runtime"
+
+func checkPlatform(f *findings, loopback bool) {
+	if runtime.GOOS == "darwin" {
+		f.add(sevInfo, "Use the hyperkit socket mode of the vsock package",
+			"macOS has no vsock sockets, HyperKit exposes them as unix domain sockets")
+		return
+	}
+	f.add(sevError, "", "Hyper-V and virtio sockets are not supported on %s", runtime.GOOS)
+}
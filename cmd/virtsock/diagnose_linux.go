@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/linuxkit/virtsock/pkg/hvsock"
+	"github.com/linuxkit/virtsock/pkg/vsock"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ioctlGetLocalCID is IOCTL_VM_SOCKETS_GET_LOCAL_CID
+	ioctlGetLocalCID = 0x7b9
+	// cidLocal is VMADDR_CID_LOCAL, used for loopback connections
+	cidLocal = 1
+)
+
+// vsockTransports are the kernel modules providing vsock transports
+var vsockTransports = []struct {
+	module string
+	desc   string
+}{
+	{"vmw_vsock_virtio_transport", "virtio transport (guest of KVM, HyperKit, Firecracker)"},
+	{"hv_sock", "Hyper-V transport (guest of Hyper-V)"},
+	{"vhost_vsock", "vhost transport (KVM host)"},
+	{"vmw_vsock_vmci_transport", "VMCI transport (VMware)"},
+	{"vsock_loopback", "loopback transport"},
+}
+
+func checkPlatform(f *findings, loopback bool) {
+	if rel, err := ioutil.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		f.add(sevInfo, "", "Linux kernel %s", strings.TrimSpace(string(rel)))
+	}
+
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM, 0)
+	if err != nil {
+		f.add(sevError, "Load the vsock module and a transport, e.g. 'modprobe vmw_vsock_virtio_transport'",
+			"Cannot create AF_VSOCK socket: %v", err)
+	} else {
+		unix.Close(fd)
+		f.add(sevOK, "", "AF_VSOCK sockets are supported")
+	}
+
+	var loaded []string
+	for _, t := range vsockTransports {
+		if _, err := os.Stat("/sys/module/" + t.module); err == nil {
+			loaded = append(loaded, t.module)
+			f.add(sevOK, "", "Transport %s loaded: %s", t.module, t.desc)
+		}
+	}
+	if len(loaded) == 0 {
+		f.add(sevWarn, "In a VM load the transport for the hypervisor, e.g. 'modprobe hv_sock' on Hyper-V",
+			"No vsock transport module found (it may be built into the kernel)")
+	}
+
+	if cid, err := localCID(); err != nil {
+		f.add(sevWarn, "/dev/vsock is created by the vsock module", "Cannot determine local CID: %v", err)
+	} else {
+		f.add(sevInfo, "", "Local CID is %d", cid)
+		if cid == vsock.CIDHost {
+			f.add(sevInfo, "", "This system is a vsock host")
+		}
+	}
+
+	if hvsock.Supported() {
+		f.add(sevInfo, "", "Legacy AF_HYPERV sockets are supported, use hvsock:// addresses")
+	}
+
+	if loopback {
+		_, err := os.Stat("/sys/module/vsock_loopback")
+		checkLoopback(f, err == nil)
+	}
+}
+
+func localCID() (uint32, error) {
+	fd, err := unix.Open("/dev/vsock", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+	var cid uint32
+	_, _, e1 := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), ioctlGetLocalCID, uintptr(unsafe.Pointer(&cid)))
+	if e1 != 0 {
+		return 0, e1
+	}
+	return cid, nil
+}
+
+// checkLoopback connects to a listener on this system. Connections to
+// the local CID are only routed locally if the loopback transport is
+// available, otherwise they end up with the hypervisor.
+func checkLoopback(f *findings, hasLoopback bool) {
+	rand.Seed(time.Now().UnixNano())
+	port := uint32(0x40000000 + rand.Intn(0x10000000))
+	l, err := vsock.Listen(vsock.CIDAny, port)
+	if err != nil {
+		f.add(sevError, "Check that a vsock transport is loaded", "Cannot listen on vsock port %d: %v", port, err)
+		return
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	err = withTimeout(func() error {
+		c, err := vsock.Dial(cidLocal, port)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		if _, err := c.Write([]byte("ping")); err != nil {
+			return err
+		}
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(c, buf)
+		return err
+	})
+	if err != nil && (!hasLoopback || errors.Is(err, syscall.ENODEV)) {
+		f.add(sevWarn, "Load the vsock_loopback module to test connections locally",
+			"Loopback connection not possible: %v", err)
+		return
+	}
+	if err != nil {
+		f.add(sevError, "", "Loopback connection failed: %v", err)
+		return
+	}
+	f.add(sevOK, "", "Loopback connection on port %d works", port)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io"
+	"syscall"
+
+	"github.com/linuxkit/virtsock/pkg/hvsock"
+	"golang.org/x/sys/windows/registry"
+)
+
+const (
+	// currentVersionKey holds the Windows version information
+	currentVersionKey = `SOFTWARE\Microsoft\Windows NT\CurrentVersion`
+	// minBuild is the first Windows 10 build with Hyper-V socket
+	// support
+	minBuild = 10586
+)
+
+func checkPlatform(f *findings, loopback bool) {
+	checkVersion(f)
+
+	fd, err := syscall.Socket(34, syscall.SOCK_STREAM, 1) // AF_HYPERV, HV_PROTOCOL_RAW
+	if err != nil {
+		f.add(sevError, "Enable the Hyper-V feature and reboot",
+			"Cannot create AF_HYPERV socket: %v", err)
+		return
+	}
+	syscall.Close(fd)
+	f.add(sevOK, "", "AF_HYPERV sockets are supported")
+
+	services, err := hvsock.ListRegisteredServices()
+	switch {
+	case err != nil:
+		f.add(sevWarn, "", "Cannot list registered services: %v", err)
+	case len(services) == 0:
+		f.add(sevWarn, "Register the service GUIDs guests connect to with hvsock.RegisterService() or in the registry",
+			"No services registered, guests cannot connect to the host")
+	default:
+		for _, s := range services {
+			f.add(sevInfo, "", "Registered service %s %q", s.ServiceID.String(), s.Name)
+		}
+	}
+
+	if loopback {
+		checkLoopback(f)
+	}
+}
+
+func checkVersion(f *findings) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, currentVersionKey, registry.QUERY_VALUE)
+	if err != nil {
+		f.add(sevWarn, "", "Cannot determine Windows version: %v", err)
+		return
+	}
+	defer k.Close()
+	name, _, _ := k.GetStringValue("ProductName")
+	build, _, err := k.GetStringValue("CurrentBuildNumber")
+	if err != nil {
+		f.add(sevWarn, "", "Cannot determine Windows build: %v", err)
+		return
+	}
+	f.add(sevInfo, "", "%s build %s", name, build)
+
+	var n int
+	for _, c := range build {
+		if c < '0' || c > '9' {
+			break
+		}
+		n = n*10 + int(c-'0')
+	}
+	if n < minBuild {
+		f.add(sevError, "Upgrade to Windows 10 or Windows Server 2016 or later",
+			"Windows build %d does not support Hyper-V sockets", n)
+	}
+}
+
+// checkLoopback connects to a listener on this system, using a
+// temporary service GUID
+func checkLoopback(f *findings) {
+	svc, err := hvsock.GUIDFromString("4e3f9a1c-6d2b-4c8e-9f7a-2b1d5c0e8a63")
+	if err != nil {
+		return
+	}
+	l, err := hvsock.Listen(hvsock.Addr{VMID: hvsock.GUIDLoopback, ServiceID: svc})
+	if err != nil {
+		f.add(sevError, "", "Cannot listen in loopback mode: %v", err)
+		return
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	err = withTimeout(func() error {
+		c, err := hvsock.Dial(hvsock.Addr{VMID: hvsock.GUIDLoopback, ServiceID: svc})
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		if _, err := c.Write([]byte("ping")); err != nil {
+			return err
+		}
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(c, buf)
+		return err
+	})
+	if err != nil {
+		f.add(sevWarn, "Loopback connections require a recent Windows build",
+			"Loopback connection failed: %v", err)
+		return
+	}
+	f.add(sevOK, "", "Loopback connection works")
+}
@@ -0,0 +1,106 @@
+package main
+
+// Fault injection for the mitm command, to test how applications
+// cope with the failures seen when VMs are suspended or killed: stalls,
+// connections cut in the middle of a frame, lost stream shutdowns and
+// abrupt resets.
+
+import (
+	"errors"
+	"flag"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/linuxkit/virtsock/pkg/mux/frame"
+)
+
+// errInjected aborts a relayed connection after an injected fault
+var errInjected = errors.New("fault injected")
+
+// faultConfig holds the probabilities of the faults injected per frame
+type faultConfig struct {
+	delay    time.Duration // maximum random delay
+	truncate float64       // cut the connection in the middle of a frame
+	dropFIN  float64       // drop a stream half-close
+	reset    float64       // reset both connections
+
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+func (fc *faultConfig) addFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&fc.delay, "fault-delay", 0, "Delay frames by a random time up to this")
+	fs.Float64Var(&fc.truncate, "fault-truncate", 0, "Probability of cutting the connection in the middle of a frame")
+	fs.Float64Var(&fc.dropFIN, "fault-drop-fin", 0, "Probability of dropping a stream half-close (FIN)")
+	fs.Float64Var(&fc.reset, "fault-reset", 0, "Probability of resetting the connection before a frame")
+}
+
+// enabled returns true if any fault is configured
+func (fc *faultConfig) enabled() bool {
+	return fc.delay > 0 || fc.truncate > 0 || fc.dropFIN > 0 || fc.reset > 0
+}
+
+func (fc *faultConfig) seed(seed int64) {
+	fc.rand = rand.New(rand.NewSource(seed))
+}
+
+// chance returns true with probability p
+func (fc *faultConfig) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	return fc.rand.Float64() < p
+}
+
+func (fc *faultConfig) randDuration(max time.Duration) time.Duration {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	return time.Duration(fc.rand.Int63n(int64(max) + 1))
+}
+
+// apply injects faults into the frame h being relayed by r. It returns
+// true if the frame was handled and must not be relayed, and
+// errInjected if the connection was cut.
+func (fc *faultConfig) apply(r *relay, h *frame.Header, payload []byte) (bool, error) {
+	if fc.delay > 0 {
+		d := fc.randDuration(fc.delay)
+		r.logf("FAULT delay %s", d)
+		time.Sleep(d)
+	}
+	if fc.chance(fc.reset) {
+		r.logf("FAULT reset")
+		resetConn(r.dst)
+		resetConn(r.src)
+		return true, errInjected
+	}
+	if len(payload) > 0 && fc.chance(fc.truncate) {
+		r.logf("FAULT truncate after %d of %d payload bytes", len(payload)/2, len(payload))
+		var b [frame.HeaderSize]byte
+		h.Encode(b[:])
+		r.dst.Write(append(b[:], payload[:len(payload)/2]...))
+		r.dst.Close()
+		r.src.Close()
+		return true, errInjected
+	}
+	if h.Type == frame.Data && h.Flags&frame.FlagFIN != 0 && fc.chance(fc.dropFIN) {
+		r.logf("FAULT drop FIN of stream %d", h.StreamID)
+		h.Flags &^= frame.FlagFIN
+		if h.Flags == 0 && len(payload) == 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// resetConn closes c, resetting TCP connections rather than shutting
+// them down cleanly
+func resetConn(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	c.Close()
+}
@@ -0,0 +1,257 @@
+package main
+
+// The forward command runs the port forwards listed in a JSON config
+// file, e.g.:
+//
+//	{
+//	  "forwards": [
+//	    {"name": "docker", "listen": "tcp://127.0.0.1:2375", "dial": "vsock://3:2375"},
+//	    {"name": "ssh", "listen": "tcp://127.0.0.1:2222", "dial": "vsock://3:22", "disabled": true}
+//	  ]
+//	}
+//
+// If a control endpoint is given, forwards can be listed and enabled
+// or disabled at runtime over HTTP:
+//
+//	GET  /status
+//	POST /enable?name=ssh
+//	POST /disable?name=docker
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	fwd "github.com/linuxkit/virtsock/pkg/forward"
+)
+
+// forwardConfig is the configuration of a single forward
+type forwardConfig struct {
+	Name        string `json:"name"`
+	Listen      string `json:"listen"`
+	Dial        string `json:"dial"`
+	Disabled    bool   `json:"disabled,omitempty"`
+	MaxConns    int    `json:"max_conns,omitempty"`
+	DialTimeout string `json:"dial_timeout,omitempty"`
+}
+
+type forwardsConfig struct {
+	Forwards []forwardConfig `json:"forwards"`
+}
+
+// forwardStatus is reported by the status endpoint
+type forwardStatus struct {
+	forwardConfig
+	Running bool   `json:"running"`
+	Error   string `json:"error,omitempty"`
+}
+
+type managedForward struct {
+	config      forwardConfig
+	dialTimeout time.Duration
+
+	running bool
+	err     error
+	fwd     *fwd.Forwarder
+	done    chan struct{}
+}
+
+// forwardManager starts and stops the configured forwards
+type forwardManager struct {
+	lock     sync.Mutex
+	forwards map[string]*managedForward
+}
+
+func loadForwards(path string) ([]*managedForward, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c forwardsConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", path, err)
+	}
+	names := make(map[string]bool)
+	var mfs []*managedForward
+	for i, fc := range c.Forwards {
+		if fc.Name == "" {
+			fc.Name = fmt.Sprintf("forward%d", i)
+		}
+		if names[fc.Name] {
+			return nil, fmt.Errorf("forward %s configured twice", fc.Name)
+		}
+		names[fc.Name] = true
+		if fc.Listen == "" || fc.Dial == "" {
+			return nil, fmt.Errorf("forward %s: listen and dial must be set", fc.Name)
+		}
+		mf := &managedForward{config: fc}
+		if fc.DialTimeout != "" {
+			mf.dialTimeout, err = time.ParseDuration(fc.DialTimeout)
+			if err != nil {
+				return nil, fmt.Errorf("forward %s: invalid dial_timeout: %v", fc.Name, err)
+			}
+		}
+		mfs = append(mfs, mf)
+	}
+	return mfs, nil
+}
+
+// start starts mf. It must be called with m.lock held.
+func (m *forwardManager) start(mf *managedForward) {
+	if mf.running {
+		return
+	}
+	f, err := fwd.New(mf.config.Listen, mf.config.Dial)
+	if err != nil {
+		mf.err = err
+		log.Printf("%s: %v", mf.config.Name, err)
+		return
+	}
+	f.MaxConns = mf.config.MaxConns
+	f.DialTimeout = mf.dialTimeout
+	name := mf.config.Name
+	f.ErrorLog = func(err error) { log.Printf("%s: %v", name, err) }
+
+	mf.fwd, mf.err, mf.running = f, nil, true
+	mf.done = make(chan struct{})
+	log.Printf("%s: forwarding %s to %s", name, mf.config.Listen, mf.config.Dial)
+	go func(done chan struct{}) {
+		defer close(done)
+		err := f.Serve(context.Background())
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		if mf.fwd == f {
+			mf.running = false
+			if err != fwd.ErrClosed {
+				mf.err = err
+				log.Printf("%s: stopped: %v", name, err)
+			}
+		}
+	}(mf.done)
+}
+
+// stop stops a forward and waits for its connections to be closed. It
+// must be called with m.lock held and releases it while waiting.
+func (m *forwardManager) stop(mf *managedForward) {
+	if !mf.running {
+		return
+	}
+	f, done := mf.fwd, mf.done
+	mf.fwd, mf.running, mf.err = nil, false, nil
+	f.Close()
+	m.lock.Unlock()
+	<-done
+	m.lock.Lock()
+	log.Printf("%s: stopped", mf.config.Name)
+}
+
+func (m *forwardManager) setEnabled(name string, enabled bool) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	mf, ok := m.forwards[name]
+	if !ok {
+		return fmt.Errorf("unknown forward %q", name)
+	}
+	mf.config.Disabled = !enabled
+	if enabled {
+		m.start(mf)
+		return mf.err
+	}
+	m.stop(mf)
+	return nil
+}
+
+func (m *forwardManager) status() []forwardStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var st []forwardStatus
+	for _, mf := range m.forwards {
+		s := forwardStatus{forwardConfig: mf.config, Running: mf.running}
+		if mf.err != nil {
+			s.Error = mf.err.Error()
+		}
+		st = append(st, s)
+	}
+	sort.Slice(st, func(i, j int) bool { return st[i].Name < st[j].Name })
+	return st
+}
+
+func (m *forwardManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/status":
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(m.status())
+	case "/enable", "/disable":
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := m.setEnabled(r.URL.Query().Get("name"), r.URL.Path == "/enable"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func forwardCmd(args []string) int {
+	fs := flag.NewFlagSet("forward", flag.ExitOnError)
+	config := fs.String("config", "", "JSON file listing the forwards")
+	control := fs.String("control", "", "Endpoint for the HTTP control interface, e.g. unix:///run/virtsock.sock")
+	fs.Parse(args)
+	if *config == "" {
+		fmt.Fprintf(os.Stderr, "-config is required\n")
+		return 2
+	}
+	log.SetFlags(log.LstdFlags)
+
+	mfs, err := loadForwards(*config)
+	if err != nil {
+		log.Printf("%v", err)
+		return 1
+	}
+	m := &forwardManager{forwards: make(map[string]*managedForward)}
+	m.lock.Lock()
+	for _, mf := range mfs {
+		m.forwards[mf.config.Name] = mf
+		if !mf.config.Disabled {
+			m.start(mf)
+		}
+	}
+	m.lock.Unlock()
+
+	if *control != "" {
+		l, err := fwd.Listen(*control)
+		if err != nil {
+			log.Printf("control: %v", err)
+			return 1
+		}
+		defer l.Close()
+		go http.Serve(l, m)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	m.lock.Lock()
+	for _, mf := range m.forwards {
+		m.stop(mf)
+	}
+	m.lock.Unlock()
+	return 0
+}
@@ -0,0 +1,242 @@
+package main
+
+// The frames command connects to a pkg/mux peer and lets the user send
+// hand crafted frames interactively, while printing every frame the
+// peer sends, to reproduce protocol level bugs precisely.
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	fwd "github.com/linuxkit/virtsock/pkg/forward"
+	"github.com/linuxkit/virtsock/pkg/mux/frame"
+)
+
+const framesHelp = `Commands:
+  open <stream>                 open a stream (data frame with SYN)
+  data <stream> <text>          send text on a stream
+  hex <stream> <hex>            send hex encoded bytes on a stream
+  fin <stream>                  half-close a stream (data frame with FIN)
+  rst <stream>                  reset a stream (data frame with RST)
+  window <stream> <credit>      grant credit (window update frame)
+  signal <stream> <text>        send a signal frame
+  ping [id]                     send a ping frame
+  maxframe <size>               announce a maximum frame size (settings frame)
+  raw <type> <flags> <stream> <length> [hex]
+                                send an arbitrary header and payload
+  magic                         send the magic word
+  shutdown                      close the write side of the connection
+  quit                          close the connection and exit
+Numbers may be given in decimal or with a 0x prefix.
+`
+
+func framesCmd(args []string) int {
+	fs := flag.NewFlagSet("frames", flag.ExitOnError)
+	dial := fs.String("dial", "", "Endpoint to connect to, e.g. vsock://3:5000")
+	listen := fs.String("listen", "", "Endpoint to accept a single connection on instead")
+	noMagic := fs.Bool("no-magic", false, "Don't send the magic word when connected")
+	dump := fs.Int("dump", 64, "Number of payload bytes to print per frame received")
+	fs.Parse(args)
+	if (*dial == "") == (*listen == "") {
+		fmt.Fprintf(os.Stderr, "Exactly one of -dial and -listen is required\n")
+		return 2
+	}
+
+	var c net.Conn
+	var err error
+	if *dial != "" {
+		var d fwd.DialFunc
+		if d, err = fwd.Dialer(*dial); err == nil {
+			c, err = d(context.Background())
+		}
+	} else {
+		var l net.Listener
+		if l, err = fwd.Listen(*listen); err == nil {
+			fmt.Printf("waiting for a connection on %s\n", l.Addr())
+			c, err = l.Accept()
+			l.Close()
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	defer c.Close()
+	fmt.Printf("connected %s -> %s, type 'help' for a list of commands\n", c.LocalAddr(), c.RemoteAddr())
+
+	if !*noMagic {
+		if err := frame.WriteMagic(c); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+	}
+	go printFrames(c, *dump)
+
+	in := bufio.NewScanner(os.Stdin)
+	for fmt.Print("> "); in.Scan(); fmt.Print("> ") {
+		fields := strings.Fields(in.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "quit" {
+			break
+		}
+		if err := runFrameCmd(c, fields); err != nil {
+			fmt.Printf("error: %v\n", err)
+		}
+	}
+	return 0
+}
+
+// printFrames prints the frames received from c until the connection
+// fails
+func printFrames(c net.Conn, dump int) {
+	err := frame.ReadMagic(c)
+	if err != nil {
+		fmt.Printf("\n<< %v\n", err)
+		if _, ok := err.(*frame.MagicError); !ok {
+			return
+		}
+	} else {
+		fmt.Printf("\n<< magic %q\n", frame.Magic[:])
+	}
+	for {
+		var h frame.Header
+		payload, err := frame.ReadFrame(c, &h, frame.MaxLargePayload)
+		if err == io.EOF {
+			fmt.Printf("\n<< EOF\n")
+			return
+		}
+		if err != nil {
+			fmt.Printf("\n<< %v\n", err)
+			return
+		}
+		fmt.Printf("\n<< %s\n", describeFrame(&h, payload, dump))
+	}
+}
+
+// runFrameCmd sends the frame described by a command line
+func runFrameCmd(c net.Conn, f []string) error {
+	var nums []uint32
+	// num parses argument i as a number
+	num := func(i int) (uint32, error) {
+		if i >= len(f) {
+			return 0, fmt.Errorf("%s: missing argument", f[0])
+		}
+		n, err := strconv.ParseUint(f[i], 0, 32)
+		if err != nil {
+			return 0, fmt.Errorf("%s: invalid number %q", f[0], f[i])
+		}
+		return uint32(n), nil
+	}
+	// parse parses the first n arguments as numbers
+	parse := func(n int) error {
+		for i := 1; i <= n; i++ {
+			v, err := num(i)
+			if err != nil {
+				return err
+			}
+			nums = append(nums, v)
+		}
+		return nil
+	}
+	rest := func(i int) string {
+		if i >= len(f) {
+			return ""
+		}
+		return strings.Join(f[i:], " ")
+	}
+	send := func(t frame.Type, flags uint16, stream uint32, payload []byte) error {
+		h := frame.New(t, flags, stream, uint32(len(payload)))
+		fmt.Printf(">> %s\n", describeFrame(&h, payload, len(payload)))
+		return frame.WriteFrame(c, &h, payload)
+	}
+
+	switch f[0] {
+	case "help":
+		fmt.Print(framesHelp)
+		return nil
+	case "magic":
+		return frame.WriteMagic(c)
+	case "shutdown":
+		cw, ok := c.(closeWriter)
+		if !ok {
+			return fmt.Errorf("connection does not support half-close")
+		}
+		return cw.CloseWrite()
+	case "open", "fin", "rst":
+		if err := parse(1); err != nil {
+			return err
+		}
+		flags := map[string]uint16{"open": frame.FlagSYN, "fin": frame.FlagFIN, "rst": frame.FlagRST}[f[0]]
+		return send(frame.Data, flags, nums[0], nil)
+	case "data", "signal":
+		if err := parse(1); err != nil {
+			return err
+		}
+		t := frame.Data
+		if f[0] == "signal" {
+			t = frame.Signal
+		}
+		return send(t, 0, nums[0], []byte(rest(2)))
+	case "hex":
+		if err := parse(1); err != nil {
+			return err
+		}
+		b, err := hex.DecodeString(strings.Join(f[2:], ""))
+		if err != nil {
+			return err
+		}
+		return send(frame.Data, 0, nums[0], b)
+	case "window":
+		if err := parse(2); err != nil {
+			return err
+		}
+		h := frame.New(frame.WindowUpdate, 0, nums[0], nums[1])
+		fmt.Printf(">> %s\n", describeFrame(&h, nil, 0))
+		return frame.WriteFrame(c, &h, nil)
+	case "ping":
+		var id uint32
+		if len(f) > 1 {
+			if err := parse(1); err != nil {
+				return err
+			}
+			id = nums[0]
+		}
+		payload := make([]byte, frame.PingSize)
+		binary.BigEndian.PutUint64(payload, uint64(id))
+		return send(frame.Ping, 0, 0, payload)
+	case "maxframe":
+		if err := parse(1); err != nil {
+			return err
+		}
+		payload := frame.AppendSetting(nil, frame.Setting{ID: frame.SettingMaxFrameSize, Value: nums[0]})
+		return send(frame.Settings, 0, 0, payload)
+	case "raw":
+		if err := parse(4); err != nil {
+			return err
+		}
+		b, err := hex.DecodeString(strings.Join(f[5:], ""))
+		if err != nil {
+			return err
+		}
+		// The length is sent as given, even if it does not match
+		// the payload
+		h := frame.New(frame.Type(nums[0]), uint16(nums[1]), nums[2], nums[3])
+		fmt.Printf(">> %s (%d payload bytes)\n", h, len(b))
+		var hb [frame.HeaderSize]byte
+		h.Encode(hb[:])
+		_, err = c.Write(append(hb[:], b...))
+		return err
+	}
+	return fmt.Errorf("unknown command %q, type 'help' for a list of commands", f[0])
+}
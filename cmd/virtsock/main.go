@@ -0,0 +1,54 @@
+package main
+
+// virtsock is a collection of tools to set up and debug Hyper-V and
+// virtio sockets.
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
+
+var commands = []command{
+	{"diagnose", "Check the hvsock/vsock configuration of this system", diagnose},
+	{"forward", "Run the port forwards listed in a config file", forwardCmd},
+	{"mitm", "Relay connections and log the mux frames exchanged", mitmCmd},
+	{"frames", "Send hand crafted mux frames to a peer interactively", framesCmd},
+	{"scan", "Probe VMs for services accepting connections", scanCmd},
+	{"monitor", "Monitor guest services and report when they go up or down", monitorCmd},
+	{"probe", "Report which mux protocol features a peer supports", probeCmd},
+	{"cert", "Create a CA and issue certificates for TLS between host and VMs", certCmd},
+}
+
+func usage() {
+	prog := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "USAGE: %s <command> [options]\n\n", prog)
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", c.name, c.usage)
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name == flag.Arg(0) {
+			os.Exit(c.run(flag.Args()[1:]))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", flag.Arg(0))
+	usage()
+	os.Exit(2)
+}
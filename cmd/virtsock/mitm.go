@@ -0,0 +1,303 @@
+package main
+
+// The mitm command relays connections between two endpoints and logs
+// the pkg/mux frames exchanged in human readable form, to debug
+// interoperability and shutdown problems. On sessions authenticated
+// with a shared key the nonces and proofs are relayed unchanged before
+// the frames. Connections which don't start with either mux magic word
+// are relayed unchanged and only the amount of data is logged. Faults
+// can be injected into the relayed frames, see faults.go.
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	fwd "github.com/linuxkit/virtsock/pkg/forward"
+	"github.com/linuxkit/virtsock/pkg/mux/frame"
+)
+
+// maxFramePayload bounds the payloads relayed, larger frames are
+// treated as corrupt
+const maxFramePayload = frame.MaxLargePayload
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// relay holds the state of one direction of a relayed connection
+type relay struct {
+	prefix   string // identifies connection and direction in logs
+	dst, src net.Conn
+	dump     int          // number of payload bytes to dump
+	faults   *faultConfig // nil if no faults are injected
+}
+
+func (r *relay) logf(format string, args ...interface{}) {
+	log.Printf("%s %s", r.prefix, fmt.Sprintf(format, args...))
+}
+
+func mitmCmd(args []string) int {
+	fs := flag.NewFlagSet("mitm", flag.ExitOnError)
+	listen := fs.String("listen", "", "Endpoint to accept connections on, e.g. tcp://127.0.0.1:5000")
+	dial := fs.String("dial", "", "Endpoint to relay connections to, e.g. vsock://3:5000")
+	dump := fs.Int("dump", 16, "Number of payload bytes to dump per frame")
+	seed := fs.Int64("seed", 0, "Seed for fault injection (default random)")
+	var faults faultConfig
+	faults.addFlags(fs)
+	fs.Parse(args)
+	if *listen == "" || *dial == "" {
+		fmt.Fprintf(os.Stderr, "-listen and -dial are required\n")
+		return 2
+	}
+	log.SetFlags(log.Ltime | log.Lmicroseconds)
+
+	d, err := fwd.Dialer(*dial)
+	if err != nil {
+		log.Printf("%v", err)
+		return 1
+	}
+	l, err := fwd.Listen(*listen)
+	if err != nil {
+		log.Printf("%v", err)
+		return 1
+	}
+	defer l.Close()
+	log.Printf("relaying %s to %s", *listen, *dial)
+
+	fc := &faults
+	if !faults.enabled() {
+		fc = nil
+	} else {
+		if *seed == 0 {
+			*seed = time.Now().UnixNano()
+		}
+		faults.seed(*seed)
+		log.Printf("injecting faults, seed %d", *seed)
+	}
+
+	for id := 1; ; id++ {
+		c, err := l.Accept()
+		if err != nil {
+			log.Printf("accept: %v", err)
+			return 1
+		}
+		go func(id int, c net.Conn) {
+			defer c.Close()
+			s, err := d(context.Background())
+			if err != nil {
+				log.Printf("[%d] dial: %v", id, err)
+				return
+			}
+			defer s.Close()
+			log.Printf("[%d] %s -> %s", id, c.RemoteAddr(), s.RemoteAddr())
+			relayBoth(id, c, s, *dump, fc)
+			log.Printf("[%d] done", id)
+		}(id, c)
+	}
+}
+
+// relayBoth relays frames between client c and server s until both
+// directions are done. faults, if set, are injected into the frames.
+func relayBoth(id int, c, s net.Conn, dump int, faults *faultConfig) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	for _, r := range []*relay{
+		{prefix: fmt.Sprintf("[%d] c->s", id), dst: s, src: c, dump: dump, faults: faults},
+		{prefix: fmt.Sprintf("[%d] s->c", id), dst: c, src: s, dump: dump, faults: faults},
+	} {
+		go func(r *relay) {
+			defer wg.Done()
+			err := r.run()
+			if err != nil {
+				if err != errInjected {
+					r.logf("error: %v", err)
+				}
+				// Abort the other direction as well
+				c.Close()
+				s.Close()
+				return
+			}
+			if cw, ok := r.dst.(closeWriter); ok {
+				cw.CloseWrite()
+			}
+		}(r)
+	}
+	wg.Wait()
+}
+
+// run relays from src to dst until EOF
+func (r *relay) run() error {
+	var magic [len(frame.Magic)]byte
+	n, err := io.ReadFull(r.src, magic[:])
+	switch {
+	case err == io.EOF:
+		r.logf("EOF")
+		return nil
+	case err == io.ErrUnexpectedEOF:
+		r.logf("EOF after %d raw bytes", n)
+		_, err = r.dst.Write(magic[:n])
+		return err
+	case err != nil:
+		return err
+	}
+	if magic != frame.Magic && magic != frame.AuthMagic {
+		r.logf("no mux magic word (got %q), relaying raw data", magic[:n])
+		if _, err := r.dst.Write(magic[:n]); err != nil {
+			return err
+		}
+		n, err := io.Copy(r.dst, r.src)
+		r.logf("EOF after %d raw bytes", int64(len(magic))+n)
+		return err
+	}
+	r.logf("magic %q", magic[:])
+	if _, err := r.dst.Write(magic[:]); err != nil {
+		return err
+	}
+	if magic == frame.AuthMagic {
+		if done, err := r.relayAuth(); done || err != nil {
+			return err
+		}
+	}
+
+	for {
+		var h frame.Header
+		if err := frame.ReadHeader(r.src, &h); err != nil {
+			if err == io.EOF {
+				r.logf("EOF")
+				return nil
+			}
+			return err
+		}
+		n := h.PayloadLength()
+		if n > maxFramePayload {
+			return fmt.Errorf("frame payload too large: %s", h)
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r.src, payload); err != nil {
+			return fmt.Errorf("truncated %s frame: %v", h.Type, err)
+		}
+		r.logf("%s", describeFrame(&h, payload, r.dump))
+		if r.faults != nil {
+			handled, err := r.faults.apply(r, &h, payload)
+			if err != nil {
+				return err
+			}
+			if handled {
+				continue
+			}
+		}
+		if err := frame.WriteFrame(r.dst, &h, payload); err != nil {
+			return err
+		}
+	}
+}
+
+// relayAuth relays the nonce and proof which follow AuthMagic. It
+// returns true if src hung up before sending them, which the server
+// does when the client's proof was wrong.
+func (r *relay) relayAuth() (bool, error) {
+	fields := []struct {
+		name string
+		size int
+	}{
+		{"nonce", frame.AuthNonceSize},
+		{"proof", frame.AuthProofSize},
+	}
+	for _, f := range fields {
+		b := make([]byte, f.size)
+		n, err := io.ReadFull(r.src, b)
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			r.logf("EOF after %d bytes of the auth %s", n, f.name)
+			_, err = r.dst.Write(b[:n])
+			return true, err
+		case err != nil:
+			return false, err
+		}
+		r.logf("auth %s %s", f.name, dumpBytes(b, r.dump))
+		if _, err := r.dst.Write(b); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// dumpBytes returns the length of b and up to dump of its bytes in hex
+func dumpBytes(b []byte, dump int) string {
+	s := fmt.Sprintf("len=%d", len(b))
+	if dump <= 0 || len(b) == 0 {
+		return s
+	}
+	p := b
+	if len(p) > dump {
+		p = p[:dump]
+	}
+	s += fmt.Sprintf(" % x", p)
+	if len(p) < len(b) {
+		s += " ..."
+	}
+	return s
+}
+
+// describeFrame returns a human readable description of a frame
+func describeFrame(h *frame.Header, payload []byte, dump int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-13s stream=%d", h.Type, h.StreamID)
+	if f := flagNames(h.Flags); f != "" {
+		fmt.Fprintf(&b, " %s", f)
+	}
+	switch h.Type {
+	case frame.WindowUpdate:
+		fmt.Fprintf(&b, " credit=%d", h.Length)
+	case frame.Settings:
+		settings, err := frame.ParseSettings(payload)
+		if err != nil {
+			fmt.Fprintf(&b, " invalid: %v", err)
+		}
+		for _, s := range settings {
+			if s.ID == frame.SettingMaxFrameSize {
+				fmt.Fprintf(&b, " max-frame-size=%d", s.Value)
+			} else {
+				fmt.Fprintf(&b, " setting(%d)=%d", s.ID, s.Value)
+			}
+		}
+	case frame.Ping, frame.Pong:
+		if len(payload) == frame.PingSize {
+			fmt.Fprintf(&b, " id=%d", binary.BigEndian.Uint64(payload))
+		}
+	default:
+		fmt.Fprintf(&b, " %s", dumpBytes(payload, dump))
+	}
+	if h.Version != frame.Version {
+		fmt.Fprintf(&b, " version=%d", h.Version)
+	}
+	return b.String()
+}
+
+// flagNames names the flags of a data frame, which open (SYN),
+// half-close (FIN) and reset (RST) streams
+func flagNames(flags uint16) string {
+	var names []string
+	if flags&frame.FlagSYN != 0 {
+		names = append(names, "SYN")
+	}
+	if flags&frame.FlagFIN != 0 {
+		names = append(names, "FIN")
+	}
+	if flags&frame.FlagRST != 0 {
+		names = append(names, "RST")
+	}
+	if unknown := flags &^ frame.KnownFlags; unknown != 0 {
+		names = append(names, fmt.Sprintf("%#x", unknown))
+	}
+	return strings.Join(names, "|")
+}
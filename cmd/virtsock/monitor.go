@@ -0,0 +1,310 @@
+package main
+
+// The monitor command keeps a pkg/mux session open to each of the
+// given guest services and pings it, so that hosts learn quickly when a
+// guest agent dies:
+//
+//	virtsock monitor -http tcp://127.0.0.1:9100 -exec ./on-change.sh \
+//	    agent=vsock://3:1024 docker=vsock://3:2375
+//
+// State changes are logged and, with -exec, passed to a command in the
+// environment variables VIRTSOCK_SERVICE, VIRTSOCK_ADDR and
+// VIRTSOCK_STATE ("up" or "down"). With -http the state is served as
+// JSON on /status and in the Prometheus text format on /metrics. With
+// -once every service is checked once and the exit code is 0 only if
+// all of them are up.
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	fwd "github.com/linuxkit/virtsock/pkg/forward"
+	"github.com/linuxkit/virtsock/pkg/health"
+	"github.com/linuxkit/virtsock/pkg/mux"
+)
+
+// monitoredService holds the state of one monitored service
+type monitoredService struct {
+	Name  string    `json:"name"`
+	Addr  string    `json:"addr"`
+	Up    bool      `json:"up"`
+	Since time.Time `json:"since"`
+	RTT   float64   `json:"rtt_ms,omitempty"`
+	Error string    `json:"error,omitempty"`
+	Flaps int       `json:"flaps"`
+
+	dial fwd.DialFunc
+	seen bool // false until the first check completed
+}
+
+type monitor struct {
+	interval time.Duration
+	timeout  time.Duration
+	command  string
+	once     bool // don't report state changes
+
+	lock     sync.Mutex
+	services []*monitoredService
+}
+
+func monitorCmd(args []string) int {
+	fs := flag.NewFlagSet("monitor", flag.ExitOnError)
+	interval := fs.Duration("interval", time.Second, "Interval between pings")
+	timeout := fs.Duration("timeout", time.Second, "Time to wait for a connection or a ping reply")
+	command := fs.String("exec", "", "Command to run when a service goes up or down")
+	httpAddr := fs.String("http", "", "Endpoint serving /status and /metrics, e.g. tcp://127.0.0.1:9100")
+	once := fs.Bool("once", false, "Check every service once and exit non-zero if any is down")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: monitor [options] name=endpoint ...\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	m := &monitor{interval: *interval, timeout: *timeout, command: *command, once: *once}
+	for _, arg := range fs.Args() {
+		i := strings.Index(arg, "=")
+		if i <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid service %q, expected name=address\n", arg)
+			return 2
+		}
+		d, err := fwd.Dialer(arg[i+1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 2
+		}
+		m.services = append(m.services, &monitoredService{Name: arg[:i], Addr: arg[i+1:], dial: d})
+	}
+
+	if *once {
+		return m.checkOnce()
+	}
+
+	log.SetFlags(log.LstdFlags)
+	if *httpAddr != "" {
+		l, err := fwd.Listen(*httpAddr)
+		if err != nil {
+			log.Printf("http: %v", err)
+			return 1
+		}
+		defer l.Close()
+		go http.Serve(l, m)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, ms := range m.services {
+		wg.Add(1)
+		go func(ms *monitoredService) {
+			defer wg.Done()
+			m.watch(ctx, ms)
+		}(ms)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	cancel()
+	wg.Wait()
+	return 0
+}
+
+// checkOnce pings every service once and prints the results
+func (m *monitor) checkOnce() int {
+	var wg sync.WaitGroup
+	for _, ms := range m.services {
+		wg.Add(1)
+		go func(ms *monitoredService) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+			defer cancel()
+			c, err := ms.dial(ctx)
+			var rtt time.Duration
+			if err == nil {
+				rtt, err = health.Check(ctx, c)
+			}
+			m.update(ms, rtt, err)
+		}(ms)
+	}
+	wg.Wait()
+
+	rc := 0
+	for _, ms := range m.services {
+		if ms.Up {
+			fmt.Printf("%-20s up   %.3fms\n", ms.Name, ms.RTT)
+		} else {
+			fmt.Printf("%-20s down %s\n", ms.Name, ms.Error)
+			rc = 1
+		}
+	}
+	return rc
+}
+
+// watch keeps a session open to ms and pings it every interval until
+// ctx is done. Failed sessions are reconnected after an interval.
+func (m *monitor) watch(ctx context.Context, ms *monitoredService) {
+	for ctx.Err() == nil {
+		s, err := m.connect(ctx, ms.dial)
+		if err != nil {
+			m.update(ms, 0, err)
+		} else {
+			m.pingLoop(ctx, ms, s)
+			s.Close()
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(m.interval):
+		}
+	}
+}
+
+// connect sets up a mux session with a service
+func (m *monitor) connect(ctx context.Context, dial fwd.DialFunc) (*mux.Session, error) {
+	dctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+	c, err := dial(dctx)
+	if err != nil {
+		return nil, err
+	}
+	// Bound the handshake as well
+	c.SetDeadline(time.Now().Add(m.timeout))
+	s, err := mux.Client(c, nil)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return s, nil
+}
+
+// pingLoop pings the service over s until a ping fails or ctx is done
+func (m *monitor) pingLoop(ctx context.Context, ms *monitoredService, s *mux.Session) {
+	for {
+		pctx, cancel := context.WithTimeout(ctx, m.timeout)
+		rtt, err := s.Ping(pctx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		m.update(ms, rtt, err)
+		if err != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.interval):
+		}
+	}
+}
+
+// update records the result of a check and reports state changes
+func (m *monitor) update(ms *monitoredService, rtt time.Duration, err error) {
+	m.lock.Lock()
+	up := err == nil
+	changed := !ms.seen || ms.Up != up
+	if changed {
+		if ms.seen {
+			ms.Flaps++
+		}
+		ms.seen, ms.Up, ms.Since = true, up, time.Now()
+	}
+	ms.RTT = float64(rtt) / float64(time.Millisecond)
+	ms.Error = ""
+	if err != nil {
+		ms.Error = err.Error()
+	}
+	m.lock.Unlock()
+
+	if !changed || m.once {
+		return
+	}
+	state := "down"
+	if up {
+		state = "up"
+	}
+	if err != nil {
+		log.Printf("%s: %s: %v", ms.Name, state, err)
+	} else {
+		log.Printf("%s: %s", ms.Name, state)
+	}
+	if m.command != "" {
+		go m.runCommand(ms, state)
+	}
+}
+
+// runCommand runs the -exec command for a state change
+func (m *monitor) runCommand(ms *monitoredService, state string) {
+	cmd := exec.Command(m.command)
+	cmd.Env = append(os.Environ(),
+		"VIRTSOCK_SERVICE="+ms.Name,
+		"VIRTSOCK_ADDR="+ms.Addr,
+		"VIRTSOCK_STATE="+state)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Printf("%s: %s: %v", ms.Name, m.command, err)
+	}
+}
+
+// status returns a copy of the state of all services, sorted by name
+func (m *monitor) status() []monitoredService {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var st []monitoredService
+	for _, ms := range m.services {
+		st = append(st, *ms)
+	}
+	sort.Slice(st, func(i, j int) bool { return st[i].Name < st[j].Name })
+	return st
+}
+
+func (m *monitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/status":
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(m.status())
+	case "/metrics":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		st := m.status()
+		fmt.Fprintf(w, "# HELP virtsock_service_up Whether the service answers pings.\n")
+		fmt.Fprintf(w, "# TYPE virtsock_service_up gauge\n")
+		for _, s := range st {
+			up := 0
+			if s.Up {
+				up = 1
+			}
+			fmt.Fprintf(w, "virtsock_service_up{name=%q,addr=%q} %d\n", s.Name, s.Addr, up)
+		}
+		fmt.Fprintf(w, "# HELP virtsock_service_rtt_seconds Round trip time of the last ping.\n")
+		fmt.Fprintf(w, "# TYPE virtsock_service_rtt_seconds gauge\n")
+		for _, s := range st {
+			if s.Up {
+				fmt.Fprintf(w, "virtsock_service_rtt_seconds{name=%q,addr=%q} %g\n", s.Name, s.Addr, s.RTT/1000)
+			}
+		}
+		fmt.Fprintf(w, "# HELP virtsock_service_flaps_total Number of times the service went up or down.\n")
+		fmt.Fprintf(w, "# TYPE virtsock_service_flaps_total counter\n")
+		for _, s := range st {
+			fmt.Fprintf(w, "virtsock_service_flaps_total{name=%q,addr=%q} %d\n", s.Name, s.Addr, s.Flaps)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
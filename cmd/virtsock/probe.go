@@ -0,0 +1,239 @@
+package main
+
+// The probe command connects to a peer and reports which parts of the
+// pkg/mux protocol it supports, to find out what an old binary on the
+// other side of a VM fleet understands. It sends the magic word, a
+// settings frame offering large frames, a ping and opens a stream, and
+// watches how the peer reacts.
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	fwd "github.com/linuxkit/virtsock/pkg/forward"
+	"github.com/linuxkit/virtsock/pkg/mux/frame"
+)
+
+// probePingID identifies our ping, "vprobe\0\0"
+const probePingID = 0x7670726f62650000
+
+// probeGrace is how long to wait for further frames, e.g. settings,
+// once the ping was answered
+const probeGrace = 200 * time.Millisecond
+
+// probeResult is what was learnt about the peer
+type probeResult struct {
+	Addr string `json:"addr"`
+	// Mux is true if the peer sent the magic word
+	Mux bool `json:"mux"`
+	// Raw holds the first bytes sent by a peer not speaking mux
+	Raw string `json:"raw,omitempty"`
+	// Auth is true if the peer requires shared key authentication
+	Auth bool `json:"auth,omitempty"`
+	// Versions lists the protocol versions in the frame headers
+	Versions []int `json:"versions,omitempty"`
+	// MaxFrameSize is the frame size the peer offered, 0 if it did
+	// not send settings and uses the default frame size
+	MaxFrameSize uint32 `json:"max_frame_size,omitempty"`
+	// Ping is true if the peer answered the ping
+	Ping    bool    `json:"ping"`
+	PingRTT float64 `json:"ping_rtt_ms,omitempty"`
+	// Echo is true if the peer sent our own frames back, i.e. it is a
+	// raw echo service
+	Echo bool `json:"echo,omitempty"`
+	// Stream describes how the peer reacted to the stream we opened
+	Stream string `json:"stream"`
+	// Closed describes how the connection ended, if it did
+	Closed string `json:"closed,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func probeCmd(args []string) int {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 2*time.Second, "Time to wait for the peer")
+	asJSON := fs.Bool("json", false, "Print the results as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: probe [options] endpoint\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	r := probe(fs.Arg(0), *timeout)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(r)
+	} else {
+		printProbe(r)
+	}
+	if r.Error != "" {
+		return 1
+	}
+	return 0
+}
+
+// probe connects to addr and probes the peer
+func probe(addr string, timeout time.Duration) *probeResult {
+	r := &probeResult{Addr: addr}
+	d, err := fwd.Dialer(addr)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	c, err := d(ctx)
+	cancel()
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	defer c.Close()
+	deadline := time.Now().Add(timeout)
+	c.SetDeadline(deadline)
+
+	// Send everything up front, the peer may not read before it has
+	// written its magic word
+	sent := time.Now()
+	go func() {
+		settings := frame.AppendSetting(nil, frame.Setting{ID: frame.SettingMaxFrameSize, Value: frame.MaxLargePayload})
+		ping := make([]byte, frame.PingSize)
+		binary.BigEndian.PutUint64(ping, probePingID)
+		hs := frame.New(frame.Settings, 0, 0, uint32(len(settings)))
+		hp := frame.New(frame.Ping, 0, 0, frame.PingSize)
+		ho := frame.New(frame.Data, frame.FlagSYN, 1, 0)
+		if frame.WriteMagic(c) != nil || frame.WriteFrame(c, &hs, settings) != nil {
+			return
+		}
+		if frame.WriteFrame(c, &hp, ping) != nil {
+			return
+		}
+		frame.WriteFrame(c, &ho, nil)
+	}()
+
+	r.Stream = "no response"
+	if err := frame.ReadMagic(c); err != nil {
+		if me, ok := err.(*frame.MagicError); ok && me.Got == frame.AuthMagic {
+			r.Auth = true
+		} else if ok {
+			r.Raw = fmt.Sprintf("%q", me.Got[:])
+		} else {
+			r.Closed = describeClose(err)
+		}
+		return r
+	}
+	r.Mux = true
+
+	versions := make(map[int]bool)
+	for {
+		var h frame.Header
+		payload, err := frame.ReadFrame(c, &h, frame.MaxLargePayload)
+		if err != nil {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				r.Closed = describeClose(err)
+			}
+			break
+		}
+		versions[int(h.Version)] = true
+		switch {
+		case h.Type == frame.Settings:
+			settings, _ := frame.ParseSettings(payload)
+			for _, s := range settings {
+				if s.ID == frame.SettingMaxFrameSize {
+					r.MaxFrameSize = s.Value
+				}
+			}
+		case h.Type == frame.Pong && len(payload) == frame.PingSize && binary.BigEndian.Uint64(payload) == probePingID:
+			r.Ping = true
+			r.PingRTT = float64(time.Since(sent)) / float64(time.Millisecond)
+			// Wait a little for frames the peer sends on its own
+			if t := time.Now().Add(probeGrace); t.Before(deadline) {
+				c.SetDeadline(t)
+			}
+		case h.Type == frame.Ping && len(payload) == frame.PingSize && binary.BigEndian.Uint64(payload) == probePingID:
+			r.Echo = true
+		case h.StreamID == 1 && h.Type == frame.Data && h.Flags&frame.FlagSYN != 0:
+			// Our own SYN, echoed
+			r.Echo = true
+		case h.StreamID == 1 && h.Type == frame.Data && h.Flags&frame.FlagRST != 0:
+			r.Stream = "refused (reset)"
+		case h.StreamID == 1 && r.Stream == "no response":
+			r.Stream = "accepted"
+			if h.Type == frame.Data && h.Flags&frame.FlagFIN != 0 {
+				r.Stream = "accepted and closed"
+			}
+		}
+	}
+	if r.Echo {
+		r.Mux = false
+	}
+	for v := range versions {
+		r.Versions = append(r.Versions, v)
+	}
+	sort.Ints(r.Versions)
+
+	// Reset the stream we opened before going away
+	c.SetDeadline(time.Now().Add(probeGrace))
+	h := frame.New(frame.Data, frame.FlagRST, 1, 0)
+	frame.WriteFrame(c, &h, nil)
+	return r
+}
+
+func describeClose(err error) string {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return "closed by the peer"
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "no data received"
+	}
+	return err.Error()
+}
+
+func printProbe(r *probeResult) {
+	fmt.Printf("address:      %s\n", r.Addr)
+	if r.Error != "" {
+		fmt.Printf("error:        %s\n", r.Error)
+		return
+	}
+	switch {
+	case r.Echo:
+		fmt.Printf("mux:          no, the peer echoes what it receives\n")
+		return
+	case r.Mux:
+		fmt.Printf("mux:          yes, protocol versions %v\n", r.Versions)
+	case r.Auth:
+		fmt.Printf("mux:          yes, with shared key authentication, which the probe can't pass\n")
+	case r.Raw != "":
+		fmt.Printf("mux:          no, raw stream starting with %s\n", r.Raw)
+	default:
+		fmt.Printf("mux:          no magic word received (%s), a raw service waiting for input?\n", r.Closed)
+	}
+	if !r.Mux {
+		return
+	}
+	if r.MaxFrameSize > 0 {
+		fmt.Printf("large frames: yes, up to %d bytes\n", r.MaxFrameSize)
+	} else {
+		fmt.Printf("large frames: not offered, frames up to %d bytes\n", frame.MaxPayload)
+	}
+	if r.Ping {
+		fmt.Printf("ping:         yes, rtt %.3fms\n", r.PingRTT)
+	} else {
+		fmt.Printf("ping:         no reply (older peer)\n")
+	}
+	fmt.Printf("streams:      %s\n", r.Stream)
+	if r.Closed != "" {
+		fmt.Printf("connection:   %s\n", r.Closed)
+	}
+}
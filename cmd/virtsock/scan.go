@@ -0,0 +1,208 @@
+package main
+
+// The scan command probes a VM, or a range of vsock CIDs, for services
+// accepting connections, like a minimal nmap for vsock and Hyper-V
+// sockets.
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linuxkit/virtsock/pkg/grpcdial"
+	"github.com/linuxkit/virtsock/pkg/hvsock"
+)
+
+// wellKnownPorts are probed if no ports or services are given
+var wellKnownPorts = map[uint32]string{
+	22:   "ssh",
+	1024: "kata-agent",
+	2375: "docker",
+	2376: "docker-tls",
+	5000: "sock_stress",
+}
+
+// scanService is a Hyper-V socket service to probe
+type scanService struct {
+	id   string
+	name string
+}
+
+// scanTarget is a single address to probe
+type scanTarget struct {
+	addr string
+	name string
+}
+
+func scanCmd(args []string) int {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	ports := fs.String("ports", "", "Ports to probe, e.g. 22,1024-1100 (default well-known ports)")
+	services := fs.String("services", "", "Comma separated service GUIDs to probe for hvsock")
+	registered := fs.Bool("registered", false, "Probe the services registered on this host for hvsock (Windows only)")
+	timeout := fs.Duration("timeout", 2*time.Second, "Timeout per probe")
+	concurrency := fs.Int("c", 16, "Number of probes run in parallel")
+	all := fs.Bool("a", false, "Also report closed ports")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "USAGE: scan [options] vsock://CID[-CID] | hvsock://VMID\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	portList, err := parsePorts(*ports)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	var svcList []scanService
+	if *services != "" {
+		for _, s := range strings.Split(*services, ",") {
+			svcList = append(svcList, scanService{id: s})
+		}
+	}
+	if *registered {
+		rs, err := registeredServices()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		svcList = append(svcList, rs...)
+	}
+	targets, err := scanTargets(fs.Arg(0), portList, svcList)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+
+	type result struct {
+		scanTarget
+		err error
+	}
+	results := make([]result, len(targets))
+	sem := make(chan struct{}, *concurrency)
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, t scanTarget) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			defer cancel()
+			c, err := grpcdial.Dial(ctx, t.addr)
+			if err == nil {
+				c.Close()
+			}
+			results[i] = result{t, err}
+		}(i, t)
+	}
+	wg.Wait()
+
+	open := 0
+	for _, r := range results {
+		state := "open"
+		if r.err == context.DeadlineExceeded {
+			state = "timeout"
+		} else if r.err != nil {
+			state = "closed"
+		} else {
+			open++
+		}
+		if r.err == nil || *all {
+			fmt.Printf("%-60s %-8s %s\n", r.addr, state, r.name)
+		}
+	}
+	fmt.Printf("%d of %d probed services accepting connections\n", open, len(results))
+	return 0
+}
+
+// parsePorts parses a list of ports and port ranges
+func parsePorts(s string) ([]uint32, error) {
+	if s == "" {
+		var ports []uint32
+		for p := range wellKnownPorts {
+			ports = append(ports, p)
+		}
+		sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+		return ports, nil
+	}
+	var ports []uint32
+	for _, r := range strings.Split(s, ",") {
+		lo, hi, err := parseRange(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q: %v", r, err)
+		}
+		for p := lo; p <= hi && p >= lo; p++ {
+			ports = append(ports, p)
+		}
+	}
+	return ports, nil
+}
+
+// parseRange parses "N" or "N-M"
+func parseRange(s string) (uint32, uint32, error) {
+	parts := strings.SplitN(s, "-", 2)
+	lo, err := strconv.ParseUint(parts[0], 0, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	hi := lo
+	if len(parts) == 2 {
+		hi, err = strconv.ParseUint(parts[1], 0, 32)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if hi < lo {
+		return 0, 0, fmt.Errorf("empty range")
+	}
+	return uint32(lo), uint32(hi), nil
+}
+
+// scanTargets returns the addresses to probe on the VMs given by addr
+func scanTargets(addr string, ports []uint32, services []scanService) ([]scanTarget, error) {
+	var targets []scanTarget
+	switch {
+	case strings.HasPrefix(addr, "vsock://"):
+		lo, hi, err := parseRange(strings.TrimPrefix(addr, "vsock://"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid CID range %q: %v", addr, err)
+		}
+		for cid := lo; cid <= hi && cid >= lo; cid++ {
+			for _, p := range ports {
+				targets = append(targets, scanTarget{fmt.Sprintf("vsock://%d:%d", cid, p), wellKnownPorts[p]})
+			}
+		}
+	case strings.HasPrefix(addr, "hvsock://"):
+		vmid, err := hvsock.GUIDFromString(strings.TrimPrefix(addr, "hvsock://"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid VM ID %q: %v", addr, err)
+		}
+		if len(services) > 0 {
+			for _, s := range services {
+				if _, err := hvsock.GUIDFromString(s.id); err != nil {
+					return nil, fmt.Errorf("invalid service ID %q: %v", s.id, err)
+				}
+				targets = append(targets, scanTarget{fmt.Sprintf("hvsock://%s:%s", vmid.String(), s.id), s.name})
+			}
+			break
+		}
+		for _, p := range ports {
+			// The service GUID mapping to a vsock port, see hvsock.GUID.Port()
+			svc := fmt.Sprintf("%08x-facb-11e6-bd58-64006a7986d3", p)
+			targets = append(targets, scanTarget{fmt.Sprintf("hvsock://%s:%s", vmid.String(), svc), wellKnownPorts[p]})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported address %q", addr)
+	}
+	return targets, nil
+}
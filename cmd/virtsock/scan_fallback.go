@@ -0,0 +1,11 @@
+// +build !windows
+
+package main
+
+import "fmt"
+
+// registeredServices returns the services registered on this host.
+// Only Hyper-V hosts have a registry of services.
+func registeredServices() ([]scanService, error) {
+	return nil, fmt.Errorf("registered services are only available on Windows")
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"github.com/linuxkit/virtsock/pkg/hvsock"
+)
+
+// registeredServices returns the services registered on this host,
+// which are the ones VMs are allowed to talk to
+func registeredServices() ([]scanService, error) {
+	rs, err := hvsock.ListRegisteredServices()
+	if err != nil {
+		return nil, err
+	}
+	var services []scanService
+	for _, s := range rs {
+		services = append(services, scanService{s.ServiceID.String(), s.Name})
+	}
+	return services, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+// vscp copies files between host and guest over a Hyper-V or virtio
+// socket, like scp, using pkg/vscp. The guest runs a server and the
+// host copies to or from it.
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	fwd "github.com/linuxkit/virtsock/pkg/forward"
+	"github.com/linuxkit/virtsock/pkg/vscp"
+)
+
+var (
+	recursive bool
+	quiet     bool
+	serve     string
+	root      string
+	readOnly  bool
+	timeout   time.Duration
+)
+
+func init() {
+	flag.BoolVar(&recursive, "r", false, "Copy directories recursively")
+	flag.BoolVar(&quiet, "q", false, "Don't print progress")
+	flag.StringVar(&serve, "serve", "", "Serve requests on this endpoint, e.g. vsock://:5555")
+	flag.StringVar(&root, "root", "/", "Directory the paths of requests are relative to when serving")
+	flag.BoolVar(&readOnly, "read-only", false, "Refuse to receive files when serving")
+	flag.DurationVar(&timeout, "timeout", 10*time.Second, "Timeout for connecting")
+
+	flag.Usage = func() {
+		prog := filepath.Base(os.Args[0])
+		fmt.Fprintf(os.Stderr, "USAGE: %s [options] <src> <dst>\n", prog)
+		fmt.Fprintf(os.Stderr, "       %s -serve <endpoint> [-root dir] [-read-only]\n\n", prog)
+		fmt.Fprintf(os.Stderr, "Copy files to or from a vscp server. Exactly one of src and dst\n")
+		fmt.Fprintf(os.Stderr, "is remote, of the form vsock://CID:Port/path,\n")
+		fmt.Fprintf(os.Stderr, "hvsock://VMID:ServiceID/path or tcp://host:port/path.\n")
+		fmt.Fprintf(os.Stderr, "Interrupted copies resume when run again.\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "Examples:\n")
+		fmt.Fprintf(os.Stderr, "  %s -serve vsock://:5555                 Serve files in the guest\n", prog)
+		fmt.Fprintf(os.Stderr, "  %s app.tar vsock://3:5555/tmp/          Copy app.tar to /tmp in the VM with CID 3\n", prog)
+		fmt.Fprintf(os.Stderr, "  %s -r vsock://3:5555/var/log logs       Copy /var/log from the VM to logs\n", prog)
+	}
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix(filepath.Base(os.Args[0]) + ": ")
+	flag.Parse()
+
+	if serve != "" {
+		if flag.NArg() != 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		l, err := fwd.Listen(serve)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s := &vscp.Server{Root: root, ReadOnly: readOnly}
+		log.Fatal(s.Serve(l))
+	}
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	src, dst := flag.Arg(0), flag.Arg(1)
+	srcEndpoint, srcPath, srcRemote := splitRemote(src)
+	dstEndpoint, dstPath, dstRemote := splitRemote(dst)
+	if srcRemote == dstRemote {
+		log.Fatal("exactly one of src and dst must be remote")
+	}
+
+	endpoint := dstEndpoint
+	if srcRemote {
+		endpoint = srcEndpoint
+	}
+	d, err := fwd.Dialer(endpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	c, err := d(ctx)
+	cancel()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+
+	opts := &vscp.Options{Recursive: recursive}
+	if !quiet {
+		opts.Progress = (&progress{}).update
+	}
+	if srcRemote {
+		err = vscp.Pull(c, srcPath, dst, opts)
+	} else {
+		err = vscp.Push(c, src, dstPath, opts)
+	}
+	if !quiet {
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// splitRemote splits a remote path into the endpoint and the path on
+// the server. remote is false for local paths.
+func splitRemote(s string) (endpoint, path string, remote bool) {
+	i := strings.Index(s, "://")
+	if i < 0 {
+		return "", s, false
+	}
+	j := strings.Index(s[i+3:], "/")
+	if j < 0 {
+		return s, "/", true
+	}
+	return s[:i+3+j], s[i+3+j:], true
+}
+
+// progress prints the progress of the file being copied, at most a few
+// times per second
+type progress struct {
+	lock  sync.Mutex
+	path  string
+	start time.Time
+	base  int64 // bytes done when the file was first seen, e.g. resumed
+	last  time.Time
+}
+
+func (p *progress) update(path string, done, size int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	if path != p.path {
+		if p.path != "" {
+			fmt.Fprintf(os.Stderr, "\n")
+		}
+		p.path, p.start, p.base = path, now, done
+	} else if done < size && now.Sub(p.last) < 200*time.Millisecond {
+		return
+	}
+	p.last = now
+	pct := 100.0
+	if size > 0 {
+		pct = float64(done) * 100 / float64(size)
+	}
+	var rate float64
+	if d := now.Sub(p.start).Seconds(); d > 0 {
+		rate = float64(done-p.base) / d / (1024 * 1024)
+	}
+	fmt.Fprintf(os.Stderr, "\r%-50s %5.1f%% %12d bytes %8.2f MB/s", path, pct, done, rate)
+}
@@ -0,0 +1,138 @@
+package main
+
+// vsockcat connects stdin and stdout to a hvsock or vsock connection,
+// like netcat, to debug guest services interactively.
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/linuxkit/virtsock/pkg/grpcdial"
+	"github.com/linuxkit/virtsock/pkg/mux"
+)
+
+var (
+	listen    bool
+	framed    bool
+	halfClose bool
+	verbose   bool
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+func init() {
+	flag.BoolVar(&listen, "l", false, "Listen for a single connection instead of connecting")
+	flag.BoolVar(&framed, "framed", false, "Use a stream of a pkg/mux session instead of the raw connection")
+	flag.BoolVar(&halfClose, "half-close", true, "On EOF on stdin only close the write side of the connection, otherwise close the connection")
+	flag.BoolVar(&verbose, "v", false, "Print connection details to stderr")
+
+	flag.Usage = func() {
+		prog := filepath.Base(os.Args[0])
+		fmt.Fprintf(os.Stderr, "USAGE: %s [options] <address>\n\n", prog)
+		fmt.Fprintf(os.Stderr, "Connect stdin and stdout to a Hyper-V or virtio socket.\n")
+		fmt.Fprintf(os.Stderr, "Addresses are of the form vsock://CID:Port or\n")
+		fmt.Fprintf(os.Stderr, "hvsock://VMID:ServiceID. When listening the CID or VMID\n")
+		fmt.Fprintf(os.Stderr, "may be omitted.\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "Examples:\n")
+		fmt.Fprintf(os.Stderr, "  %s vsock://3:1024      Connect to port 1024 of the VM with CID 3\n", prog)
+		fmt.Fprintf(os.Stderr, "  %s -l vsock://:1024    Wait for a connection on port 1024\n", prog)
+	}
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix(filepath.Base(os.Args[0]) + ": ")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	addr := flag.Arg(0)
+
+	c, err := connect(addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if verbose {
+		log.Printf("connected %s -> %s", c.LocalAddr(), c.RemoteAddr())
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		_, err := io.Copy(c, os.Stdin)
+		if err != nil {
+			log.Printf("write: %v", err)
+		}
+		if cw, ok := c.(closeWriter); ok && halfClose {
+			cw.CloseWrite()
+			return
+		}
+		close(closed)
+		c.Close()
+	}()
+
+	if _, err := io.Copy(os.Stdout, c); err != nil {
+		select {
+		case <-closed:
+			// Reading was aborted by closing the connection
+		default:
+			log.Fatalf("read: %v", err)
+		}
+	}
+	c.Close()
+}
+
+// connect dials addr, or accepts a single connection on it, and sets
+// up a mux stream on the connection if requested
+func connect(addr string) (net.Conn, error) {
+	var c net.Conn
+	var err error
+	if listen {
+		var l net.Listener
+		l, err = grpcdial.Listen(addr)
+		if err != nil {
+			return nil, err
+		}
+		if verbose {
+			log.Printf("listening on %s", l.Addr())
+		}
+		c, err = l.Accept()
+		l.Close()
+	} else {
+		c, err = grpcdial.Dial(context.Background(), addr)
+	}
+	if err != nil || !framed {
+		return c, err
+	}
+
+	var s *mux.Session
+	var st *mux.Stream
+	if listen {
+		s, err = mux.Server(c, nil)
+		if err == nil {
+			st, err = s.AcceptStream()
+		}
+	} else {
+		s, err = mux.Client(c, nil)
+		if err == nil {
+			st, err = s.Open()
+		}
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return st, nil
+}
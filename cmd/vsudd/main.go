@@ -3,7 +3,6 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"log/syslog"
 	"net"
@@ -14,6 +13,7 @@ import (
 	"syscall"
 
 	"github.com/linuxkit/virtsock/pkg/hvsock"
+	"github.com/linuxkit/virtsock/pkg/proxy"
 	"github.com/linuxkit/virtsock/pkg/vsock"
 )
 
@@ -216,39 +216,9 @@ func handleOneIn(connid int, conn vConn, sock string) {
 		}
 	}()
 
-	w := make(chan int64)
-	go func() {
-		n, err := io.Copy(conn, docker)
-		if err != nil {
-			log.Println(connid, "error copying from docker to vsock:", err)
-		}
-
-		err = docker.CloseRead()
-		if err != nil {
-			log.Println(connid, "error CloseRead on docker socket:", err)
-		}
-		err = conn.CloseWrite()
-		if err != nil {
-			log.Println(connid, "error CloseWrite on vsock:", err)
-		}
-		w <- n
-	}()
-
-	n, err := io.Copy(docker, conn)
-	if err != nil {
-		log.Println(connid, "error copying from vsock to docker:", err)
-	}
-	totalRead := n
-
-	err = docker.CloseWrite()
+	stats, err := proxy.Copy(conn, docker)
 	if err != nil {
-		log.Println(connid, "error CloseWrite on docker socket:", err)
+		log.Println(connid, "error proxying between vsock and docker:", err)
 	}
-	err = conn.CloseRead()
-	if err != nil {
-		log.Println(connid, "error CloseRead on vsock:", err)
-	}
-
-	totalWritten := <-w
-	log.Println(connid, "Done. read:", totalRead, "written:", totalWritten)
+	log.Println(connid, "Done. read:", stats.AToB, "written:", stats.BToA)
 }
@@ -0,0 +1,277 @@
+// Package agent is a framework for guest agents offering several
+// services over Hyper-V or virtio sockets, much like net/http is for
+// HTTP servers. The agent owns the listeners, restarts them if they
+// fail, e.g. because the transport was reset while the VM was
+// suspended, checks connections against per-service access rules and
+// passes them through middleware to the handlers:
+//
+//	a := agent.New()
+//	a.Use(logConnections)
+//	a.HandleFunc("vsock://:1024", serveShell)
+//	a.Handle(agent.Service{
+//		Addr:    "hvsock://:3049197c-facb-11e6-bd58-64006a7986d3",
+//		Handler: metrics,
+//		ACL:     onlyFromHost,
+//	})
+//	err := a.Serve(ctx)
+//
+// Services are identified by addresses as understood by
+// grpcdial.Listen(), that is by port for vsock and by service GUID for
+// Hyper-V sockets.
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/linuxkit/virtsock/pkg/grpcdial"
+	"github.com/linuxkit/virtsock/pkg/netutil"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultRestartDelay is the initial delay before a failed
+	// listener is restarted. The delay doubles on every consecutive
+	// failure up to MaxRestartDelay.
+	DefaultRestartDelay = 100 * time.Millisecond
+	// MaxRestartDelay is the longest delay between restarts
+	MaxRestartDelay = 10 * time.Second
+)
+
+// Handler serves a connection. The connection is closed once
+// ServeConn returns.
+type Handler interface {
+	ServeConn(c net.Conn)
+}
+
+// HandlerFunc adapts a function to a Handler
+type HandlerFunc func(c net.Conn)
+
+// ServeConn calls f(c)
+func (f HandlerFunc) ServeConn(c net.Conn) {
+	f(c)
+}
+
+// Middleware wraps a handler, e.g. to log or authenticate connections
+type Middleware func(Handler) Handler
+
+// Service describes a service offered by the agent
+type Service struct {
+	// Addr is the address to listen on, e.g. "vsock://:1024"
+	Addr    string
+	Handler Handler
+	// ACL, if set, is called for every connection accepted. If it
+	// returns an error, the connection is closed without being
+	// passed to the handler.
+	ACL func(c net.Conn) error
+	// Middleware is applied to the handler of this service, after
+	// the middleware of the agent. The first entry is the outermost.
+	Middleware []Middleware
+	// MaxConns limits the number of connections served at the same
+	// time. 0 means no limit.
+	MaxConns int
+}
+
+// Agent runs a set of services
+type Agent struct {
+	// Listen is used to listen on service addresses. It defaults to
+	// grpcdial.Listen.
+	Listen func(addr string) (net.Listener, error)
+	// ErrorLog, if set, is called with listener failures, rejected
+	// connections and handler panics
+	ErrorLog func(error)
+
+	lock       sync.Mutex
+	services   []Service
+	middleware []Middleware
+	running    bool
+}
+
+// New returns an agent without services
+func New() *Agent {
+	return &Agent{Listen: grpcdial.Listen}
+}
+
+// Use adds middleware applied to the handlers of all services. The
+// first middleware added is the outermost.
+func (a *Agent) Use(mw ...Middleware) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.middleware = append(a.middleware, mw...)
+}
+
+// Handle registers a service. Services must be registered before
+// Serve() is called and each address may only be used once.
+func (a *Agent) Handle(s Service) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.running {
+		return errors.New("agent already running")
+	}
+	if s.Handler == nil {
+		return fmt.Errorf("no handler for %s", s.Addr)
+	}
+	for _, o := range a.services {
+		if o.Addr == s.Addr {
+			return fmt.Errorf("service %s registered twice", s.Addr)
+		}
+	}
+	a.services = append(a.services, s)
+	return nil
+}
+
+// HandleFunc registers f to serve connections to addr
+func (a *Agent) HandleFunc(addr string, f func(c net.Conn)) error {
+	return a.Handle(Service{Addr: addr, Handler: HandlerFunc(f)})
+}
+
+// Serve runs all services until ctx is done. It then closes the
+// listeners and connections and waits for the handlers to return
+// before returning ctx.Err(). Listeners which fail are restarted, so
+// Serve only returns early if it is called twice or without services.
+func (a *Agent) Serve(ctx context.Context) error {
+	a.lock.Lock()
+	if a.running {
+		a.lock.Unlock()
+		return errors.New("agent already running")
+	}
+	if len(a.services) == 0 {
+		a.lock.Unlock()
+		return errors.New("no services registered")
+	}
+	a.running = true
+	services := append([]Service(nil), a.services...)
+	middleware := append([]Middleware(nil), a.middleware...)
+	a.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, s := range services {
+		h := s.Handler
+		mw := append(append([]Middleware(nil), middleware...), s.Middleware...)
+		for i := len(mw) - 1; i >= 0; i-- {
+			h = mw[i](h)
+		}
+		r := &runner{agent: a, service: s, handler: h}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.run(ctx)
+		}()
+	}
+	wg.Wait()
+
+	a.lock.Lock()
+	a.running = false
+	a.lock.Unlock()
+	return ctx.Err()
+}
+
+func (a *Agent) logError(err error) {
+	if a.ErrorLog != nil {
+		a.ErrorLog(err)
+	}
+}
+
+// runner keeps the listener of a service running
+type runner struct {
+	agent   *Agent
+	service Service
+	handler Handler
+
+	lock  sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+func (r *runner) run(ctx context.Context) {
+	r.conns = make(map[net.Conn]struct{})
+	delay := DefaultRestartDelay
+	for ctx.Err() == nil {
+		start := time.Now()
+		err := r.listen(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+		r.agent.logError(errors.Wrapf(err, "service %s", r.service.Addr))
+		// Back off if the listener keeps failing straight away
+		if time.Since(start) > MaxRestartDelay {
+			delay = DefaultRestartDelay
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		if delay *= 2; delay > MaxRestartDelay {
+			delay = MaxRestartDelay
+		}
+	}
+
+	r.lock.Lock()
+	for c := range r.conns {
+		c.Close()
+	}
+	r.lock.Unlock()
+	r.wg.Wait()
+}
+
+// listen listens on the service address and serves connections until
+// the listener fails or ctx is done
+func (r *runner) listen(ctx context.Context) error {
+	l, err := r.agent.Listen(r.service.Addr)
+	if err != nil {
+		return err
+	}
+	if r.service.ACL != nil {
+		l = netutil.AuditListener(l, netutil.AuditConfig{
+			Allow: r.service.ACL,
+			Audit: func(rec netutil.AuditRecord) {
+				if !rec.Accepted {
+					r.agent.logError(fmt.Errorf("service %s: rejected %s: %s", r.service.Addr, rec.Remote, rec.Reason))
+				}
+			},
+		})
+	}
+	if r.service.MaxConns > 0 {
+		l = netutil.LimitListener(l, r.service.MaxConns, netutil.LimitDelay)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-stop:
+		}
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			l.Close()
+			return err
+		}
+		r.lock.Lock()
+		r.conns[c] = struct{}{}
+		r.lock.Unlock()
+		r.wg.Add(1)
+		go r.serve(c)
+	}
+}
+
+func (r *runner) serve(c net.Conn) {
+	defer r.wg.Done()
+	defer func() {
+		if p := recover(); p != nil {
+			r.agent.logError(fmt.Errorf("service %s: panic serving %s: %v", r.service.Addr, c.RemoteAddr(), p))
+		}
+		c.Close()
+		r.lock.Lock()
+		delete(r.conns, c)
+		r.lock.Unlock()
+	}()
+	r.handler.ServeConn(c)
+}
@@ -0,0 +1,172 @@
+// Package bench measures the throughput and latency of stream
+// connections, such as those provided by the hvsock, vsock and mux
+// packages. It lets users compare configurations, e.g. raw
+// connections against mux streams or different message sizes, without
+// writing their own harness.
+//
+// One side of the connection runs Echo(), the other runs Latency() or
+// Throughput():
+//
+//	// server
+//	c, _ := l.Accept()
+//	bench.Echo(c)
+//
+//	// client
+//	c, _ := vsock.Dial(cid, port)
+//	r, err := bench.Latency(c, 64, 10000)
+//	fmt.Println(r)
+package bench
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Result holds the results of a benchmark run.
+type Result struct {
+	MsgSize  int           // size of each message in bytes
+	Messages int           // number of messages sent
+	Bytes    int64         // total number of bytes sent
+	Duration time.Duration // wall clock time of the run
+
+	// Round trip latencies. Only set by Latency().
+	Min, P50, P99, Max time.Duration
+}
+
+// Throughput returns the throughput in bytes per second
+func (r *Result) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Duration.Seconds()
+}
+
+func (r *Result) String() string {
+	s := fmt.Sprintf("%d x %d bytes in %s: %.2f MB/s",
+		r.Messages, r.MsgSize, r.Duration, r.Throughput()/(1000*1000))
+	if r.Max > 0 {
+		s += fmt.Sprintf(", latency min=%s p50=%s p99=%s max=%s",
+			r.Min, r.P50, r.P99, r.Max)
+	}
+	return s
+}
+
+// closeWriter is implemented by connections supporting half-close
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Echo writes everything read from c back to it until the peer closes
+// its write side. It then closes the write side of c, if supported, so
+// the peer sees EOF. It does not close c.
+func Echo(c net.Conn) error {
+	_, err := io.Copy(c, c)
+	if cw, ok := c.(closeWriter); ok {
+		if cerr := cw.CloseWrite(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Latency sends n messages of size bytes over c, one at a time,
+// waiting for each to be echoed back by the peer before sending the
+// next, and checks that every message comes back unchanged. It
+// reports the distribution of the round trip times. The peer must
+// run Echo().
+func Latency(c net.Conn, size, n int) (*Result, error) {
+	if size <= 0 || n <= 0 {
+		return nil, fmt.Errorf("invalid message size %d or count %d", size, n)
+	}
+	msg := pattern(size)
+	buf := make([]byte, size)
+	rtts := make([]time.Duration, n)
+
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		t := time.Now()
+		if _, err := c.Write(msg); err != nil {
+			return nil, errors.Wrapf(err, "write of message %d failed", i)
+		}
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return nil, errors.Wrapf(err, "read of message %d failed", i)
+		}
+		rtts[i] = time.Since(t)
+		if !bytes.Equal(buf, msg) {
+			return nil, fmt.Errorf("echoed data of message %d does not match", i)
+		}
+	}
+	r := &Result{
+		MsgSize:  size,
+		Messages: n,
+		Bytes:    int64(size) * int64(n),
+		Duration: time.Since(start),
+	}
+
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	r.Min = rtts[0]
+	r.P50 = percentile(rtts, 50)
+	r.P99 = percentile(rtts, 99)
+	r.Max = rtts[n-1]
+	return r, nil
+}
+
+// Throughput sends n messages of size bytes over c as fast as possible
+// while concurrently reading back the data echoed by the peer. The run
+// completes once all data has been echoed. The peer must run Echo().
+func Throughput(c net.Conn, size, n int) (*Result, error) {
+	if size <= 0 || n <= 0 {
+		return nil, fmt.Errorf("invalid message size %d or count %d", size, n)
+	}
+	msg := pattern(size)
+	total := int64(size) * int64(n)
+
+	start := time.Now()
+	werr := make(chan error, 1)
+	go func() {
+		for i := 0; i < n; i++ {
+			if _, err := c.Write(msg); err != nil {
+				werr <- errors.Wrapf(err, "write of message %d failed", i)
+				return
+			}
+		}
+		werr <- nil
+	}()
+
+	got, err := io.CopyN(ioutil.Discard, c, total)
+	r := &Result{
+		MsgSize:  size,
+		Messages: n,
+		Bytes:    got,
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		return r, errors.Wrap(err, "read failed")
+	}
+	return r, <-werr
+}
+
+// pattern returns a buffer of n bytes with a recognisable pattern
+func pattern(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+// percentile returns the p-th percentile of the sorted durations d
+func percentile(d []time.Duration, p int) time.Duration {
+	i := (len(d)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return d[i]
+}
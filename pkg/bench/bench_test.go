@@ -0,0 +1,128 @@
+package bench
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/linuxkit/virtsock/pkg/mux"
+)
+
+// transports lists the connections to benchmark, each connected to
+// a peer running Echo()
+var transports = []struct {
+	name string
+	dial func(b *testing.B) net.Conn
+}{
+	{"pipe", dialPipe},
+	{"tcp", dialTCP},
+	{"mux", dialMux},
+}
+
+func dialPipe(b *testing.B) net.Conn {
+	c, s := net.Pipe()
+	go Echo(s)
+	b.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return c
+}
+
+func dialTCP(b *testing.B) net.Conn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Skip(err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		Echo(s)
+		s.Close()
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { c.Close() })
+	return c
+}
+
+func dialMux(b *testing.B) net.Conn {
+	a, z := net.Pipe()
+	var cs, ss *mux.Session
+	var cerr, serr error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		cs, cerr = mux.Client(a, nil)
+	}()
+	go func() {
+		defer wg.Done()
+		ss, serr = mux.Server(z, nil)
+	}()
+	wg.Wait()
+	if cerr != nil || serr != nil {
+		b.Fatalf("handshake failed: client %v, server %v", cerr, serr)
+	}
+	b.Cleanup(func() {
+		cs.Close()
+		ss.Close()
+	})
+	go func() {
+		st, err := ss.AcceptStream()
+		if err != nil {
+			return
+		}
+		Echo(st)
+		st.Close()
+	}()
+	c, err := cs.OpenStream()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return c
+}
+
+func BenchmarkThroughput(b *testing.B) {
+	for _, tr := range transports {
+		for _, size := range []int{4 * 1024, 64 * 1024} {
+			b.Run(tr.name+"/"+sizeName(size), func(b *testing.B) {
+				c := tr.dial(b)
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				if _, err := Throughput(c, size, b.N); err != nil {
+					b.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkLatency(b *testing.B) {
+	for _, tr := range transports {
+		for _, size := range []int{64, 4 * 1024} {
+			b.Run(tr.name+"/"+sizeName(size), func(b *testing.B) {
+				c := tr.dial(b)
+				b.ResetTimer()
+				r, err := Latency(c, size, b.N)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.ReportMetric(float64(r.P99.Nanoseconds()), "p99-ns")
+			})
+		}
+	}
+}
+
+func sizeName(size int) string {
+	if size >= 1024 {
+		return strconv.Itoa(size/1024) + "KiB"
+	}
+	return strconv.Itoa(size) + "B"
+}
@@ -0,0 +1,249 @@
+// Package conntable keeps a table of live connections and multiplexed
+// sessions and renders it over HTTP, similar to /debug/pprof but for
+// virtsock state. It is opt-in: only connections explicitly registered
+// are shown. Mount the table on an existing debug server with:
+//
+//	t := conntable.New()
+//	l = t.Listener(l)
+//	http.Handle("/debug/virtsock", t)
+//
+// The table is rendered as HTML, or as JSON with ?format=json.
+package conntable
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/linuxkit/virtsock/pkg/mux"
+	"github.com/linuxkit/virtsock/pkg/netutil"
+)
+
+// Entry describes a connection or session in the table
+type Entry struct {
+	Kind          string        `json:"kind"` // "conn" or "session"
+	Network       string        `json:"network"`
+	Local         string        `json:"local"`
+	Remote        string        `json:"remote"`
+	State         string        `json:"state"`
+	BytesSent     uint64        `json:"bytes_sent"`
+	BytesReceived uint64        `json:"bytes_received"`
+	Streams       int           `json:"streams,omitempty"` // sessions only
+	Created       time.Time     `json:"created"`
+	Age           time.Duration `json:"age_ns"`
+}
+
+// Table tracks connections and sessions. It implements http.Handler.
+// It is safe for concurrent use.
+type Table struct {
+	lock     sync.Mutex
+	conns    map[*trackedConn]struct{}
+	sessions map[*mux.Session]time.Time
+}
+
+// New returns an empty table
+func New() *Table {
+	return &Table{
+		conns:    make(map[*trackedConn]struct{}),
+		sessions: make(map[*mux.Session]time.Time),
+	}
+}
+
+type trackedListener struct {
+	net.Listener
+	t *Table
+}
+
+func (tl *trackedListener) Accept() (net.Conn, error) {
+	c, err := tl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tl.t.Conn(c), nil
+}
+
+// Listener returns a listener which adds every connection accepted
+// from l to the table
+func (t *Table) Listener(l net.Listener) net.Listener {
+	return &trackedListener{Listener: l, t: t}
+}
+
+// Conn adds c, e.g. a dialled connection, to the table. The returned
+// connection must be used in place of c, so that traffic is counted.
+// It is removed from the table when closed and supports half-close if
+// c does.
+func (t *Table) Conn(c net.Conn) net.Conn {
+	tc := &trackedConn{Conn: c, t: t, created: time.Now()}
+	t.lock.Lock()
+	t.conns[tc] = struct{}{}
+	t.lock.Unlock()
+	return tc
+}
+
+// AddSession adds a multiplexed session to the table. Its traffic is
+// taken from Session.Stats(). Sessions are removed from the table once
+// they have been shut down.
+func (t *Table) AddSession(s *mux.Session) {
+	t.lock.Lock()
+	t.sessions[s] = time.Now()
+	t.lock.Unlock()
+	go func() {
+		<-s.CloseChan()
+		t.lock.Lock()
+		delete(t.sessions, s)
+		t.lock.Unlock()
+	}()
+}
+
+// Entries returns a snapshot of the table, oldest entries first
+func (t *Table) Entries() []Entry {
+	now := time.Now()
+	t.lock.Lock()
+	entries := make([]Entry, 0, len(t.conns)+len(t.sessions))
+	for c := range t.conns {
+		entries = append(entries, c.entry(now))
+	}
+	for s, created := range t.sessions {
+		stats := s.Stats()
+		entries = append(entries, Entry{
+			Kind:          "session",
+			Network:       network(s.LocalAddr()),
+			Local:         fmt.Sprint(s.LocalAddr()),
+			Remote:        fmt.Sprint(s.RemoteAddr()),
+			State:         "open",
+			BytesSent:     stats.BytesSent,
+			BytesReceived: stats.BytesReceived,
+			Streams:       stats.Streams,
+			Created:       created,
+			Age:           now.Sub(created),
+		})
+	}
+	t.lock.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	return entries
+}
+
+func (t *Table) remove(c *trackedConn) {
+	t.lock.Lock()
+	delete(t.conns, c)
+	t.lock.Unlock()
+}
+
+// ServeHTTP renders the table as HTML, or as JSON if the format query
+// parameter is "json"
+func (t *Table) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	entries := t.Entries()
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(entries)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tableTemplate.Execute(w, entries); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var tableTemplate = template.Must(template.New("table").Parse(`<html>
+<head><title>virtsock connections</title></head>
+<body>
+<p>{{len .}} connections and sessions</p>
+<table border="1">
+<tr><th>Kind</th><th>Network</th><th>Local</th><th>Remote</th><th>State</th><th>Sent</th><th>Received</th><th>Streams</th><th>Age</th></tr>
+{{range .}}<tr><td>{{.Kind}}</td><td>{{.Network}}</td><td>{{.Local}}</td><td>{{.Remote}}</td><td>{{.State}}</td><td>{{.BytesSent}}</td><td>{{.BytesReceived}}</td><td>{{if eq .Kind "session"}}{{.Streams}}{{end}}</td><td>{{.Age}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func network(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.Network()
+}
+
+// trackedConn counts the traffic of a connection in the table
+type trackedConn struct {
+	// Accessed atomically, first to keep them 64-bit aligned on
+	// 32-bit platforms
+	sent        uint64
+	received    uint64
+	readClosed  int32
+	writeClosed int32
+
+	net.Conn
+	t       *Table
+	created time.Time
+
+	removeOnce sync.Once
+}
+
+func (c *trackedConn) entry(now time.Time) Entry {
+	state := "open"
+	rc := atomic.LoadInt32(&c.readClosed) != 0
+	wc := atomic.LoadInt32(&c.writeClosed) != 0
+	switch {
+	case rc && wc:
+		state = "read and write closed"
+	case rc:
+		state = "read closed"
+	case wc:
+		state = "write closed"
+	}
+	return Entry{
+		Kind:          "conn",
+		Network:       network(c.LocalAddr()),
+		Local:         fmt.Sprint(c.LocalAddr()),
+		Remote:        fmt.Sprint(c.RemoteAddr()),
+		State:         state,
+		BytesSent:     atomic.LoadUint64(&c.sent),
+		BytesReceived: atomic.LoadUint64(&c.received),
+		Created:       c.created,
+		Age:           now.Sub(c.created),
+	}
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.received, uint64(n))
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.sent, uint64(n))
+	return n, err
+}
+
+func (c *trackedConn) CloseRead() error {
+	err := netutil.CloseRead(c.Conn)
+	if err == nil {
+		atomic.StoreInt32(&c.readClosed, 1)
+	}
+	return err
+}
+
+func (c *trackedConn) CloseWrite() error {
+	err := netutil.CloseWrite(c.Conn)
+	if err == nil {
+		atomic.StoreInt32(&c.writeClosed, 1)
+	}
+	return err
+}
+
+func (c *trackedConn) Close() error {
+	c.removeOnce.Do(func() { c.t.remove(c) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,233 @@
+// Package execstream carries the standard streams, terminal size
+// changes and exit status of a process running in a VM over a single
+// hvsock or vsock connection. It is the building block for container
+// runtimes and tools which "exec" into a VM.
+//
+// The host side starts the exchange with Start() and the guest side,
+// which runs the process, with Attach():
+//
+//	// guest
+//	a, err := execstream.Attach(conn)
+//	...
+//	cmd.Stdin, cmd.Stdout, cmd.Stderr = a.Stdin, a.Stdout, a.Stderr
+//	err = cmd.Run()
+//	a.Exit(cmd.ProcessState.ExitCode())
+//
+//	// host
+//	p, err := execstream.Start(conn)
+//	...
+//	go io.Copy(p.Stdin, os.Stdin)
+//	go io.Copy(os.Stderr, p.Stderr)
+//	io.Copy(os.Stdout, p.Stdout)
+//	code, err := p.Wait()
+//
+// The connection carries a pkg/mux session with four streams: a
+// control stream for resize and exit messages, followed by stdin,
+// stdout and stderr.
+package execstream
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+
+	"github.com/linuxkit/virtsock/pkg/mux"
+	"github.com/pkg/errors"
+)
+
+// Control message types
+const (
+	msgResize = 'r' // width and height, 2 bytes each
+	msgExit   = 'x' // exit status, 4 bytes
+)
+
+var (
+	// ErrNoExitStatus is returned by Wait() if the connection was
+	// lost before the guest reported the exit status
+	ErrNoExitStatus = errors.New("no exit status received")
+)
+
+// Resize is a change of the terminal size of the process
+type Resize struct {
+	Width  uint16
+	Height uint16
+}
+
+// Process is the host side of a process running in the guest
+type Process struct {
+	// Stdin is the standard input of the process. Closing it closes
+	// the standard input of the process.
+	Stdin io.WriteCloser
+	// Stdout and Stderr read the output of the process. They return
+	// io.EOF once the process closed them.
+	Stdout io.Reader
+	Stderr io.Reader
+
+	session *mux.Session
+	ctrl    *mux.Stream
+}
+
+// Start sets up the host side of the exchange over conn. conn is
+// closed by Close() or once Wait() returns.
+func Start(conn net.Conn) (*Process, error) {
+	s, err := mux.Client(conn, nil)
+	if err != nil {
+		return nil, err
+	}
+	var streams [4]*mux.Stream
+	for i := range streams {
+		streams[i], err = s.Open()
+		if err != nil {
+			s.Close()
+			return nil, errors.Wrap(err, "open exec stream")
+		}
+	}
+	// The guest does not write to stdin, nor read from the output
+	// streams
+	streams[1].CloseRead()
+	streams[2].CloseWrite()
+	streams[3].CloseWrite()
+	return &Process{
+		Stdin:   streams[1],
+		Stdout:  streams[2],
+		Stderr:  streams[3],
+		session: s,
+		ctrl:    streams[0],
+	}, nil
+}
+
+// Resize tells the guest that the terminal size changed
+func (p *Process) Resize(width, height uint16) error {
+	msg := []byte{msgResize, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(msg[1:], width)
+	binary.BigEndian.PutUint16(msg[3:], height)
+	return p.ctrl.WriteMsg(msg)
+}
+
+// Wait waits for the process to exit and returns its exit status. As
+// with os/exec, Stdout and Stderr should be read until EOF before
+// calling Wait(), as it closes the connection and any output not read
+// by then is lost.
+func (p *Process) Wait() (int, error) {
+	defer p.Close()
+	for {
+		msg, err := p.ctrl.ReadMsg()
+		if err == io.EOF {
+			return 0, ErrNoExitStatus
+		}
+		if err != nil {
+			return 0, errors.Wrap(err, "wait")
+		}
+		if len(msg) == 5 && msg[0] == msgExit {
+			return int(int32(binary.BigEndian.Uint32(msg[1:]))), nil
+		}
+		// Skip unknown messages
+	}
+}
+
+// Close closes the connection. The guest sees its stdin and control
+// stream closed.
+func (p *Process) Close() error {
+	return p.session.Close()
+}
+
+// Attached is the guest side of the exchange, to be connected to the
+// process being run
+type Attached struct {
+	Stdin  io.ReadCloser
+	Stdout io.WriteCloser
+	Stderr io.WriteCloser
+
+	session *mux.Session
+	ctrl    *mux.Stream
+	resize  chan Resize
+	ctrlEOF chan struct{}
+}
+
+// Attach sets up the guest side of the exchange over conn
+func Attach(conn net.Conn) (*Attached, error) {
+	s, err := mux.Server(conn, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Streams are accepted in the order they were opened, but sort
+	// them by ID to not rely on it
+	streams := make([]*mux.Stream, 4)
+	for i := range streams {
+		streams[i], err = s.AcceptStream()
+		if err != nil {
+			s.Close()
+			return nil, errors.Wrap(err, "accept exec stream")
+		}
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].ID() < streams[j].ID() })
+	streams[1].CloseWrite()
+	streams[2].CloseRead()
+	streams[3].CloseRead()
+
+	a := &Attached{
+		Stdin:   streams[1],
+		Stdout:  streams[2],
+		Stderr:  streams[3],
+		session: s,
+		ctrl:    streams[0],
+		resize:  make(chan Resize, 1),
+		ctrlEOF: make(chan struct{}),
+	}
+	go a.readCtrl()
+	return a, nil
+}
+
+// Resizes returns a channel receiving terminal size changes requested
+// by the host. Only the latest size is kept if the receiver falls
+// behind. The channel is closed once the host closed the connection.
+func (a *Attached) Resizes() <-chan Resize {
+	return a.resize
+}
+
+func (a *Attached) readCtrl() {
+	defer close(a.ctrlEOF)
+	defer close(a.resize)
+	for {
+		msg, err := a.ctrl.ReadMsg()
+		if err != nil {
+			return
+		}
+		if len(msg) != 5 || msg[0] != msgResize {
+			continue
+		}
+		r := Resize{
+			Width:  binary.BigEndian.Uint16(msg[1:]),
+			Height: binary.BigEndian.Uint16(msg[3:]),
+		}
+		// Replace a size the receiver has not picked up yet
+		select {
+		case <-a.resize:
+		default:
+		}
+		a.resize <- r
+	}
+}
+
+// Exit closes the output streams, reports the exit status of the
+// process to the host and closes the connection once the host has
+// received it.
+func (a *Attached) Exit(status int) error {
+	a.Stdout.Close()
+	a.Stderr.Close()
+	msg := []byte{msgExit, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], uint32(int32(status)))
+	err := a.ctrl.WriteMsg(msg)
+	if err == nil {
+		// The host closes the connection after reading the status
+		<-a.ctrlEOF
+	}
+	a.session.Close()
+	return err
+}
+
+// Close closes the connection without reporting an exit status
+func (a *Attached) Close() error {
+	return a.session.Close()
+}
@@ -0,0 +1,242 @@
+// Package forward accepts connections on one listener and forwards
+// each of them to a freshly dialled connection, e.g. from a TCP port
+// on the host to a service in a VM or from a vsock port in a guest to
+// a unix domain socket. Most forwarding daemons only differ in their
+// endpoints, so with this package they become configuration:
+//
+//	f, err := forward.New("tcp://127.0.0.1:8080", "vsock://3:80")
+//	...
+//	f.MaxConns = 64
+//	err = f.Serve(ctx)
+//
+// Endpoints are written as "tcp://host:port", "unix:///path",
+// "vsock://CID:Port" or "hvsock://VMID:ServiceID". Other listeners and
+// dialers, e.g. for Windows named pipes, can be plugged in by setting
+// up a Forwarder directly.
+package forward
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linuxkit/virtsock/pkg/grpcdial"
+	"github.com/linuxkit/virtsock/pkg/netutil"
+	"github.com/linuxkit/virtsock/pkg/proxy"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrClosed is returned by Serve() once the forwarder is closed
+	ErrClosed = errors.New("forwarder closed")
+)
+
+// DialFunc establishes the connection an accepted connection is
+// forwarded to
+type DialFunc func(ctx context.Context) (net.Conn, error)
+
+// Forwarder forwards connections accepted from Listener to
+// connections established with Dial. The fields must not be changed
+// once Serve() is called.
+type Forwarder struct {
+	Listener net.Listener
+	Dial     DialFunc
+
+	// MaxConns limits the number of connections forwarded at the same
+	// time. Further connections wait in the listen backlog. 0 means
+	// no limit.
+	MaxConns int
+	// DialTimeout limits the time to establish the forwarded
+	// connection. 0 means no timeout.
+	DialTimeout time.Duration
+	// ErrorLog, if set, is called with errors from dialling and
+	// copying individual connections, which otherwise only close the
+	// connection concerned.
+	ErrorLog func(error)
+
+	lock   sync.Mutex
+	closed bool
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New returns a forwarder listening on the endpoint listen and
+// forwarding connections to the endpoint dial
+func New(listen, dial string) (*Forwarder, error) {
+	d, err := Dialer(dial)
+	if err != nil {
+		return nil, err
+	}
+	l, err := Listen(listen)
+	if err != nil {
+		return nil, err
+	}
+	return &Forwarder{Listener: l, Dial: d}, nil
+}
+
+// Listen listens on an endpoint
+func Listen(endpoint string) (net.Listener, error) {
+	network, addr, err := splitEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	switch network {
+	case "tcp", "unix":
+		return net.Listen(network, addr)
+	}
+	return grpcdial.Listen(endpoint)
+}
+
+// Dialer returns a function connecting to an endpoint. The endpoint is
+// checked straight away, but only connected to when the function is
+// called.
+func Dialer(endpoint string) (DialFunc, error) {
+	network, addr, err := splitEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	switch network {
+	case "tcp", "unix":
+		var d net.Dialer
+		return func(ctx context.Context) (net.Conn, error) {
+			return d.DialContext(ctx, network, addr)
+		}, nil
+	case "vsock":
+		_, err = grpcdial.ParseVsockAddr(addr)
+	case "hvsock":
+		_, err = grpcdial.ParseHvsockAddr(addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context) (net.Conn, error) {
+		return grpcdial.Dial(ctx, endpoint)
+	}, nil
+}
+
+func splitEndpoint(endpoint string) (string, string, error) {
+	i := strings.Index(endpoint, "://")
+	if i < 0 {
+		return "", "", fmt.Errorf("invalid endpoint %q: missing scheme", endpoint)
+	}
+	network := endpoint[:i]
+	switch network {
+	case "tcp", "unix", "vsock", "hvsock":
+		return network, endpoint[i+3:], nil
+	}
+	return "", "", fmt.Errorf("unsupported endpoint %q", endpoint)
+}
+
+// Serve accepts and forwards connections until the listener fails,
+// ctx is done or the forwarder is closed. Before returning, it closes
+// the listener and all forwarded connections and waits for them to be
+// cleaned up. It returns ErrClosed if the forwarder was closed and
+// ctx.Err() if ctx is done.
+func (f *Forwarder) Serve(ctx context.Context) error {
+	f.lock.Lock()
+	if f.closed {
+		f.lock.Unlock()
+		return ErrClosed
+	}
+	ctx, f.cancel = context.WithCancel(ctx)
+	f.lock.Unlock()
+	defer f.wg.Wait()
+	defer f.cancel()
+
+	var l net.Listener = f.Listener
+	if f.MaxConns > 0 {
+		l = netutil.LimitListener(l, f.MaxConns, netutil.LimitDelay)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-stop:
+		}
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			l.Close()
+			f.lock.Lock()
+			closed := f.closed
+			f.lock.Unlock()
+			if closed {
+				return ErrClosed
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errors.Wrap(err, "accept")
+		}
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			f.forward(ctx, c)
+		}()
+	}
+}
+
+// Close stops a running Serve() and closes the forwarded connections
+func (f *Forwarder) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return ErrClosed
+	}
+	f.closed = true
+	if f.cancel != nil {
+		f.cancel()
+		return nil
+	}
+	return f.Listener.Close()
+}
+
+func (f *Forwarder) forward(ctx context.Context, c net.Conn) {
+	dctx := ctx
+	if f.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		dctx, cancel = context.WithTimeout(ctx, f.DialTimeout)
+		defer cancel()
+	}
+	d, err := f.Dial(dctx)
+	if err != nil {
+		c.Close()
+		f.logError(errors.Wrapf(err, "forward %s", c.RemoteAddr()))
+		return
+	}
+
+	_, err = proxy.Proxy(ctx, halfCloser(c), halfCloser(d))
+	if err != nil && err != ctx.Err() {
+		f.logError(errors.Wrapf(err, "forward %s", c.RemoteAddr()))
+	}
+}
+
+func (f *Forwarder) logError(err error) {
+	if f.ErrorLog != nil {
+		f.ErrorLog(err)
+	}
+}
+
+// noHalfClose adapts connections without half-close support. The
+// forwarded connection is only shut down once both directions are
+// done.
+type noHalfClose struct {
+	net.Conn
+}
+
+func (noHalfClose) CloseRead() error  { return nil }
+func (noHalfClose) CloseWrite() error { return nil }
+
+func halfCloser(c net.Conn) proxy.Conn {
+	if pc, ok := c.(proxy.Conn); ok {
+		return pc
+	}
+	return noHalfClose{c}
+}
@@ -0,0 +1,150 @@
+// Package grpcdial connects gRPC clients and servers to Hyper-V and
+// virtio sockets, which is the common way to talk to guest agents. It
+// does not depend on gRPC itself: Dial has the signature expected by
+// grpc.WithContextDialer() and Listen returns a net.Listener for
+// grpc.Server.Serve():
+//
+//	conn, err := grpc.Dial("vsock://3:1024",
+//		grpc.WithContextDialer(grpcdial.Dial), grpc.WithInsecure())
+//
+//	l, err := grpcdial.Listen("vsock://:1024")
+//	...
+//	server.Serve(l)
+//
+// Addresses are written as "vsock://CID:Port" or
+// "hvsock://VMID:ServiceID", where VMID and ServiceID are GUIDs. An
+// empty CID or VMID listens on all of them.
+package grpcdial
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/linuxkit/virtsock/pkg/hvsock"
+	"github.com/linuxkit/virtsock/pkg/vsock"
+)
+
+const (
+	vsockPrefix  = "vsock://"
+	hvsockPrefix = "hvsock://"
+)
+
+// ParseVsockAddr parses a vsock address of the form "CID:Port", with
+// an optional "vsock://" prefix. If the CID is empty, vsock.CIDAny is
+// returned.
+func ParseVsockAddr(s string) (vsock.Addr, error) {
+	s = strings.TrimPrefix(s, vsockPrefix)
+	cidStr, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return vsock.Addr{}, fmt.Errorf("invalid vsock address %q: %v", s, err)
+	}
+	a := vsock.Addr{CID: vsock.CIDAny}
+	if cidStr != "" {
+		cid, err := strconv.ParseUint(cidStr, 10, 32)
+		if err != nil {
+			return vsock.Addr{}, fmt.Errorf("invalid CID in vsock address %q: %v", s, err)
+		}
+		a.CID = uint32(cid)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 32)
+	if err != nil {
+		return vsock.Addr{}, fmt.Errorf("invalid port in vsock address %q: %v", s, err)
+	}
+	a.Port = uint32(port)
+	return a, nil
+}
+
+// ParseHvsockAddr parses a Hyper-V socket address of the form
+// "VMID:ServiceID", with an optional "hvsock://" prefix. If the VMID is
+// empty, hvsock.GUIDWildcard is returned.
+func ParseHvsockAddr(s string) (hvsock.Addr, error) {
+	s = strings.TrimPrefix(s, hvsockPrefix)
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return hvsock.Addr{}, fmt.Errorf("invalid hvsock address %q: missing service ID", s)
+	}
+	a := hvsock.Addr{VMID: hvsock.GUIDWildcard}
+	var err error
+	if i > 0 {
+		a.VMID, err = hvsock.GUIDFromString(s[:i])
+		if err != nil {
+			return hvsock.Addr{}, fmt.Errorf("invalid VM ID in hvsock address %q: %v", s, err)
+		}
+	}
+	a.ServiceID, err = hvsock.GUIDFromString(s[i+1:])
+	if err != nil {
+		return hvsock.Addr{}, fmt.Errorf("invalid service ID in hvsock address %q: %v", s, err)
+	}
+	return a, nil
+}
+
+// Dial connects to a "vsock://" or "hvsock://" address. If ctx is done
+// before the connection is established, Dial returns ctx.Err() and
+// the connection is closed once established.
+func Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var dial func() (net.Conn, error)
+	switch {
+	case strings.HasPrefix(addr, vsockPrefix):
+		a, err := ParseVsockAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		dial = func() (net.Conn, error) { return vsock.Dial(a.CID, a.Port) }
+	case strings.HasPrefix(addr, hvsockPrefix):
+		a, err := ParseHvsockAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		dial = func() (net.Conn, error) { return hvsock.Dial(a) }
+	default:
+		return nil, fmt.Errorf("unsupported address %q", addr)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// The socket packages can't abort a connect, so dial in the
+	// background and give up waiting if ctx is done
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		c, err := dial()
+		ch <- result{c, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// Listen listens on a "vsock://" or "hvsock://" address
+func Listen(addr string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, vsockPrefix):
+		a, err := ParseVsockAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		return vsock.Listen(a.CID, a.Port)
+	case strings.HasPrefix(addr, hvsockPrefix):
+		a, err := ParseHvsockAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		return hvsock.Listen(a)
+	}
+	return nil, fmt.Errorf("unsupported address %q", addr)
+}
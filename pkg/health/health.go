@@ -0,0 +1,108 @@
+// Package health lets orchestrators probe guest agents uniformly. A
+// probe sets up a pkg/mux session with the agent and sends a ping
+// control frame, which every mux session answers by itself, so agents
+// serving their API over mux need no health endpoint of their own.
+// Agents which don't use mux can run Serve() on a dedicated port:
+//
+//	l, err := vsock.Listen(vsock.CIDAny, 1023)
+//	...
+//	go health.Serve(l)
+//
+// and the host probes them with:
+//
+//	rtt, err := health.CheckHealth(ctx, "vsock://3:1023")
+//
+// An agent should only start answering probes once it is ready to
+// serve requests.
+package health
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/linuxkit/virtsock/pkg/grpcdial"
+	"github.com/linuxkit/virtsock/pkg/mux"
+	"github.com/pkg/errors"
+)
+
+// CheckHealth connects to the agent at addr, a "vsock://" or
+// "hvsock://" address as understood by grpcdial.Dial(), and checks
+// that it answers a ping. It returns the round trip time of the ping.
+// ctx should have a deadline, as an agent which hangs otherwise blocks
+// the check forever.
+func CheckHealth(ctx context.Context, addr string) (time.Duration, error) {
+	c, err := grpcdial.Dial(ctx, addr)
+	if err != nil {
+		return 0, errors.Wrapf(err, "health check %s", addr)
+	}
+	rtt, err := Check(ctx, c)
+	if err != nil {
+		return 0, errors.Wrapf(err, "health check %s", addr)
+	}
+	return rtt, nil
+}
+
+// Check is like CheckHealth, but probes the agent over the existing
+// connection c. c is closed when Check returns.
+func Check(ctx context.Context, c net.Conn) (time.Duration, error) {
+	defer c.Close()
+	// Abort the handshake if ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	s, err := mux.Client(c, nil)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		return 0, err
+	}
+	defer s.Close()
+	return s.Ping(ctx)
+}
+
+// handshakeTimeout bounds the time a prober has to set up the session,
+// so that peers which connect and send nothing don't pile up
+const handshakeTimeout = 10 * time.Second
+
+// Serve accepts connections from l and answers health probes on them
+// until Accept() fails, e.g. because l was closed. Streams opened by
+// the prober are refused, and connections are dropped if the prober
+// does not complete the handshake within 10 seconds.
+func Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveConn(c)
+	}
+}
+
+func serveConn(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	s, err := mux.Server(c, nil)
+	if err != nil {
+		return
+	}
+	defer s.Close()
+	c.SetDeadline(time.Time{})
+	// Pings are answered by the session. Refuse streams until the
+	// prober goes away.
+	for {
+		st, err := s.AcceptStream()
+		if err != nil {
+			return
+		}
+		st.Close()
+	}
+}
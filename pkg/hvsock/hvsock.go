@@ -8,9 +8,15 @@ package hvsock
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
 	"reflect"
+	"sync"
+	"syscall"
+	"time"
 )
 
 var (
@@ -29,6 +35,11 @@ var (
 
 	// GUIDs for LinuxVMs with the new Hyper-V socket implementation need to match this template
 	guidTemplate, _ = GUIDFromString("00000000-facb-11e6-bd58-64006a7986d3")
+
+	// ErrConnReset is matched, using errors.Is(), by errors returned
+	// when the peer aborted the connection, e.g. because the VM was
+	// killed. The error also wraps the errno reported by the system.
+	ErrConnReset = errors.New("connection reset by peer")
 )
 
 const (
@@ -42,16 +53,19 @@ const (
 	maxMsgSize = 8 * 1024
 )
 
-// GUID is used by Hypper-V sockets for "addresses" and "ports"
+// GUID is used by Hypper-V sockets for "addresses" and "ports". It
+// is stored in the same byte order as a Windows GUID in memory and in
+// the Hyper-V socket address: the first three fields are little
+// endian, the remaining 8 bytes are stored as is. This is independent
+// of the byte order of the host.
 type GUID [16]byte
 
 // Convert a GUID into a string
 func (g *GUID) String() string {
-	/* XXX This assume little endian */
-	return fmt.Sprintf("%02x%02x%02x%02x-%02x%02x-%02x%02x-%02x%02x-%02x%02x%02x%02x%02x%02x",
-		g[3], g[2], g[1], g[0],
-		g[5], g[4],
-		g[7], g[6],
+	return fmt.Sprintf("%08x-%04x-%04x-%02x%02x-%02x%02x%02x%02x%02x%02x",
+		binary.LittleEndian.Uint32(g[0:4]),
+		binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]),
 		g[8], g[9],
 		g[10], g[11], g[12], g[13], g[14], g[15])
 }
@@ -71,14 +85,19 @@ func (g *GUID) Port() (uint32, error) {
 // GUIDFromString parses a string and returns a GUID
 func GUIDFromString(s string) (GUID, error) {
 	var g GUID
-	var err error
-	_, err = fmt.Sscanf(s, "%02x%02x%02x%02x-%02x%02x-%02x%02x-%02x%02x-%02x%02x%02x%02x%02x%02x",
-		&g[3], &g[2], &g[1], &g[0],
-		&g[5], &g[4],
-		&g[7], &g[6],
+	var d1 uint32
+	var d2, d3 uint16
+	_, err := fmt.Sscanf(s, "%08x-%04x-%04x-%02x%02x-%02x%02x%02x%02x%02x%02x",
+		&d1, &d2, &d3,
 		&g[8], &g[9],
 		&g[10], &g[11], &g[12], &g[13], &g[14], &g[15])
-	return g, err
+	if err != nil {
+		return g, err
+	}
+	binary.LittleEndian.PutUint32(g[0:4], d1)
+	binary.LittleEndian.PutUint16(g[4:6], d2)
+	binary.LittleEndian.PutUint16(g[6:8], d3)
+	return g, nil
 }
 
 // Addr represents a Hyper-V socket address
@@ -99,13 +118,109 @@ func (a Addr) String() string {
 	return vmid + ":" + svc
 }
 
-// Conn is a hvsock connection which supports half-close.
+// Conn is a hvsock connection which supports half-close. Connections
+// are plain byte streams: a zero-length Write sends nothing and a
+// zero-length Read returns immediately.
+//
+// As in the net package, errors other than io.EOF are returned as a
+// *net.OpError wrapping the underlying error, so errors.Is() can be
+// used to check for a particular errno, os.ErrDeadlineExceeded or
+// ErrConnReset.
+//
+// For bug reports, connections also implement DebugString() string,
+// which describes their internal state.
 type Conn interface {
 	net.Conn
 	CloseRead() error
 	CloseWrite() error
 }
 
+// debugState records the state of a connection reported by
+// DebugString(). It is only used for diagnostics.
+type debugState struct {
+	lock          sync.Mutex
+	readClosed    bool
+	writeClosed   bool
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (d *debugState) update(f func(d *debugState)) {
+	d.lock.Lock()
+	f(d)
+	d.lock.Unlock()
+}
+
+// format describes the connection. handle is the socket descriptor
+// and extra any platform specific state.
+func (d *debugState) format(local, remote net.Addr, handle string, extra string) string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	deadline := func(t time.Time) string {
+		if t.IsZero() {
+			return "none"
+		}
+		return t.Format(time.RFC3339Nano)
+	}
+	s := fmt.Sprintf("hvsock %s->%s handle=%s closed=%t readClosed=%t writeClosed=%t readDeadline=%s writeDeadline=%s",
+		local, remote, handle, d.closed, d.readClosed, d.writeClosed,
+		deadline(d.readDeadline), deadline(d.writeDeadline))
+	if extra != "" {
+		s += " " + extra
+	}
+	return s
+}
+
+// opError wraps err in a *net.OpError, the way the net package reports
+// errors, so that callers can inspect the operation and addresses and
+// use errors.Is/As on the underlying error. Errors from os.File are
+// unwrapped first, so that callers see the errno or
+// os.ErrDeadlineExceeded rather than a *os.PathError, and using a
+// closed connection reports net.ErrClosed. A reset by the peer matches
+// ErrConnReset.
+func opError(op string, source, addr net.Addr, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+		if errno, ok := err.(syscall.Errno); ok {
+			err = os.NewSyscallError(pe.Op, errno)
+		}
+	}
+	if err == os.ErrClosed {
+		err = net.ErrClosed
+	}
+	if isConnReset(err) {
+		err = &connResetError{err}
+	}
+	return &net.OpError{Op: op, Net: "hvsock", Source: source, Addr: addr, Err: err}
+}
+
+// connResetError marks an error reported because the peer reset the
+// connection. It matches ErrConnReset with errors.Is() while still
+// unwrapping to the underlying *os.SyscallError and errno.
+type connResetError struct {
+	err error
+}
+
+func (e *connResetError) Error() string { return e.err.Error() }
+
+func (e *connResetError) Is(target error) bool { return target == ErrConnReset }
+
+func (e *connResetError) Unwrap() error { return e.err }
+
+// isConnReset returns whether err is an errno, possibly wrapped in a
+// *os.SyscallError, reporting that the peer reset the connection
+func isConnReset(err error) bool {
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	errno, ok := err.(syscall.Errno)
+	return ok && connResetErrno(errno)
+}
+
 // Since there doesn't seem to be a standard min function
 func min(x, y int) int {
 	if x < y {
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"runtime"
+	"syscall"
 )
 
 // Supported returns if hvsocks are supported on your platform
@@ -20,3 +21,7 @@ func Dial(raddr Addr) (Conn, error) {
 func Listen(addr Addr) (net.Listener, error) {
 	return nil, fmt.Errorf("Listen() not implemented on %s", runtime.GOOS)
 }
+
+func connResetErrno(errno syscall.Errno) bool {
+	return errno == syscall.ECONNRESET
+}
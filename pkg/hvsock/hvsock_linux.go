@@ -15,6 +15,7 @@ package hvsock
 // it.
 
 /*
+#define _GNU_SOURCE
 #include <sys/socket.h>
 
 struct sockaddr_hv {
@@ -30,7 +31,7 @@ int connect_sockaddr_hv(int fd, const struct sockaddr_hv *sa_hv) {
     return connect(fd, (const struct sockaddr*)sa_hv, sizeof(*sa_hv));
 }
 int accept_hv(int fd, struct sockaddr_hv *sa_hv, socklen_t *sa_hv_len) {
-    return accept(fd, (struct sockaddr *)sa_hv, sa_hv_len);
+    return accept4(fd, (struct sockaddr *)sa_hv, sa_hv_len, SOCK_NONBLOCK | SOCK_CLOEXEC);
 }
 int getsockname_hv(int fd, struct sockaddr_hv *sa_hv, socklen_t *sa_hv_len) {
     return getsockname(fd, (struct sockaddr *)sa_hv, sa_hv_len);
@@ -39,13 +40,15 @@ int getsockname_hv(int fd, struct sockaddr_hv *sa_hv, socklen_t *sa_hv_len) {
 import "C"
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"runtime/trace"
 	"syscall"
 	"time"
 
-	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
 )
 
@@ -81,9 +84,9 @@ func Supported() bool {
 
 // Dial a Hyper-V socket address
 func Dial(raddr Addr) (Conn, error) {
-	fd, err := syscall.Socket(hvsockAF, syscall.SOCK_STREAM, hvsockRaw)
+	fd, err := syscall.Socket(hvsockAF, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, hvsockRaw)
 	if err != nil {
-		return nil, err
+		return nil, opError("dial", nil, raddr, os.NewSyscallError("socket", err))
 	}
 
 	sa := C.struct_sockaddr_hv{}
@@ -97,25 +100,19 @@ func Dial(raddr Addr) (Conn, error) {
 		sa.shv_service_id[i] = C.uchar(raddr.ServiceID[i])
 	}
 
-	// Retry connect in a loop if EINTR is encountered.
-	for {
-		if ret, errno := C.connect_sockaddr_hv(C.int(fd), &sa); ret != 0 {
-			if errno == syscall.EINTR {
-				continue
-			}
-			return nil, fmt.Errorf("connect(%s) failed with %d, errno=%d", raddr, ret, errno)
-		}
-		break
+	v := newHVsockConn(uintptr(fd), &Addr{VMID: GUIDZero, ServiceID: GUIDZero}, &raddr)
+	if err := v.connect(&sa); err != nil {
+		v.Close()
+		return nil, opError("dial", v.local, raddr, err)
 	}
-
-	return newHVsockConn(uintptr(fd), &Addr{VMID: GUIDZero, ServiceID: GUIDZero}, &raddr), nil
+	return v, nil
 }
 
 // Listen returns a net.Listener which can accept connections on the given port
 func Listen(addr Addr) (net.Listener, error) {
-	fd, err := syscall.Socket(hvsockAF, syscall.SOCK_STREAM, hvsockRaw)
+	fd, err := syscall.Socket(hvsockAF, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, hvsockRaw)
 	if err != nil {
-		return nil, err
+		return nil, opError("listen", nil, addr, os.NewSyscallError("socket", err))
 	}
 
 	sa := C.struct_sockaddr_hv{}
@@ -130,14 +127,24 @@ func Listen(addr Addr) (net.Listener, error) {
 	}
 
 	if ret, errno := C.bind_sockaddr_hv(C.int(fd), &sa); ret != 0 {
-		return nil, fmt.Errorf("listen(%s) failed with %d, errno=%d", addr, ret, errno)
+		syscall.Close(fd)
+		return nil, opError("listen", nil, addr, os.NewSyscallError("bind", errno))
 	}
 
 	err = syscall.Listen(fd, syscall.SOMAXCONN)
 	if err != nil {
-		return nil, errors.Wrapf(err, "listen(%s) failed", addr)
+		syscall.Close(fd)
+		return nil, opError("listen", nil, addr, os.NewSyscallError("listen", err))
 	}
-	return &hvsockListener{fd, addr}, nil
+	// The socket is non-blocking, so os.NewFile() registers it with
+	// the runtime poller
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("hvsock-listener:%d", fd))
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, opError("listen", nil, addr, err)
+	}
+	return &hvsockListener{f, rc, addr}, nil
 }
 
 //
@@ -145,7 +152,8 @@ func Listen(addr Addr) (net.Listener, error) {
 //
 
 type hvsockListener struct {
-	fd    int
+	file  *os.File
+	rc    syscall.RawConn
 	local Addr
 }
 
@@ -153,21 +161,39 @@ type hvsockListener struct {
 func (v *hvsockListener) Accept() (net.Conn, error) {
 	var acceptSA C.struct_sockaddr_hv
 	var acceptSALen C.socklen_t
-
-	acceptSALen = C.sizeof_struct_sockaddr_hv
-	fd, err := C.accept_hv(C.int(v.fd), &acceptSA, &acceptSALen)
+	var fd C.int
+	var aerr error
+
+	err := v.rc.Read(func(s uintptr) bool {
+		for {
+			acceptSALen = C.sizeof_struct_sockaddr_hv
+			fd, aerr = C.accept_hv(C.int(s), &acceptSA, &acceptSALen)
+			if fd >= 0 {
+				aerr = nil
+				return true
+			}
+			if aerr != syscall.EINTR {
+				break
+			}
+		}
+		// Wait for the next connection on EAGAIN
+		return aerr != syscall.EAGAIN
+	})
+	if err == nil && aerr != nil {
+		err = os.NewSyscallError("accept4", aerr)
+	}
 	if err != nil {
-		return nil, errors.Wrapf(err, "accept(%s) failed", v.local)
+		return nil, opError("accept", nil, v.local, err)
 	}
 
 	remote := &Addr{VMID: guidFromC(acceptSA.shv_vm_id), ServiceID: guidFromC(acceptSA.shv_service_id)}
 	return newHVsockConn(uintptr(fd), &v.local, remote), nil
 }
 
-// Close closes the listening connection
+// Close closes the listening connection. Pending Accept calls are
+// unblocked and return an error.
 func (v *hvsockListener) Close() error {
-	// Note this won't cause the Accept to unblock.
-	return unix.Close(v.fd)
+	return opError("close", nil, v.local, v.file.Close())
 }
 
 // Addr returns the address the Listener is listening on
@@ -181,15 +207,82 @@ func (v *hvsockListener) Addr() net.Addr {
 
 // hvsockConn represents a connection over a Hyper-V socket
 type hvsockConn struct {
+	// The socket is owned by the os.File, which makes sure it is
+	// closed once and not used afterwards
 	hvsock *os.File
-	fd     uintptr
 	local  *Addr
 	remote *Addr
+
+	debug debugState
 }
 
+// newHVsockConn wraps a connected socket. fd must be in non-blocking
+// mode so that os.NewFile() registers it with the runtime poller,
+// which means blocked Read and Write calls do not tie up a thread and
+// deadlines are supported.
 func newHVsockConn(fd uintptr, local, remote *Addr) *hvsockConn {
 	hvsock := os.NewFile(fd, fmt.Sprintf("hvsock:%d", fd))
-	return &hvsockConn{hvsock: hvsock, fd: fd, local: local, remote: remote}
+	return &hvsockConn{hvsock: hvsock, local: local, remote: remote}
+}
+
+// connect connects the socket to sa. The socket is non-blocking, so
+// connect() usually returns EINPROGRESS and we wait in the poller for
+// the socket to become writable, which signals completion.
+func (v *hvsockConn) connect(sa *C.struct_sockaddr_hv) error {
+	rc, err := v.hvsock.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var cerr error
+	err = rc.Control(func(fd uintptr) {
+		for {
+			ret, errno := C.connect_sockaddr_hv(C.int(fd), sa)
+			if ret == 0 {
+				cerr = nil
+				return
+			}
+			cerr = errno
+			if cerr != syscall.EINTR {
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	switch cerr {
+	case nil:
+		return nil
+	case syscall.EINPROGRESS, syscall.EALREADY:
+	default:
+		return os.NewSyscallError("connect", cerr)
+	}
+
+	err = rc.Write(func(fd uintptr) bool {
+		var errno int
+		errno, cerr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR)
+		if cerr != nil {
+			return true
+		}
+		switch e := syscall.Errno(errno); e {
+		case syscall.EINPROGRESS, syscall.EALREADY, syscall.EINTR:
+			return false
+		case 0, syscall.EISCONN:
+			// The socket may be reported writable before the
+			// connection is established. Getpeername() can't decode
+			// the address, but only fails with ENOTCONN if we are
+			// not connected yet.
+			_, perr := unix.Getpeername(int(fd))
+			return perr != unix.ENOTCONN
+		default:
+			cerr = e
+			return true
+		}
+	})
+	if err == nil && cerr != nil {
+		err = os.NewSyscallError("connect", cerr)
+	}
+	return err
 }
 
 // LocalAddr returns the local address of a connection
@@ -204,64 +297,125 @@ func (v *hvsockConn) RemoteAddr() net.Addr {
 
 // Close closes the connection
 func (v *hvsockConn) Close() error {
-	return v.hvsock.Close()
+	v.debug.update(func(d *debugState) { d.closed = true })
+	return v.opError("close", v.hvsock.Close())
 }
 
 // CloseRead shuts down the reading side of a hvsock connection
 func (v *hvsockConn) CloseRead() error {
-	return syscall.Shutdown(int(v.fd), syscall.SHUT_RD)
+	v.debug.update(func(d *debugState) { d.readClosed = true })
+	return v.shutdown(syscall.SHUT_RD)
 }
 
 // CloseWrite shuts down the writing side of a hvsock connection
 func (v *hvsockConn) CloseWrite() error {
-	return syscall.Shutdown(int(v.fd), syscall.SHUT_WR)
+	v.debug.update(func(d *debugState) { d.writeClosed = true })
+	return v.shutdown(syscall.SHUT_WR)
+}
+
+// shutdown calls shutdown(2) through the os.File, so that it fails
+// once the connection is closed rather than hitting an unrelated
+// socket which reused the fd
+func (v *hvsockConn) shutdown(how int) error {
+	rc, err := v.hvsock.SyscallConn()
+	if err != nil {
+		return v.opError("close", err)
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.Shutdown(int(fd), how)
+	})
+	if err == nil && serr != nil {
+		err = os.NewSyscallError("shutdown", serr)
+	}
+	return v.opError("close", err)
 }
 
 // Read reads data from the connection
 func (v *hvsockConn) Read(buf []byte) (int, error) {
-	return v.hvsock.Read(buf)
+	defer trace.StartRegion(context.Background(), "hvsock.Read").End()
+	n, err := v.hvsock.Read(buf)
+	return n, v.opError("read", err)
 }
 
 // Write writes data over the connection
 // TODO(rn): replace with a straight call to v.hvsock.Write() once 4.9.x support is deprecated
 func (v *hvsockConn) Write(buf []byte) (int, error) {
+	defer trace.StartRegion(context.Background(), "hvsock.Write").End()
+	// Count partial batches, so that callers know exactly how much
+	// data was sent before an error
 	written := 0
-	toWrite := len(buf)
-	for toWrite > 0 {
-		thisBatch := min(toWrite, maxMsgSize)
+	for written < len(buf) {
+		thisBatch := min(len(buf)-written, maxMsgSize)
 		n, err := v.hvsock.Write(buf[written : written+thisBatch])
+		written += n
 		if err != nil {
-			return written, err
+			return written, v.opError("write", err)
 		}
-		if n != thisBatch {
-			return written, fmt.Errorf("short write %d != %d", n, thisBatch)
+		if n == 0 {
+			return written, v.opError("write", io.ErrShortWrite)
 		}
-		toWrite -= n
-		written += n
 	}
 
 	return written, nil
 }
 
+// opError wraps an error from an operation on the connection
+func (v *hvsockConn) opError(op string, err error) error {
+	return opError(op, v.local, v.remote, err)
+}
+
+// connResetErrno returns whether errno reports a connection reset by
+// the peer
+func connResetErrno(errno syscall.Errno) bool {
+	return errno == syscall.ECONNRESET
+}
+
 // SetDeadline sets the read and write deadlines associated with the connection
 func (v *hvsockConn) SetDeadline(t time.Time) error {
-	return nil // FIXME
+	v.debug.update(func(d *debugState) { d.readDeadline, d.writeDeadline = t, t })
+	return v.hvsock.SetDeadline(t)
 }
 
 // SetReadDeadline sets the deadline for future Read calls.
 func (v *hvsockConn) SetReadDeadline(t time.Time) error {
-	return nil // FIXME
+	v.debug.update(func(d *debugState) { d.readDeadline = t })
+	return v.hvsock.SetReadDeadline(t)
 }
 
 // SetWriteDeadline sets the deadline for future Write calls
 func (v *hvsockConn) SetWriteDeadline(t time.Time) error {
-	return nil // FIXME
+	v.debug.update(func(d *debugState) { d.writeDeadline = t })
+	return v.hvsock.SetWriteDeadline(t)
+}
+
+// DebugString describes the state of the connection, for bug reports
+func (v *hvsockConn) DebugString() string {
+	handle := "none"
+	if rc, err := v.hvsock.SyscallConn(); err == nil {
+		rc.Control(func(fd uintptr) {
+			handle = fmt.Sprint(fd)
+		})
+	}
+	return v.debug.format(v.local, v.remote, handle, "")
 }
 
 // File duplicates the underlying socket descriptor and returns it.
 func (v *hvsockConn) File() (*os.File, error) {
-	// This is equivalent to dup(2) but creates the new fd with CLOEXEC already set.
-	r0, _, e1 := syscall.Syscall(syscall.SYS_FCNTL, uintptr(v.hvsock.Fd()), syscall.F_DUPFD_CLOEXEC, 0)
+	// Don't use v.hvsock.Fd() as it puts the socket into blocking mode
+	rc, err := v.hvsock.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var r0 uintptr
+	var e1 syscall.Errno
+	err = rc.Control(func(fd uintptr) {
+		// This is equivalent to dup(2) but creates the new fd with CLOEXEC already set.
+		r0, _, e1 = syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_DUPFD_CLOEXEC, 0)
+	})
+	if err != nil {
+		return nil, err
+	}
 	if e1 != 0 {
 		return nil, os.NewSyscallError("fcntl", e1)
 	}
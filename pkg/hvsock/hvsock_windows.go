@@ -1,18 +1,20 @@
 package hvsock
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
 	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
-
-	"github.com/pkg/errors"
 )
 
 // Make sure Winsock2 is initialised
@@ -32,6 +34,9 @@ var (
 	// ErrTimeout is an error returned on timeout
 	ErrTimeout = &timeoutError{}
 
+	// errClosed is returned when using a closed connection or listener
+	errClosed = net.ErrClosed
+
 	wsaData syscall.WSAData
 )
 
@@ -44,78 +49,222 @@ func Supported() bool {
 func Dial(raddr Addr) (Conn, error) {
 	fd, err := syscall.Socket(hvsockAF, syscall.SOCK_STREAM, hvsockRaw)
 	if err != nil {
-		return nil, err
+		return nil, opError("dial", nil, raddr, os.NewSyscallError("socket", err))
 	}
 
 	var sa rawSockaddrHyperv
 	ptr, n, err := raddr.sockaddr(&sa)
 	if err != nil {
-		return nil, err
+		syscall.Close(fd)
+		return nil, opError("dial", nil, raddr, err)
 	}
 
 	if err := sys_connect(fd, ptr, n); err != nil {
-		return nil, errors.Wrapf(err, "connect(%s) failed", raddr)
+		syscall.Close(fd)
+		return nil, opError("dial", nil, raddr, os.NewSyscallError("connect", err))
 	}
 
-	return newHVsockConn(fd, Addr{VMID: GUIDZero, ServiceID: GUIDZero}, raddr)
+	conn, err := newHVsockConn(fd, Addr{VMID: GUIDZero, ServiceID: GUIDZero}, raddr)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, opError("dial", nil, raddr, err)
+	}
+	return conn, nil
 }
 
 // Listen returns a net.Listener which can accept connections on the given port
 func Listen(addr Addr) (net.Listener, error) {
 	fd, err := syscall.Socket(hvsockAF, syscall.SOCK_STREAM, hvsockRaw)
 	if err != nil {
-		return nil, err
+		return nil, opError("listen", nil, addr, os.NewSyscallError("socket", err))
 	}
 
 	var sa rawSockaddrHyperv
 	ptr, n, err := addr.sockaddr(&sa)
 	if err != nil {
-		return nil, err
+		syscall.Close(fd)
+		return nil, opError("listen", nil, addr, err)
 	}
 	if err := sys_bind(fd, ptr, n); err != nil {
-		return nil, fmt.Errorf("bind(%s) failed with %v", addr, err)
+		syscall.Close(fd)
+		return nil, opError("listen", nil, addr, os.NewSyscallError("bind", err))
 	}
 
 	err = syscall.Listen(fd, syscall.SOMAXCONN)
 	if err != nil {
-		return nil, errors.Wrapf(err, "listen(%s) failed", addr)
+		syscall.Close(fd)
+		return nil, opError("listen", nil, addr, os.NewSyscallError("listen", err))
 	}
 
-	return &hvsockListener{fd, addr}, nil
+	ioInitOnce.Do(initIo)
+	if _, err := createIoCompletionPort(fd, ioCompletionPort, 0, 0xffffffff); err != nil {
+		syscall.Close(fd)
+		return nil, opError("listen", nil, addr, os.NewSyscallError("CreateIoCompletionPort", err))
+	}
+	err = setFileCompletionNotificationModes(fd,
+		cFILE_SKIP_COMPLETION_PORT_ON_SUCCESS|cFILE_SKIP_SET_EVENT_ON_HANDLE)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, opError("listen", nil, addr, os.NewSyscallError("SetFileCompletionNotificationModes", err))
+	}
+
+	l := &hvsockListener{
+		fd:       fd,
+		local:    addr,
+		acceptCh: make(chan acceptResult),
+		closeCh:  make(chan struct{}),
+	}
+	labels := pprof.Labels("hvsock.listener", addr.String())
+	l.wg.Add(acceptBacklog)
+	for i := 0; i < acceptBacklog; i++ {
+		go pprof.Do(context.Background(), labels, func(context.Context) { l.acceptLoop() })
+	}
+	return l, nil
 }
 
 //
 // Hyper-v sockets Listener implementation
 //
 
+// acceptBacklog is the number of AcceptEx() calls kept pending on a
+// listener, so that a burst of incoming connections is accepted by the
+// kernel without waiting for Accept() to be called for each of them.
+const acceptBacklog = 8
+
+// acceptAddrLen is the space AcceptEx() needs for each address
+const acceptAddrLen = uint32(unsafe.Sizeof(rawSockaddrHyperv{})) + 16
+
 type hvsockListener struct {
 	fd    syscall.Handle
 	local Addr
+
+	acceptCh  chan acceptResult
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup // acceptLoop() goroutines
+}
+
+type acceptResult struct {
+	conn *hvsockConn
+	err  error
+}
+
+// acceptOperation is an AcceptEx() in flight. The buffer receiving the
+// addresses must stay put until the operation completes, so it is
+// allocated together with the overlapped structure.
+type acceptOperation struct {
+	ioOperation
+	addrbuf [2 * acceptAddrLen]byte
 }
 
 // Accept accepts an incoming call and returns the new connection
 func (v *hvsockListener) Accept() (net.Conn, error) {
-	var sa rawSockaddrHyperv
-	var n = int32(unsafe.Sizeof(sa))
-	fd, err := sys_accept(v.fd, &sa, &n)
+	select {
+	case r := <-v.acceptCh:
+		if r.err != nil {
+			return nil, opError("accept", nil, v.local, r.err)
+		}
+		return r.conn, nil
+	case <-v.closeCh:
+		return nil, opError("accept", nil, v.local, errClosed)
+	}
+}
+
+// acceptLoop keeps one AcceptEx() pending and hands accepted
+// connections to Accept()
+func (v *hvsockListener) acceptLoop() {
+	defer v.wg.Done()
+	for {
+		conn, err := v.acceptOne()
+		select {
+		case <-v.closeCh:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		default:
+		}
+
+		select {
+		case v.acceptCh <- acceptResult{conn, err}:
+		case <-v.closeCh:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// acceptOne accepts a single connection with AcceptEx()
+func (v *hvsockListener) acceptOne() (*hvsockConn, error) {
+	fd, err := syscall.Socket(hvsockAF, syscall.SOCK_STREAM, hvsockRaw)
 	if err != nil {
-		return nil, err
+		return nil, os.NewSyscallError("socket", err)
 	}
 
-	// Extract an Addr from sa
-	raddr := Addr{}
-	for i := 0; i < len(raddr.VMID); i++ {
-		raddr.VMID[i] = sa.VMID[i]
+	c := &acceptOperation{}
+	c.ch = make(chan ioResult, 1)
+	var bytes uint32
+	err = syscall.AcceptEx(v.fd, fd, &c.addrbuf[0], 0, acceptAddrLen, acceptAddrLen, &bytes, &c.o)
+	if err == syscall.ERROR_IO_PENDING {
+		// Close() cancels all operations pending when it is called.
+		// Cancel this one if it was issued after that.
+		select {
+		case <-v.closeCh:
+			cancelIoEx(v.fd, &c.o)
+		default:
+		}
+		r := <-c.ch
+		err = r.err
+	}
+	runtime.KeepAlive(c)
+	if err != nil {
+		syscall.Close(fd)
+		select {
+		case <-v.closeCh:
+			return nil, errClosed
+		default:
+		}
+		return nil, os.NewSyscallError("AcceptEx", err)
 	}
-	for i := 0; i < len(raddr.ServiceID); i++ {
-		raddr.ServiceID[i] = sa.ServiceID[i]
+
+	// Make the accepted socket inherit the properties of the listener
+	err = syscall.Setsockopt(fd, syscall.SOL_SOCKET, syscall.SO_UPDATE_ACCEPT_CONTEXT,
+		(*byte)(unsafe.Pointer(&v.fd)), int32(unsafe.Sizeof(v.fd)))
+	if err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
 	}
-	return newHVsockConn(fd, v.local, raddr)
+
+	// The remote address follows the local one
+	sa := (*rawSockaddrHyperv)(unsafe.Pointer(&c.addrbuf[acceptAddrLen]))
+	raddr := Addr{VMID: sa.VMID, ServiceID: sa.ServiceID}
+	conn, err := newHVsockConn(fd, v.local, raddr)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return conn, nil
 }
 
-// Close closes the listening connection
+// Close closes the listening connection. Pending Accept calls are
+// unblocked and return an error wrapping net.ErrClosed.
 func (v *hvsockListener) Close() error {
-	return syscall.Close(v.fd)
+	err := errClosed
+	v.closeOnce.Do(func() {
+		close(v.closeCh)
+		// Closing the handle does not reliably abort pending AcceptEx()
+		// calls, so cancel them explicitly and wait for the accept
+		// loops to exit before the handle can be reused.
+		cancelIoEx(v.fd, nil)
+		v.wg.Wait()
+		err = syscall.Close(v.fd)
+	})
+	if err != nil {
+		return opError("close", nil, v.local, syscallError("closesocket", err))
+	}
+	return nil
 }
 
 // Addr returns the address the Listener is listening on
@@ -128,17 +277,26 @@ func (v *hvsockListener) Addr() net.Addr {
 //
 
 // hvsockConn represent a Hyper-V connection. Complex mostly due to asynch send()/recv() syscalls.
+//
+// Read, Write, CloseRead, CloseWrite and Close may be called
+// concurrently. Every operation using fd registers with wg. Close
+// marks the connection as closing, which makes new operations fail
+// with errClosed, cancels pending IO and waits for all operations to
+// finish before closing the handle. fd itself is never modified after
+// the connection is created.
 type hvsockConn struct {
 	fd     syscall.Handle
 	local  Addr
 	remote Addr
 
 	wg      sync.WaitGroup
-	wgLock  sync.RWMutex
+	wgLock  sync.RWMutex // serialises wg.Add against close()
 	closing atomicBool
 
 	readDeadline  deadlineHandler
 	writeDeadline deadlineHandler
+
+	debug debugState
 }
 
 func newHVsockConn(h syscall.Handle, local Addr, remote Addr) (*hvsockConn, error) {
@@ -172,110 +330,186 @@ func (v *hvsockConn) RemoteAddr() net.Addr {
 
 // Close closes the connection
 func (v *hvsockConn) Close() error {
-	v.close()
+	v.debug.update(func(d *debugState) { d.closed = true })
+	if !v.close() {
+		return v.opError("close", errClosed)
+	}
 	return nil
 }
 
 // CloseRead shuts down the reading side of a hvsock connection
 func (v *hvsockConn) CloseRead() error {
-	return syscall.Shutdown(v.fd, syscall.SHUT_RD)
+	v.debug.update(func(d *debugState) { d.readClosed = true })
+	return v.shutdown(syscall.SHUT_RD)
 }
 
 // CloseWrite shuts down the writing side of a hvsock connection
 func (v *hvsockConn) CloseWrite() error {
-	return syscall.Shutdown(v.fd, syscall.SHUT_WR)
+	v.debug.update(func(d *debugState) { d.writeClosed = true })
+	return v.shutdown(syscall.SHUT_WR)
+}
+
+func (v *hvsockConn) shutdown(how int) error {
+	if err := v.enter(); err != nil {
+		return v.opError("close", err)
+	}
+	defer v.wg.Done()
+	if err := syscall.Shutdown(v.fd, how); err != nil {
+		return v.opError("close", os.NewSyscallError("shutdown", err))
+	}
+	return nil
+}
+
+// opError wraps an error from an operation on the connection
+func (v *hvsockConn) opError(op string, err error) error {
+	return opError(op, v.local, v.remote, err)
+}
+
+// syscallError wraps an errno returned by the named system call in an
+// *os.SyscallError. Other errors are returned as is.
+func syscallError(name string, err error) error {
+	if errno, ok := err.(syscall.Errno); ok {
+		return os.NewSyscallError(name, errno)
+	}
+	return err
+}
+
+// connResetErrno returns whether errno reports a connection reset by
+// the peer. Overlapped operations report ERROR_NETNAME_DELETED rather
+// than WSAECONNRESET.
+func connResetErrno(errno syscall.Errno) bool {
+	return errno == syscall.WSAECONNRESET || errno == syscall.ERROR_NETNAME_DELETED
 }
 
 // Read reads data from the connection
 func (v *hvsockConn) Read(buf []byte) (int, error) {
-	var b syscall.WSABuf
-	var f uint32
-
-	b.Len = uint32(len(buf))
-	b.Buf = &buf[0]
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	defer trace.StartRegion(context.Background(), "hvsock.Read").End()
 
 	c, err := v.prepareIo()
 	if err != nil {
-		return 0, err
+		return 0, v.opError("read", err)
 	}
-	defer v.wg.Done()
+	defer v.finishIo(c)
 
 	if v.readDeadline.timedout.isSet() {
-		return 0, ErrTimeout
+		return 0, v.opError("read", ErrTimeout)
 	}
 
-	var bytes uint32
-	err = syscall.WSARecv(v.fd, &b, 1, &bytes, &f, &c.o, nil)
-	n, err := v.asyncIo(c, &v.readDeadline, bytes, err)
+	c.buf.Len = uint32(len(buf))
+	c.buf.Buf = &buf[0]
+	err = syscall.WSARecv(v.fd, &c.buf, 1, &c.bytes, &c.flags, &c.o, nil)
+	n, err := v.asyncIo(c, &v.readDeadline, c.bytes, err)
 	runtime.KeepAlive(buf)
 
 	// Handle EOF conditions.
-	if err == nil && n == 0 && len(buf) != 0 {
+	if err == nil && n == 0 {
 		return 0, io.EOF
 	} else if err == syscall.ERROR_BROKEN_PIPE {
 		return 0, io.EOF
 	} else {
-		return n, err
+		return n, v.opError("read", syscallError("wsarecv", err))
 	}
 }
 
 // Write writes data over the connection
 // TODO(rn): Remove once 4.9.x support is deprecated
 func (v *hvsockConn) Write(buf []byte) (int, error) {
+	// Count partial batches, so that callers know exactly how much
+	// data was sent before an error
 	written := 0
-	toWrite := len(buf)
-	for toWrite > 0 {
-		thisBatch := min(toWrite, maxMsgSize)
+	for written < len(buf) {
+		thisBatch := min(len(buf)-written, maxMsgSize)
 		n, err := v.write(buf[written : written+thisBatch])
+		written += n
 		if err != nil {
-			return written, err
+			return written, v.opError("write", syscallError("wsasend", err))
 		}
-		if n != thisBatch {
-			return written, fmt.Errorf("short write %d != %d", n, thisBatch)
+		if n == 0 {
+			return written, v.opError("write", io.ErrShortWrite)
 		}
-		toWrite -= n
-		written += n
 	}
 
 	return written, nil
 }
 
 func (v *hvsockConn) write(buf []byte) (int, error) {
-	var b syscall.WSABuf
-	var f uint32
-
 	if len(buf) == 0 {
 		return 0, nil
 	}
-
-	f = 0
-	b.Len = uint32(len(buf))
-	b.Buf = &buf[0]
+	defer trace.StartRegion(context.Background(), "hvsock.Write").End()
 
 	c, err := v.prepareIo()
 	if err != nil {
 		return 0, err
 	}
-	defer v.wg.Done()
+	defer v.finishIo(c)
 
 	if v.writeDeadline.timedout.isSet() {
 		return 0, ErrTimeout
 	}
 
-	var bytes uint32
-	err = syscall.WSASend(v.fd, &b, 1, &bytes, f, &c.o, nil)
-	n, err := v.asyncIo(c, &v.writeDeadline, bytes, err)
+	c.buf.Len = uint32(len(buf))
+	c.buf.Buf = &buf[0]
+	err = syscall.WSASend(v.fd, &c.buf, 1, &c.bytes, 0, &c.o, nil)
+	n, err := v.asyncIo(c, &v.writeDeadline, c.bytes, err)
 	runtime.KeepAlive(buf)
 	return n, err
 }
 
+// SendFile sends n bytes of f, starting at offset off, over the
+// connection using TransmitFile(), so the data is read and sent by the
+// kernel. The file offset of f is not changed. It returns the number of
+// bytes sent.
+func (v *hvsockConn) SendFile(f *os.File, off, n int64) (int64, error) {
+	var written int64
+	for written < n {
+		// TransmitFile() sends at most 2^31-2 bytes per call
+		chunk := n - written
+		if chunk > 1<<30 {
+			chunk = 1 << 30
+		}
+
+		c, err := v.prepareIo()
+		if err != nil {
+			return written, v.opError("sendfile", err)
+		}
+		if v.writeDeadline.timedout.isSet() {
+			v.finishIo(c)
+			return written, v.opError("sendfile", ErrTimeout)
+		}
+		pos := off + written
+		c.o.Offset = uint32(pos)
+		c.o.OffsetHigh = uint32(pos >> 32)
+		// Limit the size of each send as for Write
+		err = syscall.TransmitFile(v.fd, syscall.Handle(f.Fd()), uint32(chunk), maxMsgSize, &c.o, nil, syscall.TF_USE_KERNEL_APC)
+		// On synchronous success no completion is queued and the
+		// whole chunk has been sent
+		m, err := v.asyncIo(c, &v.writeDeadline, uint32(chunk), err)
+		v.finishIo(c)
+		runtime.KeepAlive(f)
+		written += int64(m)
+		if err != nil {
+			return written, v.opError("sendfile", syscallError("TransmitFile", err))
+		}
+		if m == 0 {
+			return written, io.ErrUnexpectedEOF
+		}
+	}
+	return written, nil
+}
+
 // SetReadDeadline implementation for Hyper-V sockets
 func (v *hvsockConn) SetReadDeadline(deadline time.Time) error {
+	v.debug.update(func(d *debugState) { d.readDeadline = deadline })
 	return v.readDeadline.set(deadline)
 }
 
 // SetWriteDeadline implementation for Hyper-V sockets
 func (v *hvsockConn) SetWriteDeadline(deadline time.Time) error {
+	v.debug.update(func(d *debugState) { d.writeDeadline = deadline })
 	return v.writeDeadline.set(deadline)
 }
 
@@ -287,6 +521,13 @@ func (v *hvsockConn) SetDeadline(deadline time.Time) error {
 	return v.SetWriteDeadline(deadline)
 }
 
+// DebugString describes the state of the connection, for bug reports
+func (v *hvsockConn) DebugString() string {
+	extra := fmt.Sprintf("closing=%t readTimedOut=%t writeTimedOut=%t",
+		v.closing.isSet(), v.readDeadline.timedout.isSet(), v.writeDeadline.timedout.isSet())
+	return v.debug.format(v.local, v.remote, fmt.Sprintf("%#x", uintptr(v.fd)), extra)
+}
+
 // Helper functions for conversion to sockaddr
 
 // struck sockaddr equivalent
@@ -341,64 +582,114 @@ func (e *timeoutError) Error() string   { return "i/o timeout" }
 func (e *timeoutError) Timeout() bool   { return true }
 func (e *timeoutError) Temporary() bool { return true }
 
+// Is makes errors.Is(err, os.ErrDeadlineExceeded) work as it does for
+// the Linux implementation
+func (e *timeoutError) Is(target error) bool { return target == os.ErrDeadlineExceeded }
+
 type timeoutChan chan struct{}
 
 var ioInitOnce sync.Once
 var ioCompletionPort syscall.Handle
 
+// maxIoCompletionProcessors limits the number of goroutines waiting on
+// the completion port. All connections share the same port, so a few
+// processors are enough to keep up with many connections without one
+// slow consumer delaying completions for everyone else.
+const maxIoCompletionProcessors = 4
+
 // ioResult contains the result of an asynchronous IO operation
 type ioResult struct {
 	bytes uint32
 	err   error
 }
 
+// ioOperation is an overlapped IO operation. The o field must come
+// first as the completion processor gets a pointer to it. The buffer
+// descriptor and counters are passed to the kernel by reference, so
+// they are kept here rather than on the stack where they would escape.
 type ioOperation struct {
-	o  syscall.Overlapped
-	ch chan ioResult
+	o     syscall.Overlapped
+	ch    chan ioResult
+	buf   syscall.WSABuf
+	bytes uint32
+	flags uint32
+}
+
+// ioOperations are recycled once complete, so that Read and Write
+// don't allocate
+var ioOperationPool = sync.Pool{
+	New: func() interface{} {
+		return &ioOperation{ch: make(chan ioResult, 1)}
+	},
 }
 
 func initIo() {
+	n := min(runtime.NumCPU(), maxIoCompletionProcessors)
 	h, err := createIoCompletionPort(syscall.InvalidHandle, 0, 0, 0xffffffff)
 	if err != nil {
 		panic(err)
 	}
 	ioCompletionPort = h
-	go ioCompletionProcessor(h)
+	// Set the timer resolution to 1. This fixes a performance regression in golang 1.6.
+	timeBeginPeriod(1)
+	for i := 0; i < n; i++ {
+		go ioCompletionProcessor(h)
+	}
 }
 
-func (v *hvsockConn) close() {
+// close closes the connection. It returns false if it was already closed.
+func (v *hvsockConn) close() bool {
 	v.wgLock.Lock()
-	if !v.closing.swap(true) {
-		v.wgLock.Unlock()
-		// cancel all IO and wait for it to complete
-		cancelIoEx(v.fd, nil)
-		v.wg.Wait()
-		// at this point, no new IO can start
-		syscall.Close(v.fd)
-		v.fd = 0
-	} else {
+	if v.closing.swap(true) {
 		v.wgLock.Unlock()
-	}
+		return false
+	}
+	v.wgLock.Unlock()
+	// cancel all IO and wait for it to complete
+	cancelIoEx(v.fd, nil)
+	v.wg.Wait()
+	// at this point, no new IO can start
+	syscall.Close(v.fd)
+	return true
 }
 
-// prepareIo prepares for a new IO operation
-func (v *hvsockConn) prepareIo() (*ioOperation, error) {
+// enter registers an operation using fd, which must call v.wg.Done()
+// once it is finished. It fails if the connection is closing.
+func (v *hvsockConn) enter() error {
 	v.wgLock.RLock()
+	defer v.wgLock.RUnlock()
 	if v.closing.isSet() {
-		v.wgLock.RUnlock()
-		return nil, fmt.Errorf("HvSocket has already been closed")
+		return errClosed
 	}
 	v.wg.Add(1)
-	v.wgLock.RUnlock()
-	c := &ioOperation{}
-	c.ch = make(chan ioResult)
+	return nil
+}
+
+// prepareIo prepares for a new IO operation
+func (v *hvsockConn) prepareIo() (*ioOperation, error) {
+	if err := v.enter(); err != nil {
+		return nil, err
+	}
+	// The result channel is buffered, so completion processors never
+	// wait for the issuer
+	c := ioOperationPool.Get().(*ioOperation)
 	return c, nil
 }
 
-// ioCompletionProcessor processes completed async IOs forever
+// finishIo releases an operation returned by prepareIo once it has
+// completed
+func (v *hvsockConn) finishIo(c *ioOperation) {
+	c.o = syscall.Overlapped{}
+	c.buf = syscall.WSABuf{}
+	c.bytes = 0
+	c.flags = 0
+	ioOperationPool.Put(c)
+	v.wg.Done()
+}
+
+// ioCompletionProcessor processes completed async IOs forever. Several
+// processors run concurrently on the same completion port.
 func ioCompletionProcessor(h syscall.Handle) {
-	// Set the timer resolution to 1. This fixes a performance regression in golang 1.6.
-	timeBeginPeriod(1)
 	for {
 		var bytes uint32
 		var key uintptr
@@ -413,6 +704,13 @@ func ioCompletionProcessor(h syscall.Handle) {
 
 // asyncIo processes the return value from Recv or Send, blocking until
 // the operation has actually completed.
+//
+// The kernel owns c and the buffer it describes until the completion
+// has been received from c.ch, so every path which issues a
+// CancelIoEx(), because of a deadline or Close, still waits for the
+// completion. Only then may the caller return c to the pool with
+// finishIo() and the buffer be reused. A cancelled operation may still
+// have transferred some data, which is reported in the byte count.
 func (v *hvsockConn) asyncIo(c *ioOperation, d *deadlineHandler, bytes uint32, err error) (int, error) {
 	if err != syscall.ERROR_IO_PENDING {
 		return int(bytes), err
@@ -435,15 +733,21 @@ func (v *hvsockConn) asyncIo(c *ioOperation, d *deadlineHandler, bytes uint32, e
 		err = r.err
 		if err == syscall.ERROR_OPERATION_ABORTED {
 			if v.closing.isSet() {
-				err = fmt.Errorf("HvSocket has already been closed")
+				err = errClosed
 			}
 		}
 	case <-timeout:
+		// CancelIoEx() fails if the operation completed in the
+		// meantime, in which case its completion is still queued
 		cancelIoEx(v.fd, &c.o)
 		r = <-c.ch
 		err = r.err
 		if err == syscall.ERROR_OPERATION_ABORTED {
-			err = ErrTimeout
+			if v.closing.isSet() {
+				err = errClosed
+			} else {
+				err = ErrTimeout
+			}
 		}
 	}
 
@@ -0,0 +1,104 @@
+package hvsock
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+// servicesKey is where Hyper-V looks up the services guests may
+// connect to. A guest can only connect to a service GUID registered
+// there.
+const servicesKey = `SOFTWARE\Microsoft\Windows NT\CurrentVersion\Virtualization\GuestCommunicationServices`
+
+// ErrNotElevated is matched, using errors.Is(), by errors returned
+// when changing service registrations without administrator
+// privileges
+var ErrNotElevated = errors.New("administrator privileges required")
+
+// RegisteredService is a service GUID registered with Hyper-V
+type RegisteredService struct {
+	ServiceID GUID
+	Name      string
+}
+
+// registryError wraps an error from accessing the registry. Access
+// denied errors also match ErrNotElevated.
+type registryError struct {
+	op  string
+	err error
+}
+
+func (e *registryError) Error() string {
+	if errors.Is(e.err, syscall.ERROR_ACCESS_DENIED) {
+		return fmt.Sprintf("%s: %v (%v)", e.op, e.err, ErrNotElevated)
+	}
+	return fmt.Sprintf("%s: %v", e.op, e.err)
+}
+
+func (e *registryError) Is(target error) bool {
+	return target == ErrNotElevated && errors.Is(e.err, syscall.ERROR_ACCESS_DENIED)
+}
+
+func (e *registryError) Unwrap() error { return e.err }
+
+// RegisterService registers serviceID with Hyper-V, so that guests can
+// connect to it. name is shown in the Hyper-V management tools.
+// Registering a service which already exists updates its name. It
+// requires administrator privileges.
+func RegisterService(serviceID GUID, name string) error {
+	k, _, err := registry.CreateKey(registry.LOCAL_MACHINE, servicesKey+`\`+serviceID.String(), registry.SET_VALUE)
+	if err != nil {
+		return &registryError{"register service " + serviceID.String(), err}
+	}
+	defer k.Close()
+	if err := k.SetStringValue("ElementName", name); err != nil {
+		return &registryError{"register service " + serviceID.String(), err}
+	}
+	return nil
+}
+
+// UnregisterService removes the registration of serviceID. It
+// requires administrator privileges.
+func UnregisterService(serviceID GUID) error {
+	if err := registry.DeleteKey(registry.LOCAL_MACHINE, servicesKey+`\`+serviceID.String()); err != nil {
+		return &registryError{"unregister service " + serviceID.String(), err}
+	}
+	return nil
+}
+
+// ListRegisteredServices returns the services registered with Hyper-V.
+// Entries whose name is not a GUID are skipped.
+func ListRegisteredServices() ([]RegisteredService, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, servicesKey, registry.ENUMERATE_SUB_KEYS)
+	if err == registry.ErrNotExist {
+		// Hyper-V is not installed
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &registryError{"list services", err}
+	}
+	defer k.Close()
+
+	names, err := k.ReadSubKeyNames(-1)
+	if err != nil {
+		return nil, &registryError{"list services", err}
+	}
+	var services []RegisteredService
+	for _, n := range names {
+		id, err := GUIDFromString(strings.ToLower(n))
+		if err != nil {
+			continue
+		}
+		s := RegisteredService{ServiceID: id}
+		if sk, err := registry.OpenKey(k, n, registry.QUERY_VALUE); err == nil {
+			s.Name, _, _ = sk.GetStringValue("ElementName")
+			sk.Close()
+		}
+		services = append(services, s)
+	}
+	return services, nil
+}
@@ -0,0 +1,44 @@
+package hvsock
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// DialTLS connects to addr and performs a TLS handshake as a client.
+// If config does not set a ServerName, the service GUID of addr is
+// used, so server certificates for host<->guest channels should carry
+// the service GUID as a DNS name.
+func DialTLS(addr Addr, config *tls.Config) (*tls.Conn, error) {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = addr.ServiceID.String()
+	}
+
+	c, err := Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	tc := tls.Client(c, config)
+	if err := tc.Handshake(); err != nil {
+		c.Close()
+		return nil, opError("dial", c.LocalAddr(), addr, err)
+	}
+	return tc, nil
+}
+
+// ListenTLS listens on addr and returns a listener whose connections
+// perform a TLS handshake as a server on first use. config must
+// contain at least one certificate or set GetCertificate. Setting
+// config.ClientAuth to tls.RequireAndVerifyClientCert enables mutual
+// TLS.
+func ListenTLS(addr Addr, config *tls.Config) (net.Listener, error) {
+	l, err := Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, config), nil
+}
@@ -39,7 +39,6 @@ var (
 
 	procConnect = modws2_32.NewProc("connect")
 	procBind    = modws2_32.NewProc("bind")
-	procAccept  = modws2_32.NewProc("accept")
 
 	procCancelIoEx                         = modkernel32.NewProc("CancelIoEx")
 	procCreateIoCompletionPort             = modkernel32.NewProc("CreateIoCompletionPort")
@@ -102,19 +101,6 @@ func sys_bind(s syscall.Handle, name unsafe.Pointer, namelen int32) (err error)
 	return
 }
 
-func sys_accept(s syscall.Handle, rsa *rawSockaddrHyperv, addrlen *int32) (handle syscall.Handle, err error) {
-	r1, _, e1 := syscall.Syscall(procAccept.Addr(), 3, uintptr(s), uintptr(unsafe.Pointer(rsa)), uintptr(unsafe.Pointer(addrlen)))
-	handle = syscall.Handle(r1)
-	if r1 == socketError {
-		if e1 != 0 {
-			err = errnoErr(e1)
-		} else {
-			err = syscall.EINVAL
-		}
-	}
-	return
-}
-
 func cancelIoEx(file syscall.Handle, o *syscall.Overlapped) (err error) {
 	r1, _, e1 := syscall.Syscall(procCancelIoEx.Addr(), 2, uintptr(file), uintptr(unsafe.Pointer(o)), 0)
 	if r1 == 0 {
@@ -0,0 +1,76 @@
+package mux
+
+// Shared key authentication. After the magic words, both peers send a
+// random nonce. The client then sends
+//
+//	HMAC-SHA256(key, "client" || client nonce || server nonce)
+//
+// and the server checks it. Only if it matches does the server send
+// the same with "server", which the client checks in turn. The labels
+// keep either side from replaying the proof of the other, and the
+// nonces keep proofs from being replayed on other connections.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"net"
+
+	"github.com/linuxkit/virtsock/pkg/mux/frame"
+	"github.com/pkg/errors"
+)
+
+const (
+	nonceSize        = frame.AuthNonceSize
+	minSharedKeySize = 16
+)
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "failed to create challenge")
+	}
+	return nonce, nil
+}
+
+// authProof returns the proof of the client or server of holding key
+func authProof(key []byte, client bool, clientNonce, serverNonce []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	if client {
+		mac.Write([]byte("client"))
+	} else {
+		mac.Write([]byte("server"))
+	}
+	mac.Write(clientNonce)
+	mac.Write(serverNonce)
+	return mac.Sum(nil)
+}
+
+// authenticate exchanges and checks the proofs once the nonces have
+// been exchanged
+func authenticate(conn net.Conn, key []byte, client bool, clientNonce, serverNonce []byte) error {
+	ours := authProof(key, client, clientNonce, serverNonce)
+	theirs := make([]byte, len(ours))
+	if client {
+		if _, err := conn.Write(ours); err != nil {
+			return errors.Wrap(err, "failed to write proof")
+		}
+	}
+	if _, err := io.ReadFull(conn, theirs); err != nil {
+		if client && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			// The server hangs up on clients which failed
+			return ErrAuthFailed
+		}
+		return errors.Wrap(err, "failed to read proof")
+	}
+	if !hmac.Equal(theirs, authProof(key, !client, clientNonce, serverNonce)) {
+		return ErrAuthFailed
+	}
+	if !client {
+		if _, err := conn.Write(ours); err != nil {
+			return errors.Wrap(err, "failed to write proof")
+		}
+	}
+	return nil
+}
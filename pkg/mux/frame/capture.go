@@ -0,0 +1,128 @@
+package frame
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A capture file starts with CaptureMagic, followed by one record per
+// frame:
+//
+//	| direction (1) | time (8) | frame header (12) | payload |
+//
+// The direction is 1 for frames sent and 0 for frames received. The
+// time is in nanoseconds since the Unix epoch. Header and payload are
+// encoded as on the wire, so the payload length follows from the
+// header. All fields are in network byte order.
+
+// CaptureMagic identifies a capture file and its format version
+var CaptureMagic = [8]byte{'v', 's', 'm', 'x', 'c', 'a', 'p', 1}
+
+// captureRecordSize is the size of the record fields before the frame
+const captureRecordSize = 9
+
+// Record is a frame read from a capture
+type Record struct {
+	Header
+	Payload []byte
+	Sent    bool // true if the frame was sent, false if received
+	// Time the frame was written to, or read from, the connection
+	Time time.Time
+}
+
+// CaptureWriter writes frames to a capture file. It is safe for
+// concurrent use. After the first write error all further frames are
+// dropped and the error is returned by Err().
+type CaptureWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+	buf  []byte
+	err  error
+}
+
+// NewCaptureWriter writes the capture file magic to w and returns a
+// CaptureWriter appending frames to it
+func NewCaptureWriter(w io.Writer) (*CaptureWriter, error) {
+	if _, err := w.Write(CaptureMagic[:]); err != nil {
+		return nil, err
+	}
+	return &CaptureWriter{w: w}, nil
+}
+
+// Capture writes a frame with its payload to the capture
+func (c *CaptureWriter) Capture(sent bool, t time.Time, h *Header, payload []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return
+	}
+
+	// Build the record in one buffer, so that it is written with a
+	// single write
+	n := captureRecordSize + HeaderSize + len(payload)
+	if cap(c.buf) < n {
+		c.buf = make([]byte, n)
+	}
+	b := c.buf[:n]
+	b[0] = 0
+	if sent {
+		b[0] = 1
+	}
+	binary.BigEndian.PutUint64(b[1:9], uint64(t.UnixNano()))
+	h.Encode(b[captureRecordSize:])
+	copy(b[captureRecordSize+HeaderSize:], payload)
+	_, c.err = c.w.Write(b)
+}
+
+// Err returns the error which stopped the capture, if any
+func (c *CaptureWriter) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// CaptureReader decodes a capture file
+type CaptureReader struct {
+	r io.Reader
+}
+
+// NewCaptureReader reads the capture file magic from r and returns a
+// CaptureReader for the records following it
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	var got [len(CaptureMagic)]byte
+	if _, err := io.ReadFull(r, got[:]); err != nil {
+		return nil, errors.Wrap(err, "failed to read capture magic")
+	}
+	if !bytes.Equal(got[:], CaptureMagic[:]) {
+		return nil, fmt.Errorf("not a capture file or unsupported version: %q", got[:])
+	}
+	return &CaptureReader{r: r}, nil
+}
+
+// Next returns the next record. It returns io.EOF at the end of the
+// capture and io.ErrUnexpectedEOF if the capture ends within a record.
+func (c *CaptureReader) Next() (*Record, error) {
+	var b [captureRecordSize]byte
+	if _, err := io.ReadFull(c.r, b[:]); err != nil {
+		return nil, err
+	}
+	rec := &Record{
+		Sent: b[0] == 1,
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(b[1:9]))),
+	}
+	var err error
+	rec.Payload, err = ReadFrame(c.r, &rec.Header, MaxLargePayload)
+	if errors.Cause(err) == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
@@ -0,0 +1,291 @@
+// Package frame implements the wire format used by the mux package.
+// It is kept separate so that the encoding can be tested in isolation
+// and reused by tools which need to decode captured traffic.
+//
+// A session starts with both sides sending a 4 byte magic word. After
+// that, every frame starts with a fixed size header:
+//
+//	| version (1) | type (1) | flags (2) | stream ID (4) | length (4) |
+//
+// All fields are in network byte order. For most frame types the
+// header is followed by length bytes of payload. Window update frames
+// have no payload, their length field carries the credit granted.
+package frame
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Version is the protocol version written into every header
+	Version = 0
+
+	// HeaderSize is the size of a frame header on the wire
+	HeaderSize = 12
+
+	// MaxPayload is the maximum payload of a data frame, unless the
+	// peers negotiated larger frames with SettingMaxFrameSize
+	MaxPayload = 32 * 1024
+
+	// MaxLargePayload is the largest frame payload which may be
+	// negotiated
+	MaxLargePayload = 4 * 1024 * 1024
+)
+
+// Type identifies the type of a frame
+type Type uint8
+
+// Frame types
+const (
+	// Data carries stream data and the stream flags
+	Data Type = 0
+	// WindowUpdate grants the peer more credit. The length field
+	// carries the credit, there is no payload.
+	WindowUpdate Type = 1
+	// Signal carries an out-of-band application signal
+	Signal Type = 2
+	// Settings announces optional parameters of the sender. The
+	// payload is a list of settings, see ParseSettings(). Peers which
+	// don't know this type skip it.
+	Settings Type = 3
+	// Ping asks the peer to reply with a Pong frame carrying the same
+	// payload of PingSize bytes. It is used to measure round trip
+	// times. Peers which don't know this type skip it and never reply.
+	Ping Type = 4
+	// Pong answers a Ping
+	Pong Type = 5
+)
+
+// PingSize is the size of the opaque payload of Ping and Pong frames
+const PingSize = 8
+
+func (t Type) String() string {
+	switch t {
+	case Data:
+		return "data"
+	case WindowUpdate:
+		return "window-update"
+	case Signal:
+		return "signal"
+	case Settings:
+		return "settings"
+	case Ping:
+		return "ping"
+	case Pong:
+		return "pong"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(t))
+}
+
+// Frame flags
+const (
+	FlagSYN = 1 << 0 // open a new stream
+	FlagFIN = 1 << 1 // half-close the stream
+	FlagRST = 1 << 2 // abort the stream
+
+	// KnownFlags is the set of all flags defined
+	KnownFlags = FlagSYN | FlagFIN | FlagRST
+)
+
+// Setting identifiers
+const (
+	// SettingMaxFrameSize is the largest data frame payload the
+	// sender is willing to receive. It must be at least MaxPayload.
+	SettingMaxFrameSize uint16 = 1
+)
+
+// settingSize is the encoded size of a single setting
+const settingSize = 6
+
+// Setting is a single parameter carried in a Settings frame
+type Setting struct {
+	ID    uint16
+	Value uint32
+}
+
+// AppendSetting appends the encoding of s to b, for use as the payload
+// of a Settings frame
+func AppendSetting(b []byte, s Setting) []byte {
+	var e [settingSize]byte
+	binary.BigEndian.PutUint16(e[0:2], s.ID)
+	binary.BigEndian.PutUint32(e[2:6], s.Value)
+	return append(b, e[:]...)
+}
+
+// ParseSettings decodes the payload of a Settings frame. Settings the
+// caller does not know should be ignored.
+func ParseSettings(p []byte) ([]Setting, error) {
+	if len(p)%settingSize != 0 {
+		return nil, fmt.Errorf("invalid settings payload length %d", len(p))
+	}
+	settings := make([]Setting, 0, len(p)/settingSize)
+	for ; len(p) > 0; p = p[settingSize:] {
+		settings = append(settings, Setting{
+			ID:    binary.BigEndian.Uint16(p[0:2]),
+			Value: binary.BigEndian.Uint32(p[2:6]),
+		})
+	}
+	return settings, nil
+}
+
+// Magic is sent by both sides when a session is set up
+var Magic = [4]byte{'v', 's', 'm', 'x'}
+
+// AuthMagic replaces Magic on sessions authenticated with a shared
+// key, so that a peer without the key fails the handshake straight
+// away instead of misreading the challenge as frames.
+var AuthMagic = [4]byte{'v', 's', 'm', 'a'}
+
+// After AuthMagic, each side sends a random nonce of AuthNonceSize
+// bytes. The client then sends an HMAC-SHA256 proof of AuthProofSize
+// bytes, and the server answers with its own proof if the client's was
+// valid. Frames follow.
+const (
+	AuthNonceSize = 32
+	AuthProofSize = sha256.Size
+)
+
+// MagicError is returned by ReadMagic() if the peer did not send the
+// expected magic word, i.e. it does not speak the protocol.
+type MagicError struct {
+	Got [4]byte
+	// Want is the magic word expected, Magic if not set
+	Want [4]byte
+}
+
+func (e *MagicError) Error() string {
+	want := e.Want
+	if want == ([4]byte{}) {
+		want = Magic
+	}
+	return fmt.Sprintf("peer does not speak the mux protocol: got %q instead of %q", e.Got[:], want[:])
+}
+
+// Header is the fixed size header of every frame
+type Header struct {
+	Version  uint8
+	Type     Type
+	Flags    uint16
+	StreamID uint32
+	Length   uint32
+}
+
+// New returns a header for the current protocol version
+func New(t Type, flags uint16, streamID, length uint32) Header {
+	return Header{Version: Version, Type: t, Flags: flags, StreamID: streamID, Length: length}
+}
+
+// PayloadLength returns the number of payload bytes following the header
+func (h *Header) PayloadLength() uint32 {
+	if h.Type == WindowUpdate {
+		return 0
+	}
+	return h.Length
+}
+
+// Encode writes the header into b, which must hold at least HeaderSize bytes
+func (h *Header) Encode(b []byte) {
+	b[0] = h.Version
+	b[1] = uint8(h.Type)
+	binary.BigEndian.PutUint16(b[2:4], h.Flags)
+	binary.BigEndian.PutUint32(b[4:8], h.StreamID)
+	binary.BigEndian.PutUint32(b[8:12], h.Length)
+}
+
+// Decode parses the header from b, which must hold at least HeaderSize bytes
+func (h *Header) Decode(b []byte) {
+	h.Version = b[0]
+	h.Type = Type(b[1])
+	h.Flags = binary.BigEndian.Uint16(b[2:4])
+	h.StreamID = binary.BigEndian.Uint32(b[4:8])
+	h.Length = binary.BigEndian.Uint32(b[8:12])
+}
+
+// CheckStrict returns an error if the frame type or flags are not
+// defined by this version of the protocol.
+func (h *Header) CheckStrict() error {
+	switch h.Type {
+	case Data:
+		if h.Flags&^KnownFlags != 0 {
+			return fmt.Errorf("unknown flags %#x in %s frame", h.Flags, h.Type)
+		}
+	case WindowUpdate, Signal, Settings, Ping, Pong:
+		if h.Flags != 0 {
+			return fmt.Errorf("unexpected flags %#x in %s frame", h.Flags, h.Type)
+		}
+	default:
+		return fmt.Errorf("unknown frame type %d", uint8(h.Type))
+	}
+	return nil
+}
+
+func (h Header) String() string {
+	return fmt.Sprintf("version=%d type=%s flags=%#x stream=%d length=%d",
+		h.Version, h.Type, h.Flags, h.StreamID, h.Length)
+}
+
+// WriteMagic writes the magic word to w
+func WriteMagic(w io.Writer) error {
+	_, err := w.Write(Magic[:])
+	return err
+}
+
+// ReadMagic reads the magic word from r and returns a *MagicError if
+// it does not match.
+func ReadMagic(r io.Reader) error {
+	var got [4]byte
+	if _, err := io.ReadFull(r, got[:]); err != nil {
+		return err
+	}
+	if got != Magic {
+		return &MagicError{Got: got, Want: Magic}
+	}
+	return nil
+}
+
+// ReadHeader reads and decodes a frame header from r
+func ReadHeader(r io.Reader, h *Header) error {
+	var b [HeaderSize]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+	h.Decode(b[:])
+	return nil
+}
+
+// ReadFrame reads a frame header and its payload from r. Payloads
+// larger than maxPayload are rejected.
+func ReadFrame(r io.Reader, h *Header, maxPayload uint32) ([]byte, error) {
+	if err := ReadHeader(r, h); err != nil {
+		return nil, err
+	}
+	n := h.PayloadLength()
+	if n > maxPayload {
+		return nil, fmt.Errorf("frame payload too large: %d bytes", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errors.Wrapf(err, "failed to read payload of %s frame", h.Type)
+	}
+	return payload, nil
+}
+
+// WriteFrame writes a frame header followed by the payload to w
+func WriteFrame(w io.Writer, h *Header, payload []byte) error {
+	var b [HeaderSize]byte
+	h.Encode(b[:])
+	if _, err := w.Write(b[:]); err != nil {
+		return err
+	}
+	if len(payload) > 0 {
+		if _, err := w.Write(payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,312 @@
+// Package mux multiplexes many independent, bi-directional streams
+// over a single connection. Opening a Hyper-V socket connection
+// requires a service GUID to be registered on the Windows host for
+// every "port" used, so carrying several logical channels over one
+// hvsock (or vsock) connection is often the only practical way to
+// talk to more than one service inside a VM.
+//
+// One side of the connection creates a session with Client(), the
+// other with Server(). Either side may then open new streams with
+// Open() and accept streams opened by the peer with AcceptStream().
+// Streams implement net.Conn and support half-close.
+//
+// When a session is set up both sides send a 4 byte magic word and
+// check the one received from the peer, so that a peer which does not
+// speak this protocol is detected straight away. After that, all data
+// is carried in frames with a fixed size header, see the frame package
+// for the encoding. Streams opened by the client use odd IDs, streams
+// opened by the server use even IDs.
+//
+// Streams are flow controlled. Each side starts with a receive window
+// of 256 KiB per stream and returns credit to the peer with window
+// update frames as the application consumes data, so a fast writer
+// blocks instead of buffering unbounded amounts of data at the
+// receiver.
+package mux
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/linuxkit/virtsock/pkg/mux/frame"
+	"github.com/pkg/errors"
+)
+
+const (
+	// MaxSignalSize is the maximum payload of a signal
+	MaxSignalSize = 1024
+
+	// initialStreamWindow is the receive window every stream starts
+	// with. It can only be grown beyond this with window updates.
+	initialStreamWindow = 256 * 1024
+
+	// asyncQueueSize is the number of control frames queued by the
+	// receive path which may wait to be sent, see sendAsync()
+	asyncQueueSize = 1024
+
+	// maxEmptyMessages is the number of empty messages which may be
+	// queued unread on a stream. They don't cost any window, so they
+	// need a limit of their own.
+	maxEmptyMessages = 64
+)
+
+var (
+	// ErrSessionShutdown is returned when using a session which has
+	// been shut down. It matches net.ErrClosed with errors.Is().
+	ErrSessionShutdown error = closedError("session shutdown")
+	// ErrStreamClosed is returned when using a stream which has been
+	// closed. It matches net.ErrClosed with errors.Is().
+	ErrStreamClosed error = closedError("stream closed")
+	// ErrStreamReset is returned when the peer reset the stream
+	ErrStreamReset = errors.New("stream reset by peer")
+	// ErrStreamsExhausted is returned when no more stream IDs are available
+	ErrStreamsExhausted = errors.New("stream IDs exhausted")
+	// ErrRecvWindowExceeded is wrapped in a *ProtocolError when the peer sends more data than it had credit for
+	ErrRecvWindowExceeded = errors.New("receive window exceeded")
+	// ErrTooManyEmptyMessages is wrapped in a *ProtocolError when the peer sends more empty messages than are read
+	ErrTooManyEmptyMessages = errors.New("too many empty messages queued")
+	// ErrTimeout is returned when a deadline expires
+	ErrTimeout = &timeoutError{}
+	// ErrKeepAliveTimeout is returned by Session.Err() if the session
+	// was shut down because the peer did not answer a keepalive ping
+	ErrKeepAliveTimeout = errors.New("keepalive timeout")
+	// ErrAuthFailed is returned by Client() and Server() if the peer
+	// did not prove that it holds Config.SharedKey
+	ErrAuthFailed = errors.New("shared key authentication failed")
+	// ErrAuthMismatch is returned by Client() and Server() if only
+	// one of the peers has Config.SharedKey set
+	ErrAuthMismatch = errors.New("shared key authentication configured on one side only")
+	// ErrControlBacklog is returned by Session.Err() if the session
+	// was shut down because the peer made us queue more control
+	// frames, e.g. resets of streams it opened or pongs, than it read
+	ErrControlBacklog = errors.New("too many control frames queued for the peer")
+)
+
+// closedError is an error which matches net.ErrClosed, so that the
+// usual accept loop and connection handling code works with sessions
+// and streams
+type closedError string
+
+func (e closedError) Error() string        { return string(e) }
+func (e closedError) Is(target error) bool { return target == net.ErrClosed }
+
+// ProtocolError is the reason a session was shut down, see
+// Session.Err(), if the peer sent a frame which violates the protocol,
+// for example one larger than the negotiated maximum frame size. The
+// connection is closed when this happens.
+type ProtocolError struct {
+	Header frame.Header // header of the offending frame
+	Err    error
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("mux protocol error: %v (%s)", e.Err, e.Header)
+}
+
+// Unwrap returns the underlying error
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// protocolErrorf returns a *ProtocolError for the frame with header hdr
+func protocolErrorf(hdr *frame.Header, format string, args ...interface{}) error {
+	return &ProtocolError{Header: *hdr, Err: fmt.Errorf(format, args...)}
+}
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// Config is used to tune a session.
+type Config struct {
+	// AcceptBacklog is the maximum number of streams opened by the
+	// peer which may wait to be accepted. Further streams are reset.
+	AcceptBacklog int
+
+	// MaxStreamWindowSize is the maximum amount of unread data
+	// buffered per stream. It must be at least 256 KiB, and at least
+	// MaxFrameSize, so that the peer can send a full frame with
+	// Stream.WriteMsg().
+	MaxStreamWindowSize uint32
+
+	// MaxFrameSize is the largest data frame payload this side sends
+	// and accepts. It must be between 32 KiB and 4 MiB. Larger frames
+	// reduce the per-frame overhead of bulk transfers. A value above
+	// 32 KiB is announced to the peer in a settings frame, and larger
+	// frames are only used in a direction once the receiving side has
+	// announced them. The default of 32 KiB sends no settings frame,
+	// so it works with strict peers which don't know about them.
+	MaxFrameSize uint32
+
+	// ReadBufferSize is the size of the read-ahead buffer used when
+	// reading frames from the connection. A buffer saves syscalls when
+	// the peer sends many small frames. Setting it to 0 reads straight
+	// from the connection, which gives the lowest latency for sparse
+	// traffic.
+	ReadBufferSize int
+
+	// CoalesceDelay enables coalescing of small writes. If set, data
+	// written to a stream is buffered for up to this long, or until it
+	// fills a frame, and then sent as a single data frame. This saves
+	// frames and syscalls when an application issues many small
+	// writes, at the cost of latency. Stream.Flush() sends buffered
+	// data straight away and Stream.SetNoDelay() disables coalescing
+	// for a single stream. By default every write is sent immediately.
+	CoalesceDelay time.Duration
+
+	// WriteEmptyFrames makes a zero-length Write on a stream send an
+	// empty data frame, for peers which use them as markers. By
+	// default zero-length writes send nothing. Empty frames are never
+	// surfaced by Read.
+	WriteEmptyFrames bool
+
+	// KeepAliveInterval enables keepalives if set. The session then
+	// pings the peer at this interval and shuts down with
+	// ErrKeepAliveTimeout if the peer does not reply within
+	// KeepAliveTimeout, e.g. because the VM was paused or killed
+	// without the connection being reset. Only enable keepalives if
+	// the peer runs a version of this package which answers pings.
+	KeepAliveInterval time.Duration
+	KeepAliveTimeout  time.Duration
+
+	// Strict makes the session fail with an error when the peer sends
+	// a frame type or flag it does not know about. By default unknown
+	// frame types are skipped and unknown flags ignored, so that peers
+	// running a newer version of the protocol can still talk to us.
+	Strict bool
+
+	// SignalHandler, if set, is called with the payload of every
+	// signal the peer sends with Stream.Signal(). It is called
+	// synchronously from the session's receive loop and must not
+	// block. Signals are dropped if no handler is set.
+	SignalHandler func(st *Stream, payload []byte)
+
+	// Trace, if set, is called for every frame sent or received. It
+	// is called synchronously from the session's I/O loops and must
+	// not block.
+	Trace func(TraceEvent)
+
+	// Capture, if set, receives a copy of every frame sent or received,
+	// including payloads, for offline analysis with
+	// frame.NewCaptureReader(). Capturing slows down the session and
+	// should only be enabled for debugging. A CaptureWriter should not
+	// be shared between sessions, as records don't identify the
+	// session they belong to.
+	Capture *frame.CaptureWriter
+
+	// SharedKey, if set, authenticates the peer during the handshake.
+	// Both sides prove that they hold the key by answering a random
+	// challenge with an HMAC-SHA256 of it, the client first, so that
+	// the server does not answer peers which failed. Client() and
+	// Server() return ErrAuthFailed if the peer does not hold the
+	// key. It must be at least 16 bytes long, and set on both sides.
+	// It authenticates the peer only, the session is not encrypted.
+	SharedKey []byte
+}
+
+// TraceEvent describes a single frame sent or received by a session.
+type TraceEvent struct {
+	frame.Header
+	Sent bool // true if the frame was sent, false if received
+	// Time the frame was handed to, or read from, the connection
+	Time time.Time
+}
+
+// DefaultConfig returns the configuration used when nil is passed to
+// Client() or Server().
+func DefaultConfig() *Config {
+	return &Config{
+		AcceptBacklog:       256,
+		MaxStreamWindowSize: initialStreamWindow,
+		MaxFrameSize:        frame.MaxPayload,
+		ReadBufferSize:      16 * 1024,
+		KeepAliveTimeout:    30 * time.Second,
+	}
+}
+
+func verifyConfig(c *Config) error {
+	if c.AcceptBacklog <= 0 {
+		return fmt.Errorf("AcceptBacklog must be positive")
+	}
+	if c.MaxFrameSize < frame.MaxPayload || c.MaxFrameSize > frame.MaxLargePayload {
+		return fmt.Errorf("MaxFrameSize must be between %d and %d", frame.MaxPayload, frame.MaxLargePayload)
+	}
+	if c.CoalesceDelay < 0 {
+		return fmt.Errorf("CoalesceDelay must not be negative")
+	}
+	if c.ReadBufferSize < 0 {
+		return fmt.Errorf("ReadBufferSize must not be negative")
+	}
+	if c.MaxStreamWindowSize < initialStreamWindow {
+		return fmt.Errorf("MaxStreamWindowSize must be at least %d", initialStreamWindow)
+	}
+	if c.MaxStreamWindowSize < c.MaxFrameSize {
+		return fmt.Errorf("MaxStreamWindowSize must be at least MaxFrameSize")
+	}
+	if c.KeepAliveInterval < 0 {
+		return fmt.Errorf("KeepAliveInterval must not be negative")
+	}
+	if c.KeepAliveInterval > 0 && c.KeepAliveTimeout <= 0 {
+		return fmt.Errorf("KeepAliveTimeout must be positive if keepalives are enabled")
+	}
+	if c.SharedKey != nil && len(c.SharedKey) < minSharedKeySize {
+		return fmt.Errorf("SharedKey must be at least %d bytes", minSharedKeySize)
+	}
+	return nil
+}
+
+// VsockConfig returns a configuration tuned for hvsock and vsock
+// connections between peers which both run this package. Compared to
+// DefaultConfig() it uses larger windows and frames, which suit the
+// high bandwidth and low latency of VM sockets, and enables
+// keepalives, so that a session to a VM which went away is shut down
+// even if the connection is not reset.
+func VsockConfig() *Config {
+	c := DefaultConfig()
+	c.MaxStreamWindowSize = 1024 * 1024
+	c.MaxFrameSize = 256 * 1024
+	c.KeepAliveInterval = 30 * time.Second
+	c.KeepAliveTimeout = 30 * time.Second
+	return c
+}
+
+// Client sets up the client side of a session over conn. It exchanges
+// magic words with the peer and returns a *frame.MagicError if the peer
+// does not speak the protocol. The connection is not closed on error.
+func Client(conn net.Conn, config *Config) (*Session, error) {
+	return newSession(conn, config, true)
+}
+
+// Server sets up the server side of a session over conn. It exchanges
+// magic words with the peer and returns a *frame.MagicError if the peer
+// does not speak the protocol. The connection is not closed on error.
+func Server(conn net.Conn, config *Config) (*Session, error) {
+	return newSession(conn, config, false)
+}
+
+// Addr is the address of one end of a stream. It combines the address
+// of the underlying connection with the stream ID.
+type Addr struct {
+	Conn     net.Addr
+	StreamID uint32
+}
+
+// Network returns the type of network for a stream
+func (a Addr) Network() string {
+	return "mux"
+}
+
+func (a Addr) String() string {
+	return fmt.Sprintf("%s/%d", a.Conn, a.StreamID)
+}
+
+// Since there doesn't seem to be a standard min function
+func min(x, y int) int {
+	if x < y {
+		return x
+	}
+	return y
+}
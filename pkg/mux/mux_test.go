@@ -0,0 +1,874 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linuxkit/virtsock/pkg/mux/frame"
+)
+
+// testPair returns a client and a server session connected over
+// net.Pipe()
+func testPair(t *testing.T, cc, sc *Config) (*Session, *Session) {
+	t.Helper()
+	a, b := net.Pipe()
+	var c, s *Session
+	var cerr, serr error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c, cerr = Client(a, cc)
+	}()
+	go func() {
+		defer wg.Done()
+		s, serr = Server(b, sc)
+	}()
+	wg.Wait()
+	if cerr != nil || serr != nil {
+		t.Fatalf("handshake failed: client %v, server %v", cerr, serr)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return c, s
+}
+
+// testStreams opens a stream on c and accepts it on s
+func testStreams(t *testing.T, c, s *Session) (*Stream, *Stream) {
+	t.Helper()
+	cs, err := c.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The peer learns about the stream with its first frame
+	if _, err := cs.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	ss, err := s.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(ss, b); err != nil || b[0] != 'x' {
+		t.Fatalf("read %q, %v", b, err)
+	}
+	return cs, ss
+}
+
+func TestOpenAccept(t *testing.T) {
+	c, s := testPair(t, nil, nil)
+
+	const n = 10
+	errs := make(chan error, n)
+	go func() {
+		for i := 0; i < n; i++ {
+			st, err := s.AcceptStream()
+			if err != nil {
+				errs <- err
+				return
+			}
+			go func() {
+				_, err := io.Copy(st, st)
+				if err == nil {
+					err = st.Close()
+				}
+				errs <- err
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			st, err := c.Open()
+			if err != nil {
+				errs <- err
+				return
+			}
+			msg := bytes.Repeat([]byte{byte(i)}, 100000+i)
+			go func() {
+				st.Write(msg)
+				st.CloseWrite()
+			}()
+			got, err := ioutil.ReadAll(st)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !bytes.Equal(got, msg) {
+				errs <- errors.New("echoed data differs")
+			}
+			st.Close()
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.NumStreams() != 0 {
+		t.Errorf("%d streams left open", c.NumStreams())
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	c, s := testPair(t, nil, nil)
+	cs, ss := testStreams(t, c, s)
+
+	if err := cs.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.Write([]byte("late")); err == nil {
+		t.Error("write after CloseWrite succeeded")
+	}
+	if n, err := ss.Read(make([]byte, 10)); err != io.EOF {
+		t.Fatalf("read %d, %v after peer's CloseWrite, expected EOF", n, err)
+	}
+
+	// The other direction is still open
+	if _, err := ss.Write([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	ss.CloseWrite()
+	got, err := ioutil.ReadAll(cs)
+	if err != nil || string(got) != "reply" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+}
+
+// TestHalfCloseTransitions checks what each end of a stream can still
+// do after the local end shut down one or both directions
+func TestHalfCloseTransitions(t *testing.T) {
+	closeRead := func(st *Stream) error { return st.CloseRead() }
+	closeWrite := func(st *Stream) error { return st.CloseWrite() }
+	closeBoth := func(st *Stream) error { return st.Close() }
+
+	tests := []struct {
+		name       string
+		ops        []func(st *Stream) error
+		localWrite bool  // the local end can write
+		peerRead   bool  // the peer receives what the local end wrote
+		localRead  error // what the local end reads, nil for data
+	}{
+		{"open", nil, true, true, nil},
+		{"CloseWrite", []func(*Stream) error{closeWrite}, false, false, nil},
+		{"CloseWrite twice", []func(*Stream) error{closeWrite, closeWrite}, false, false, nil},
+		{"CloseRead", []func(*Stream) error{closeRead}, true, true, io.EOF},
+		{"CloseRead twice", []func(*Stream) error{closeRead, closeRead}, true, true, io.EOF},
+		{"CloseRead CloseWrite", []func(*Stream) error{closeRead, closeWrite}, false, false, io.EOF},
+		{"CloseWrite CloseRead", []func(*Stream) error{closeWrite, closeRead}, false, false, io.EOF},
+		{"Close", []func(*Stream) error{closeBoth}, false, false, ErrStreamClosed},
+		{"CloseWrite Close", []func(*Stream) error{closeWrite, closeBoth}, false, false, ErrStreamClosed},
+		{"Close CloseWrite", []func(*Stream) error{closeBoth, closeWrite}, false, false, ErrStreamClosed},
+		{"Close CloseRead", []func(*Stream) error{closeBoth, closeRead}, false, false, ErrStreamClosed},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, s := testPair(t, nil, nil)
+			local, peer := testStreams(t, c, s)
+			local.SetDeadline(time.Now().Add(5 * time.Second))
+			peer.SetDeadline(time.Now().Add(5 * time.Second))
+
+			for _, op := range tc.ops {
+				if err := op(local); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err := local.Write([]byte("l"))
+			if (err == nil) != tc.localWrite {
+				t.Errorf("local write returned %v", err)
+			}
+			b := make([]byte, 1)
+			n, err := peer.Read(b)
+			if tc.peerRead && (err != nil || string(b[:n]) != "l") {
+				t.Errorf("peer read %q, %v", b[:n], err)
+			}
+			if !tc.peerRead && err != io.EOF {
+				t.Errorf("peer read %q, %v, expected EOF", b[:n], err)
+			}
+
+			// The peer may always write, data for a direction which
+			// was shut down is dropped
+			_, err = peer.Write([]byte("p"))
+			if err != nil {
+				t.Errorf("peer write returned %v", err)
+			}
+			n, err = local.Read(b)
+			if tc.localRead == nil && (err != nil || string(b[:n]) != "p") {
+				t.Errorf("local read %q, %v", b[:n], err)
+			}
+			if tc.localRead != nil && !errors.Is(err, tc.localRead) {
+				t.Errorf("local read %q, %v, expected %v", b[:n], err, tc.localRead)
+			}
+		})
+	}
+}
+
+func TestCloseReadUnread(t *testing.T) {
+	c, s := testPair(t, nil, nil)
+	cs, ss := testStreams(t, c, s)
+
+	if _, err := cs.Write(make([]byte, 64*1024)); err != nil {
+		t.Fatal(err)
+	}
+	// Frames are handled in order, so the data has arrived once a
+	// second stream sees its first byte
+	testStreams(t, c, s)
+	if err := ss.CloseRead(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ss.Read(make([]byte, 10)); err != io.EOF {
+		t.Fatalf("read %d, %v after CloseRead, expected EOF", n, err)
+	}
+	if _, err := ss.Write([]byte("still open")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 10)
+	if _, err := io.ReadFull(cs, b); err != nil || string(b) != "still open" {
+		t.Fatalf("read %q, %v", b, err)
+	}
+}
+
+// TestCloseReadReturnsCredit checks that the window of data discarded
+// by CloseRead is handed back to the peer, who must be able to keep
+// writing without exceeding the window.
+func TestCloseReadReturnsCredit(t *testing.T) {
+	c, s := testPair(t, nil, nil)
+	cs, ss := testStreams(t, c, s)
+
+	// Fill the window, less the byte read by testStreams
+	if _, err := cs.Write(make([]byte, initialStreamWindow-1)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return ss.bufferedSize() == initialStreamWindow-1 })
+	if err := ss.CloseRead(); err != nil {
+		t.Fatal(err)
+	}
+	cs.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := cs.Write(make([]byte, 32*1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.Ping(ctx); err != nil {
+		t.Fatalf("session failed after CloseRead: %v, peer: %v", err, s.Err())
+	}
+}
+
+func TestWindowExhaustion(t *testing.T) {
+	c, s := testPair(t, nil, nil)
+	cs, ss := testStreams(t, c, s)
+
+	// The window is full once initialStreamWindow bytes are unread
+	msg := make([]byte, initialStreamWindow+1000)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	cs.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := cs.Write(msg)
+	if err != ErrTimeout {
+		t.Fatalf("write of %d bytes into a full window returned %d, %v", len(msg), n, err)
+	}
+	if n != initialStreamWindow-1 {
+		t.Fatalf("wrote %d bytes before the window was exhausted, expected %d", n, initialStreamWindow-1)
+	}
+
+	// Reading refills the window and the rest goes through
+	cs.SetWriteDeadline(time.Time{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := cs.Write(msg[n:])
+		if err == nil {
+			err = cs.CloseWrite()
+		}
+		done <- err
+	}()
+	got, err := ioutil.ReadAll(ss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("received %d bytes which differ from the %d sent", len(got), len(msg))
+	}
+}
+
+// TestWriteTimeoutReturnsCredit checks that writes which time out
+// while the send loop is blocked don't use up the send window
+func TestWriteTimeoutReturnsCredit(t *testing.T) {
+	s, conn := rawPeer(t, false, nil)
+	hdr := frame.New(frame.Data, frame.FlagSYN, 1, 0)
+	if err := frame.WriteFrame(conn, &hdr, nil); err != nil {
+		t.Fatal(err)
+	}
+	st, err := s.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Once its header is read, the send loop is stuck writing the body
+	// of the first frame as nobody reads conn
+	go st.Write([]byte("x"))
+	if _, err := io.ReadFull(conn, make([]byte, frame.HeaderSize)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		st.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, err := st.Write(make([]byte, 16*1024)); err != ErrTimeout {
+			t.Fatalf("write returned %v, expected a timeout", err)
+		}
+	}
+
+	// All of the window, less the byte in flight, must be left
+	go io.Copy(ioutil.Discard, conn)
+	st.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := st.Write(make([]byte, initialStreamWindow-1)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSessionClose checks that shutting down a session ends the
+// streams of the peer. The protocol has no GoAway frame, closing the
+// session is how a peer goes away.
+func TestSessionClose(t *testing.T) {
+	c, s := testPair(t, nil, nil)
+	cs, ss := testStreams(t, c, s)
+
+	s.Close()
+	if _, err := ss.Write([]byte("x")); !errors.Is(err, ErrSessionShutdown) {
+		t.Errorf("write on a closed session returned %v", err)
+	}
+	if _, err := s.Open(); !errors.Is(err, ErrSessionShutdown) {
+		t.Errorf("open on a closed session returned %v", err)
+	}
+	if _, err := cs.Read(make([]byte, 10)); err == nil {
+		t.Error("read from a stream of a closed peer succeeded")
+	}
+	select {
+	case <-c.CloseChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer of a closed session did not shut down")
+	}
+	if _, err := c.AcceptStream(); !errors.Is(err, ErrSessionShutdown) {
+		t.Errorf("accept on a closed session returned %v", err)
+	}
+}
+
+// rawPeer returns a session and the other end of its connection, on
+// which the test speaks the protocol by hand
+func rawPeer(t *testing.T, client bool, config *Config) (*Session, net.Conn) {
+	t.Helper()
+	a, b := net.Pipe()
+	var s *Session
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if client {
+			s, err = Client(b, config)
+		} else {
+			s, err = Server(b, config)
+		}
+	}()
+	if err := frame.WriteMagic(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := frame.ReadMagic(a); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+		a.Close()
+	})
+	return s, a
+}
+
+func TestPing(t *testing.T) {
+	c, s := testPair(t, nil, nil)
+	for _, sess := range []*Session{c, s} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		rtt, err := sess.Ping(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rtt <= 0 {
+			t.Errorf("ping returned a round trip time of %v", rtt)
+		}
+	}
+
+	s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.Ping(ctx); err == nil {
+		t.Error("ping of a closed peer succeeded")
+	}
+}
+
+// TestPingFlood checks that a peer which pings but does not read the
+// pongs can't make the session queue them without limit
+func TestPingFlood(t *testing.T) {
+	s, conn := rawPeer(t, false, nil)
+	ping := frame.New(frame.Ping, 0, 0, frame.PingSize)
+	payload := make([]byte, frame.PingSize)
+	for i := 0; i < 4*asyncQueueSize; i++ {
+		if err := frame.WriteFrame(conn, &ping, payload); err != nil {
+			break
+		}
+	}
+	waitFor(t, s.IsClosed)
+	if s.Err() != ErrControlBacklog {
+		t.Fatalf("session closed with %v, expected %v", s.Err(), ErrControlBacklog)
+	}
+}
+
+func TestStreamIDZero(t *testing.T) {
+	c, conn := rawPeer(t, true, nil)
+	hdr := frame.New(frame.Data, frame.FlagSYN, 0, 0)
+	if err := frame.WriteFrame(conn, &hdr, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, c.IsClosed)
+	var perr *ProtocolError
+	if !errors.As(c.Err(), &perr) {
+		t.Fatalf("session closed with %v, expected a protocol error", c.Err())
+	}
+}
+
+// TestStreamIDReuse checks that closing a stream reset by the peer
+// does not remove the stream which the peer opened next with the same
+// ID
+func TestStreamIDReuse(t *testing.T) {
+	s, conn := rawPeer(t, false, nil)
+	go io.Copy(ioutil.Discard, conn)
+	open := func() *Stream {
+		hdr := frame.New(frame.Data, frame.FlagSYN, 1, 0)
+		if err := frame.WriteFrame(conn, &hdr, nil); err != nil {
+			t.Fatal(err)
+		}
+		st, err := s.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+
+	old := open()
+	rst := frame.New(frame.Data, frame.FlagRST, 1, 0)
+	if err := frame.WriteFrame(conn, &rst, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return s.NumStreams() == 0 })
+	st := open()
+	old.Close()
+
+	data := frame.New(frame.Data, 0, 1, 2)
+	if err := frame.WriteFrame(conn, &data, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	st.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(st, b); err != nil || string(b) != "hi" {
+		t.Fatalf("read %q, %v", b, err)
+	}
+}
+
+// TestSYNFlood checks that a peer which opens streams beyond the
+// accept backlog, but does not read the resets, can't make the
+// session queue frames without limit
+func TestSYNFlood(t *testing.T) {
+	config := DefaultConfig()
+	config.AcceptBacklog = 1
+	s, conn := rawPeer(t, false, config)
+
+	for id := uint32(1); id < 4*asyncQueueSize; id += 2 {
+		hdr := frame.New(frame.Data, frame.FlagSYN, id, 0)
+		if err := frame.WriteFrame(conn, &hdr, nil); err != nil {
+			break
+		}
+	}
+	waitFor(t, s.IsClosed)
+	if s.Err() != ErrControlBacklog {
+		t.Fatalf("session closed with %v, expected %v", s.Err(), ErrControlBacklog)
+	}
+}
+
+// TestEmptyMessageFlood checks that a peer can't queue empty messages,
+// which cost no window, without limit
+func TestEmptyMessageFlood(t *testing.T) {
+	s, conn := rawPeer(t, false, nil)
+	hdr := frame.New(frame.Data, frame.FlagSYN, 1, 0)
+	if err := frame.WriteFrame(conn, &hdr, nil); err != nil {
+		t.Fatal(err)
+	}
+	st, err := s.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	empty := frame.New(frame.Data, 0, 1, 0)
+	for i := 0; i < maxEmptyMessages; i++ {
+		if err := frame.WriteFrame(conn, &empty, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reading one makes room for one more
+	if msg, err := st.ReadMsg(); err != nil || len(msg) != 0 {
+		t.Fatalf("read %q, %v, expected an empty message", msg, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := frame.WriteFrame(conn, &empty, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, s.IsClosed)
+	if !errors.Is(s.Err(), ErrTooManyEmptyMessages) {
+		t.Fatalf("session closed with %v, expected %v", s.Err(), ErrTooManyEmptyMessages)
+	}
+}
+
+// TestRandomFrames feeds sessions with random, mostly well formed,
+// frames while streams are used concurrently. Whatever the peer sends,
+// the session must keep reading from the connection and shut down,
+// along with all of its streams, once the connection goes away. The
+// subtests are named after their seed, so a failure can be repeated
+// with -run TestRandomFrames/<seed>.
+func TestRandomFrames(t *testing.T) {
+	runs := 1000
+	if testing.Short() {
+		runs = 30
+	}
+	for seed := 0; seed < runs; seed++ {
+		rnd := rand.New(rand.NewSource(int64(seed)))
+		t.Run(strconv.Itoa(seed), func(t *testing.T) {
+			testRandomFrames(t, rnd)
+		})
+	}
+}
+
+func testRandomFrames(t *testing.T, rnd *rand.Rand) {
+	config := DefaultConfig()
+	config.AcceptBacklog = 1 + rnd.Intn(4)
+	config.Strict = rnd.Intn(4) == 0
+	config.WriteEmptyFrames = rnd.Intn(2) == 0
+	if rnd.Intn(2) == 0 {
+		config.ReadBufferSize = 0
+	}
+	if rnd.Intn(4) == 0 {
+		config.CoalesceDelay = time.Millisecond
+	}
+	if rnd.Intn(4) == 0 {
+		config.KeepAliveInterval = time.Millisecond
+		config.KeepAliveTimeout = 50 * time.Millisecond
+	}
+	client := rnd.Intn(2) == 0
+	s, conn := rawPeer(t, client, config)
+	// Only the receive path is exercised, what the session sends is
+	// dropped. Some peers don't even read it, which must not stop the
+	// session from reading.
+	if rnd.Intn(4) != 0 {
+		go io.Copy(ioutil.Discard, conn)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func(seed int64) {
+		defer wg.Done()
+		r := rand.New(rand.NewSource(seed))
+		for {
+			st, err := s.AcceptStream()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go useStream(&wg, st, r.Int63())
+		}
+	}(rnd.Int63())
+	for i := rnd.Intn(3); i > 0; i-- {
+		wg.Add(1)
+		go func(seed int64) {
+			st, err := s.Open()
+			if err != nil {
+				wg.Done()
+				return
+			}
+			useStream(&wg, st, seed)
+		}(rnd.Int63())
+	}
+
+	// A client session opens odd stream IDs and its peer even ones
+	next := uint32(1)
+	if client {
+		next = 2
+	}
+	var buf [frame.HeaderSize]byte
+	for i := 0; i < 100; i++ {
+		hdr, body := randomFrame(rnd, &next)
+		hdr.Encode(buf[:])
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		_, err := conn.Write(buf[:])
+		if err == nil && len(body) > 0 {
+			_, err = conn.Write(body)
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("session stopped reading at frame %d: %v", i, hdr)
+		}
+		if err != nil {
+			// The session shut down
+			break
+		}
+	}
+
+	conn.Close()
+	waitFor(t, s.IsClosed)
+	if s.Err() == nil {
+		t.Error("session shut down without an error")
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("streams still blocked after the session shut down")
+	}
+}
+
+// useStream performs random operations on st until one fails
+func useStream(wg *sync.WaitGroup, st *Stream, seed int64) {
+	defer wg.Done()
+	defer st.Close()
+	r := rand.New(rand.NewSource(seed))
+	buf := make([]byte, 4096)
+	for i := 0; i < 8; i++ {
+		var err error
+		switch r.Intn(9) {
+		case 0:
+			_, err = st.Read(buf)
+		case 1:
+			_, err = st.ReadMsg()
+		case 2:
+			_, err = st.Write(buf[:r.Intn(len(buf))])
+		case 3:
+			err = st.CloseRead()
+		case 4:
+			err = st.CloseWrite()
+		case 5:
+			err = st.Signal(buf[:r.Intn(16)])
+		case 6:
+			err = st.WriteMsg(buf[:r.Intn(len(buf))])
+		case 7:
+			err = st.Flush()
+		case 8:
+			err = st.SetNoDelay(r.Intn(2) == 0)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// randomFrame returns a frame which is well formed more often than
+// not. Like a well behaved peer, it opens streams in order, starting
+// with the ID *next, but other frames go to any stream, whether it is
+// open or not.
+func randomFrame(rnd *rand.Rand, next *uint32) (frame.Header, []byte) {
+	t := frame.Type(rnd.Intn(6))
+	if rnd.Intn(200) == 0 {
+		t = frame.Type(rnd.Intn(256))
+	}
+	hdr := frame.New(t, 0, 1+uint32(rnd.Intn(int(*next))), 0)
+	switch t {
+	case frame.Data:
+		hdr.Flags = uint16(rnd.Intn(frame.KnownFlags+1)) &^ frame.FlagSYN
+		if rnd.Intn(4) == 0 {
+			hdr.Flags |= frame.FlagSYN
+			if rnd.Intn(20) != 0 {
+				hdr.StreamID = *next
+				*next += 2
+			}
+		}
+	case frame.Settings, frame.Ping, frame.Pong:
+		hdr.StreamID = 0
+	}
+	if rnd.Intn(300) == 0 {
+		hdr.StreamID = rnd.Uint32()
+	}
+	if rnd.Intn(200) == 0 {
+		hdr.Flags = uint16(rnd.Intn(1 << 16))
+	}
+	if rnd.Intn(300) == 0 {
+		hdr.Version = uint8(rnd.Intn(256))
+	}
+
+	var n int
+	switch t {
+	case frame.Data:
+		switch rnd.Intn(4) {
+		case 0:
+		case 1:
+			n = rnd.Intn(64)
+		default:
+			n = rnd.Intn(frame.MaxPayload + 1)
+		}
+		if rnd.Intn(200) == 0 {
+			n = frame.MaxPayload + 1 + rnd.Intn(64)
+		}
+	case frame.WindowUpdate:
+		hdr.Length = uint32(rnd.Intn(1 << 20))
+		if rnd.Intn(200) == 0 {
+			hdr.Length = rnd.Uint32()
+		}
+		return hdr, nil
+	case frame.Signal:
+		n = rnd.Intn(MaxSignalSize + 1)
+		if rnd.Intn(200) == 0 {
+			n = MaxSignalSize + 1 + rnd.Intn(64)
+		}
+	case frame.Settings:
+		var b []byte
+		for i := rnd.Intn(3); i > 0; i-- {
+			b = frame.AppendSetting(b, frame.Setting{
+				ID:    uint16(rnd.Intn(3)),
+				Value: uint32(frame.MaxPayload + rnd.Intn(frame.MaxPayload)),
+			})
+		}
+		if rnd.Intn(200) == 0 {
+			b = append(b, 0)
+		}
+		hdr.Length = uint32(len(b))
+		return hdr, b
+	case frame.Ping, frame.Pong:
+		n = frame.PingSize
+		if rnd.Intn(200) == 0 {
+			n = rnd.Intn(2 * frame.PingSize)
+		}
+	default:
+		n = rnd.Intn(64)
+	}
+	body := make([]byte, n)
+	rnd.Read(body)
+	hdr.Length = uint32(n)
+	return hdr, body
+}
+
+// waitFor polls cond until it returns true
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// bufferedSize returns the amount of unread data of the stream
+func (st *Stream) bufferedSize() int {
+	st.stateLock.Lock()
+	defer st.stateLock.Unlock()
+	return st.recvBuf.size
+}
+
+// TestMagicError checks that a peer which does not speak the protocol
+// is reported with the magic word that was expected
+func TestMagicError(t *testing.T) {
+	for _, key := range [][]byte{nil, []byte("0123456789abcdef")} {
+		a, b := net.Pipe()
+		go func() {
+			b.Write([]byte("HTTP/1.1 200 OK\r\n"))
+			io.Copy(ioutil.Discard, b)
+		}()
+		config := DefaultConfig()
+		config.SharedKey = key
+		_, err := Client(a, config)
+		a.Close()
+		b.Close()
+		var me *frame.MagicError
+		if !errors.As(err, &me) {
+			t.Fatalf("got %v, want a *frame.MagicError", err)
+		}
+		want := frame.Magic
+		if key != nil {
+			want = frame.AuthMagic
+		}
+		if me.Got != [4]byte{'H', 'T', 'T', 'P'} || me.Want != want {
+			t.Errorf("got %q instead of %q, want %q", me.Got[:], me.Want[:], want[:])
+		}
+	}
+}
+
+func TestConfigWindowBelowFrameSize(t *testing.T) {
+	c := DefaultConfig()
+	c.MaxFrameSize = 1024 * 1024
+	if err := verifyConfig(c); err == nil {
+		t.Fatal("window smaller than the frame size accepted")
+	}
+	c.MaxStreamWindowSize = c.MaxFrameSize
+	if err := verifyConfig(c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestWriteMsgFullFrame checks that a message of the largest frame
+// size gets through once the peer read the data before it, even if
+// the credit freed by the reads is too little to be batched into a
+// window update on its own.
+func TestWriteMsgFullFrame(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxFrameSize = initialStreamWindow
+	c, s := testPair(t, config, config)
+	cs, ss := testStreams(t, c, s)
+
+	first := make([]byte, 100*1024)
+	if _, err := cs.Write(first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(ss, first); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := make([]byte, config.MaxFrameSize)
+	cs.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	ss.SetReadDeadline(time.Now().Add(5 * time.Second))
+	errs := make(chan error, 1)
+	go func() { errs <- cs.WriteMsg(msg) }()
+	got, err := ss.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(msg) {
+		t.Fatalf("received %d bytes, sent %d", len(got), len(msg))
+	}
+}
@@ -0,0 +1,73 @@
+package mux
+
+import (
+	"net"
+	"time"
+)
+
+// PacketConn is a net.PacketConn carrying datagrams over a stream.
+// Each WriteTo() is sent as a single data frame with WriteMsg() and
+// each ReadFrom() returns the payload of one frame, so that datagram
+// based protocols, e.g. DNS style request/response or statsd, can be
+// used over Hyper-V sockets, which have no datagram mode. Unlike real
+// datagrams, packets are delivered reliably and in order. Both sides
+// of the stream must use a PacketConn, or WriteMsg() and ReadMsg().
+type PacketConn struct {
+	st *Stream
+}
+
+// NewPacketConn returns a PacketConn using st
+func NewPacketConn(st *Stream) *PacketConn {
+	return &PacketConn{st}
+}
+
+// Stream returns the underlying stream
+func (pc *PacketConn) Stream() *Stream {
+	return pc.st
+}
+
+// ReadFrom reads the next packet into b. As with datagram sockets, the
+// part of a packet which does not fit into b is discarded. The address
+// returned is always the remote address of the stream.
+func (pc *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	msg, err := pc.st.ReadMsg()
+	if err != nil {
+		return 0, nil, err
+	}
+	return copy(b, msg), pc.st.RemoteAddr(), nil
+}
+
+// WriteTo sends b as a single packet to the peer of the stream. addr
+// is ignored, as a stream only has one peer. Packets larger than the
+// maximum frame size are rejected.
+func (pc *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if err := pc.st.WriteMsg(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the underlying stream
+func (pc *PacketConn) Close() error {
+	return pc.st.Close()
+}
+
+// LocalAddr returns the local address of the stream
+func (pc *PacketConn) LocalAddr() net.Addr {
+	return pc.st.LocalAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the stream
+func (pc *PacketConn) SetDeadline(t time.Time) error {
+	return pc.st.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the stream
+func (pc *PacketConn) SetReadDeadline(t time.Time) error {
+	return pc.st.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the stream
+func (pc *PacketConn) SetWriteDeadline(t time.Time) error {
+	return pc.st.SetWriteDeadline(t)
+}
@@ -0,0 +1,895 @@
+package mux
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/linuxkit/virtsock/pkg/mux/frame"
+	"github.com/pkg/errors"
+)
+
+// Session multiplexes streams over a single connection. A Session
+// also implements net.Listener, returning streams opened by the peer
+// from Accept().
+type Session struct {
+	// stats is first to keep the counters 64-bit aligned for atomic
+	// access on 32-bit platforms
+	stats   sessionStats
+	created time.Time
+
+	conn   net.Conn
+	config *Config
+	client bool
+
+	// recvLoop reads from r. Unless disabled in the config this is a
+	// buffer, so that the header and payload of small frames, and
+	// often several frames, are read with a single read from the
+	// connection
+	r io.Reader
+
+	// rec records the frame currently being received if frames are
+	// captured, see Config.Capture
+	rec *recordingReader
+
+	streamLock   sync.Mutex
+	streams      map[uint32]*Stream
+	nextStreamID uint32
+
+	acceptCh chan *Stream
+
+	// pings maps the IDs of pings in flight to the channel closed when
+	// the matching pong arrives
+	pingLock   sync.Mutex
+	pings      map[uint64]chan struct{}
+	nextPingID uint64
+
+	// sendFrameSize is the largest payload we send in a data frame.
+	// It is raised if both sides allow large frames. Accessed
+	// atomically.
+	sendFrameSize uint32
+
+	// All frames are written by sendLoop. Frames on ctrlCh are
+	// written before any waiting on asyncCh, which are written before
+	// any waiting on sendCh.
+	sendCh  chan *sendReady
+	ctrlCh  chan *sendReady
+	asyncCh chan asyncFrame
+	// asyncOverflow is set once asyncCh overflowed. Accessed
+	// atomically.
+	asyncOverflow int32
+
+	shutdownLock sync.Mutex
+	shutdown     bool
+	shutdownErr  error
+	shutdownCh   chan struct{}
+}
+
+// Stats holds the traffic counters and state of a session. Data
+// frames are counted including those which only carry a FIN or RST
+// flag. All other frames are control frames.
+type Stats struct {
+	BytesSent          uint64 // payload bytes of data frames sent
+	BytesReceived      uint64 // payload bytes of data frames received
+	FramesSent         uint64 // data frames sent
+	FramesReceived     uint64 // data frames received
+	CtrlFramesSent     uint64 // control frames sent
+	CtrlFramesReceived uint64 // control frames received
+
+	Streams int           // number of open streams
+	Closed  bool          // the session has been shut down
+	Age     time.Duration // time since the session was established
+
+	// LastRTT is the round trip time of the last successful Ping(),
+	// or 0 if there was none. RTTHistogram counts the round trip
+	// times of all successful pings, see RTTBuckets.
+	LastRTT      time.Duration
+	RTTHistogram [len(RTTBuckets) + 1]uint64
+}
+
+// RTTBuckets are the upper bounds of the buckets of
+// Stats.RTTHistogram. The last bucket of the histogram counts round
+// trips taking longer than the last bound.
+var RTTBuckets = [...]time.Duration{
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// sessionStats are the counters of a session, updated atomically
+type sessionStats struct {
+	bytesSent          uint64
+	bytesReceived      uint64
+	framesSent         uint64
+	framesReceived     uint64
+	ctrlFramesSent     uint64
+	ctrlFramesReceived uint64
+	lastRTT            int64
+	rtt                [len(RTTBuckets) + 1]uint64
+}
+
+// count accounts for a frame sent or received
+func (c *sessionStats) count(sent bool, hdr *frame.Header) {
+	switch {
+	case hdr.Type == frame.Data && sent:
+		atomic.AddUint64(&c.framesSent, 1)
+		atomic.AddUint64(&c.bytesSent, uint64(hdr.Length))
+	case hdr.Type == frame.Data:
+		atomic.AddUint64(&c.framesReceived, 1)
+		atomic.AddUint64(&c.bytesReceived, uint64(hdr.Length))
+	case sent:
+		atomic.AddUint64(&c.ctrlFramesSent, 1)
+	default:
+		atomic.AddUint64(&c.ctrlFramesReceived, 1)
+	}
+}
+
+// recordRTT accounts for the round trip time of a ping
+func (c *sessionStats) recordRTT(rtt time.Duration) {
+	atomic.StoreInt64(&c.lastRTT, int64(rtt))
+	i := 0
+	for i < len(RTTBuckets) && rtt > RTTBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&c.rtt[i], 1)
+}
+
+// sendReady is a frame waiting to be written by sendLoop
+type sendReady struct {
+	hdr  frame.Header
+	body []byte
+	err  chan error
+}
+
+// asyncFrame is a control frame queued by sendAsync()
+type asyncFrame struct {
+	hdr  frame.Header
+	body []byte
+}
+
+// sendReadyPool recycles sendReady, including the reply channel, as
+// one is needed for every frame sent
+var sendReadyPool = sync.Pool{
+	New: func() interface{} {
+		return &sendReady{err: make(chan error, 1)}
+	},
+}
+
+func newSession(conn net.Conn, config *Config, client bool) (*Session, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if err := verifyConfig(config); err != nil {
+		return nil, err
+	}
+	if err := handshake(conn, config.SharedKey, client); err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		created:       time.Now(),
+		conn:          conn,
+		config:        config,
+		client:        client,
+		r:             conn,
+		streams:       make(map[uint32]*Stream),
+		pings:         make(map[uint64]chan struct{}),
+		acceptCh:      make(chan *Stream, config.AcceptBacklog),
+		sendFrameSize: frame.MaxPayload,
+		sendCh:        make(chan *sendReady),
+		ctrlCh:        make(chan *sendReady),
+		asyncCh:       make(chan asyncFrame, asyncQueueSize),
+		shutdownCh:    make(chan struct{}),
+	}
+	if config.ReadBufferSize > 0 {
+		s.r = bufio.NewReaderSize(conn, config.ReadBufferSize)
+	}
+	if config.Capture != nil {
+		s.rec = &recordingReader{r: s.r}
+		s.r = s.rec
+	}
+	if client {
+		s.nextStreamID = 1
+	} else {
+		s.nextStreamID = 2
+	}
+
+	// Label the I/O goroutines with the peer, so profiles of hosts
+	// talking to many VMs can be attributed
+	remote := fmt.Sprint(conn.RemoteAddr())
+	go pprof.Do(context.Background(), pprof.Labels("mux.remote", remote, "mux.loop", "recv"),
+		func(context.Context) { s.recvLoop() })
+	go pprof.Do(context.Background(), pprof.Labels("mux.remote", remote, "mux.loop", "send"),
+		func(context.Context) { s.sendLoop() })
+
+	if config.KeepAliveInterval > 0 {
+		go s.keepalive()
+	}
+
+	if config.MaxFrameSize > frame.MaxPayload {
+		settings := frame.AppendSetting(nil, frame.Setting{ID: frame.SettingMaxFrameSize, Value: config.MaxFrameSize})
+		hdr := frame.New(frame.Settings, 0, 0, uint32(len(settings)))
+		if err := s.sendCtrl(&hdr, settings, nil); err != nil {
+			s.Close()
+			return nil, errors.Wrap(err, "failed to send settings")
+		}
+	}
+	return s, nil
+}
+
+// handshake sends our magic word and verifies the peer's. With a
+// shared key, the magic words are followed by the challenges and the
+// peers authenticate each other, see auth.go.
+func handshake(conn net.Conn, key []byte, client bool) error {
+	magic, other := frame.Magic, frame.AuthMagic
+	var nonce []byte
+	if key != nil {
+		magic, other = frame.AuthMagic, frame.Magic
+		var err error
+		if nonce, err = newNonce(); err != nil {
+			return err
+		}
+	}
+	// Write concurrently, the peer may not read before it has written
+	werr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(append(magic[:], nonce...))
+		werr <- err
+	}()
+
+	var got [4]byte
+	if _, err := io.ReadFull(conn, got[:]); err != nil {
+		return errors.Wrap(err, "failed to read magic")
+	}
+	if got == other {
+		return ErrAuthMismatch
+	}
+	if got != magic {
+		return &frame.MagicError{Got: got, Want: magic}
+	}
+	var peerNonce []byte
+	if key != nil {
+		peerNonce = make([]byte, len(nonce))
+		if _, err := io.ReadFull(conn, peerNonce); err != nil {
+			return errors.Wrap(err, "failed to read challenge")
+		}
+	}
+	if err := <-werr; err != nil {
+		return errors.Wrap(err, "failed to write magic")
+	}
+	if key == nil {
+		return nil
+	}
+	if client {
+		return authenticate(conn, key, true, nonce, peerNonce)
+	}
+	return authenticate(conn, key, false, peerNonce, nonce)
+}
+
+// Open opens a new stream to the peer.
+func (s *Session) Open() (*Stream, error) {
+	s.streamLock.Lock()
+	// Checked under streamLock, so that Close() either refuses the
+	// stream here or finds it and shuts it down
+	if s.IsClosed() {
+		s.streamLock.Unlock()
+		return nil, ErrSessionShutdown
+	}
+	id := s.nextStreamID
+	if id >= math.MaxUint32-1 {
+		s.streamLock.Unlock()
+		return nil, ErrStreamsExhausted
+	}
+	s.nextStreamID += 2
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.streamLock.Unlock()
+
+	hdr := frame.New(frame.Data, frame.FlagSYN, id, 0)
+	if err := s.send(&hdr, nil, nil); err != nil {
+		s.removeStream(st)
+		return nil, err
+	}
+	return st, nil
+}
+
+// OpenStream is the same as Open. It is provided for familiarity with
+// other multiplexers, such as yamux.
+func (s *Session) OpenStream() (*Stream, error) {
+	return s.Open()
+}
+
+// AcceptStream waits for and returns the next stream opened by the peer.
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case st := <-s.acceptCh:
+		return st, nil
+	case <-s.shutdownCh:
+		return nil, ErrSessionShutdown
+	}
+}
+
+// Accept waits for and returns the next stream opened by the peer.
+func (s *Session) Accept() (net.Conn, error) {
+	st, err := s.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Addr returns the local address of the underlying connection
+func (s *Session) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// LocalAddr returns the local address of the underlying connection
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the underlying connection
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// NumStreams returns the number of currently open streams
+func (s *Session) NumStreams() int {
+	s.streamLock.Lock()
+	defer s.streamLock.Unlock()
+	return len(s.streams)
+}
+
+// Stats returns the traffic counters and state of the session, so that
+// hosts can account for the traffic of each guest. Frames are counted
+// once they have been written to or read from the connection.
+func (s *Session) Stats() Stats {
+	stats := Stats{
+		BytesSent:          atomic.LoadUint64(&s.stats.bytesSent),
+		BytesReceived:      atomic.LoadUint64(&s.stats.bytesReceived),
+		FramesSent:         atomic.LoadUint64(&s.stats.framesSent),
+		FramesReceived:     atomic.LoadUint64(&s.stats.framesReceived),
+		CtrlFramesSent:     atomic.LoadUint64(&s.stats.ctrlFramesSent),
+		CtrlFramesReceived: atomic.LoadUint64(&s.stats.ctrlFramesReceived),
+		Streams:            s.NumStreams(),
+		Closed:             s.IsClosed(),
+		Age:                time.Since(s.created),
+		LastRTT:            time.Duration(atomic.LoadInt64(&s.stats.lastRTT)),
+	}
+	for i := range stats.RTTHistogram {
+		stats.RTTHistogram[i] = atomic.LoadUint64(&s.stats.rtt[i])
+	}
+	return stats
+}
+
+// Ping sends a ping frame to the peer and waits for its reply, to
+// measure the responsiveness of the peer. It returns the round trip
+// time, which is also accounted for in Stats(). Peers running an
+// older version of this package skip ping frames without replying, so
+// ctx should have a deadline. Older peers with Config.Strict set
+// fail the session instead, so don't ping those.
+func (s *Session) Ping(ctx context.Context) (time.Duration, error) {
+	ch := make(chan struct{})
+	s.pingLock.Lock()
+	id := s.nextPingID
+	s.nextPingID++
+	s.pings[id] = ch
+	s.pingLock.Unlock()
+	defer func() {
+		s.pingLock.Lock()
+		delete(s.pings, id)
+		s.pingLock.Unlock()
+	}()
+
+	payload := make([]byte, frame.PingSize)
+	binary.BigEndian.PutUint64(payload, id)
+	hdr := frame.New(frame.Ping, 0, 0, frame.PingSize)
+	start := time.Now()
+	// Send asynchronously, so that ctx also bounds a blocked send
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.sendCtrl(&hdr, payload, nil) }()
+
+	for {
+		select {
+		case err := <-errCh:
+			if err != nil {
+				return 0, err
+			}
+		case <-ch:
+			rtt := time.Since(start)
+			s.stats.recordRTT(rtt)
+			return rtt, nil
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-s.shutdownCh:
+			return 0, ErrSessionShutdown
+		}
+	}
+}
+
+// IsClosed returns true if the session has been shut down
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseChan returns a channel which is closed once the session has
+// been shut down
+func (s *Session) CloseChan() <-chan struct{} {
+	return s.shutdownCh
+}
+
+// Close shuts down the session, closing the underlying connection
+// and all streams.
+func (s *Session) Close() error {
+	s.shutdownLock.Lock()
+	if s.shutdown {
+		s.shutdownLock.Unlock()
+		return nil
+	}
+	s.shutdown = true
+	if s.shutdownErr == nil {
+		s.shutdownErr = ErrSessionShutdown
+	}
+	close(s.shutdownCh)
+	s.shutdownLock.Unlock()
+
+	err := s.conn.Close()
+
+	s.streamLock.Lock()
+	for _, st := range s.streams {
+		st.sessionClosed()
+	}
+	s.streamLock.Unlock()
+	return err
+}
+
+// exitErr records the reason for the session shutting down and closes it
+func (s *Session) exitErr(err error) {
+	s.shutdownLock.Lock()
+	if s.shutdownErr == nil {
+		s.shutdownErr = err
+	}
+	s.shutdownLock.Unlock()
+	s.Close()
+}
+
+// Err returns the reason the session was shut down, or nil if it is
+// still active.
+func (s *Session) Err() error {
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+	if !s.shutdown {
+		return nil
+	}
+	return s.shutdownErr
+}
+
+// send queues a frame and waits for it to be written. The optional
+// timeout channel aborts the wait if the frame has not been handed to
+// the sendLoop yet.
+func (s *Session) send(hdr *frame.Header, body []byte, timeout <-chan time.Time) error {
+	return s.queue(s.sendCh, hdr, body, timeout)
+}
+
+// sendCtrl is like send but the frame overtakes queued data frames
+func (s *Session) sendCtrl(hdr *frame.Header, body []byte, timeout <-chan time.Time) error {
+	return s.queue(s.ctrlCh, hdr, body, timeout)
+}
+
+func (s *Session) queue(ch chan *sendReady, hdr *frame.Header, body []byte, timeout <-chan time.Time) error {
+	r := sendReadyPool.Get().(*sendReady)
+	r.hdr = *hdr
+	r.body = body
+	defer func() {
+		r.body = nil
+		sendReadyPool.Put(r)
+	}()
+
+	select {
+	case ch <- r:
+	case <-s.shutdownCh:
+		return ErrSessionShutdown
+	case <-timeout:
+		return ErrTimeout
+	}
+	// Once handed over, the sendLoop always replies
+	return <-r.err
+}
+
+// sendAsync queues a control frame without waiting for it to be
+// written. It is used from the receive path, which must never block
+// on sending. The queue is bounded, so that a peer which keeps
+// sending frames that need an answer but does not read can't make us
+// use up memory. If it overflows, the session is shut down with
+// ErrControlBacklog. sendAsync may be called with a stream's lock
+// held.
+func (s *Session) sendAsync(hdr *frame.Header, body []byte) {
+	select {
+	case s.asyncCh <- asyncFrame{hdr: *hdr, body: body}:
+	default:
+		if atomic.CompareAndSwapInt32(&s.asyncOverflow, 0, 1) {
+			// Shutting down locks the streams
+			go s.exitErr(ErrControlBacklog)
+		}
+	}
+}
+
+func (s *Session) sendLoop() {
+	var buf [frame.HeaderSize]byte
+	// Header and payload are written as net.Buffers, so connections
+	// from the net package send them with a single writev()
+	var bufs [2][]byte
+	var vec net.Buffers
+	for {
+		var r *sendReady
+		var async asyncFrame
+		select {
+		case r = <-s.ctrlCh:
+		default:
+			select {
+			case r = <-s.ctrlCh:
+			case async = <-s.asyncCh:
+			default:
+				select {
+				case r = <-s.ctrlCh:
+				case async = <-s.asyncCh:
+				case r = <-s.sendCh:
+				case <-s.shutdownCh:
+					return
+				}
+			}
+		}
+		hdr, body := &async.hdr, async.body
+		if r != nil {
+			hdr, body = &r.hdr, r.body
+		}
+
+		s.trace(true, hdr)
+		hdr.Encode(buf[:])
+		bufs[0], bufs[1] = buf[:], body
+		vec = bufs[:1]
+		if len(body) > 0 {
+			vec = bufs[:2]
+		}
+		_, err := vec.WriteTo(s.conn)
+		bufs[1] = nil
+		if err == nil {
+			s.stats.count(true, hdr)
+			if s.config.Capture != nil {
+				s.config.Capture.Capture(true, time.Now(), hdr, body)
+			}
+		}
+		if r != nil {
+			r.err <- err
+		}
+		if err != nil {
+			s.exitErr(err)
+			return
+		}
+	}
+}
+
+func (s *Session) recvLoop() {
+	var buf [frame.HeaderSize]byte
+	var hdr frame.Header
+	for {
+		if s.rec != nil {
+			s.rec.buf = s.rec.buf[:0]
+		}
+		if _, err := io.ReadFull(s.r, buf[:]); err != nil {
+			s.exitErr(err)
+			return
+		}
+		hdr.Decode(buf[:])
+		if hdr.Version != frame.Version {
+			s.exitErr(protocolErrorf(&hdr, "unsupported protocol version %d", hdr.Version))
+			return
+		}
+		s.trace(false, &hdr)
+
+		if s.config.Strict {
+			if err := hdr.CheckStrict(); err != nil {
+				s.exitErr(&ProtocolError{Header: hdr, Err: err})
+				return
+			}
+		}
+
+		var err error
+		switch hdr.Type {
+		case frame.Data:
+			err = s.handleData(&hdr)
+		case frame.WindowUpdate:
+			err = s.handleWindowUpdate(&hdr)
+		case frame.Signal:
+			err = s.handleSignal(&hdr)
+		case frame.Settings:
+			err = s.handleSettings(&hdr)
+		case frame.Ping, frame.Pong:
+			err = s.handlePing(&hdr)
+		default:
+			// Skip frame types we don't know about, but don't let
+			// the peer tie us up with a huge one
+			if hdr.Length > s.config.MaxFrameSize {
+				err = protocolErrorf(&hdr, "frame too large: %d bytes", hdr.Length)
+				break
+			}
+			_, err = io.CopyN(ioutil.Discard, s.r, int64(hdr.Length))
+		}
+		if err != nil {
+			s.exitErr(err)
+			return
+		}
+		s.stats.count(false, &hdr)
+		if s.rec != nil {
+			s.config.Capture.Capture(false, time.Now(), &hdr, s.rec.buf[frame.HeaderSize:])
+		}
+	}
+}
+
+// recordingReader keeps a copy of everything read, so that the
+// receive loop can capture frames whose payload is consumed by the
+// frame handlers
+type recordingReader struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.buf = append(rr.buf, p[:n]...)
+	return n, err
+}
+
+// trace reports a frame to the trace callback, if one is configured
+func (s *Session) trace(sent bool, hdr *frame.Header) {
+	if s.config.Trace == nil {
+		return
+	}
+	s.config.Trace(TraceEvent{
+		Header: *hdr,
+		Sent:   sent,
+		Time:   time.Now(),
+	})
+}
+
+func (s *Session) handleData(hdr *frame.Header) error {
+	id := hdr.StreamID
+	flags := hdr.Flags
+	length := hdr.Length
+
+	if length > s.config.MaxFrameSize {
+		return protocolErrorf(hdr, "frame too large: %d bytes", length)
+	}
+
+	if flags&frame.FlagSYN != 0 {
+		if err := s.incomingStream(hdr); err != nil {
+			return err
+		}
+	}
+
+	s.streamLock.Lock()
+	st := s.streams[id]
+	s.streamLock.Unlock()
+
+	if st == nil {
+		// The stream is gone, drop the payload
+		_, err := io.CopyN(ioutil.Discard, s.r, int64(length))
+		return err
+	}
+
+	// Empty frames without flags are empty messages
+	if length > 0 || flags == 0 {
+		buf, pool := getRecvBuf(length)
+		if _, err := io.ReadFull(s.r, buf); err != nil {
+			putRecvBuf(pool)
+			return err
+		}
+		if err := st.pushData(buf, pool); err != nil {
+			return &ProtocolError{Header: *hdr, Err: err}
+		}
+	}
+	if flags&frame.FlagFIN != 0 {
+		st.remoteClose()
+	}
+	if flags&frame.FlagRST != 0 {
+		st.remoteReset()
+	}
+	return nil
+}
+
+func (s *Session) handleWindowUpdate(hdr *frame.Header) error {
+	s.streamLock.Lock()
+	st := s.streams[hdr.StreamID]
+	s.streamLock.Unlock()
+
+	if st != nil && !st.incrSendWindow(hdr.Length) {
+		return protocolErrorf(hdr, "send window overflow")
+	}
+	return nil
+}
+
+func (s *Session) handleSignal(hdr *frame.Header) error {
+	length := hdr.Length
+	if length > MaxSignalSize {
+		return protocolErrorf(hdr, "signal too large: %d bytes", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(s.r, payload); err != nil {
+		return err
+	}
+
+	s.streamLock.Lock()
+	st := s.streams[hdr.StreamID]
+	s.streamLock.Unlock()
+
+	if st != nil && s.config.SignalHandler != nil {
+		s.config.SignalHandler(st, payload)
+	}
+	return nil
+}
+
+// keepalive pings the peer every Config.KeepAliveInterval and shuts
+// down the session if it does not reply in time
+func (s *Session) keepalive() {
+	ticker := time.NewTicker(s.config.KeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.shutdownCh:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), s.config.KeepAliveTimeout)
+		_, err := s.Ping(ctx)
+		cancel()
+		if err == context.DeadlineExceeded {
+			s.exitErr(ErrKeepAliveTimeout)
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handlePing answers a ping, or wakes up the Ping() waiting for a pong
+func (s *Session) handlePing(hdr *frame.Header) error {
+	if hdr.StreamID != 0 {
+		return protocolErrorf(hdr, "%s frame on stream %d", hdr.Type, hdr.StreamID)
+	}
+	if hdr.Length != frame.PingSize {
+		return protocolErrorf(hdr, "invalid %s payload length %d", hdr.Type, hdr.Length)
+	}
+	payload := make([]byte, frame.PingSize)
+	if _, err := io.ReadFull(s.r, payload); err != nil {
+		return err
+	}
+
+	if hdr.Type == frame.Ping {
+		// A peer which pings without reading the pongs fills the
+		// bounded queue and ends the session
+		reply := frame.New(frame.Pong, 0, 0, frame.PingSize)
+		s.sendAsync(&reply, payload)
+		return nil
+	}
+
+	id := binary.BigEndian.Uint64(payload)
+	s.pingLock.Lock()
+	if ch, ok := s.pings[id]; ok {
+		close(ch)
+		delete(s.pings, id)
+	}
+	s.pingLock.Unlock()
+	return nil
+}
+
+// maxSettingsSize limits the payload of a settings frame
+const maxSettingsSize = 1024
+
+func (s *Session) handleSettings(hdr *frame.Header) error {
+	if hdr.StreamID != 0 {
+		return protocolErrorf(hdr, "settings frame on stream %d", hdr.StreamID)
+	}
+	if hdr.Length > maxSettingsSize {
+		return protocolErrorf(hdr, "settings too large: %d bytes", hdr.Length)
+	}
+	payload := make([]byte, hdr.Length)
+	if _, err := io.ReadFull(s.r, payload); err != nil {
+		return err
+	}
+	settings, err := frame.ParseSettings(payload)
+	if err != nil {
+		return &ProtocolError{Header: *hdr, Err: err}
+	}
+	for _, setting := range settings {
+		switch setting.ID {
+		case frame.SettingMaxFrameSize:
+			if setting.Value < frame.MaxPayload {
+				return protocolErrorf(hdr, "invalid max frame size %d", setting.Value)
+			}
+			size := setting.Value
+			if size > s.config.MaxFrameSize {
+				size = s.config.MaxFrameSize
+			}
+			atomic.StoreUint32(&s.sendFrameSize, size)
+		}
+		// Ignore settings we don't know about
+	}
+	return nil
+}
+
+// maxSendFrameSize returns the largest payload to send in a data frame
+func (s *Session) maxSendFrameSize() int {
+	return int(atomic.LoadUint32(&s.sendFrameSize))
+}
+
+// incomingStream registers a new stream opened by the peer with the
+// SYN frame hdr
+func (s *Session) incomingStream(hdr *frame.Header) error {
+	id := hdr.StreamID
+	// The peer must use IDs of the opposite parity to ours. 0 is
+	// reserved for frames concerning the session.
+	if id == 0 || (id%2 == 1) == s.client {
+		return protocolErrorf(hdr, "peer opened stream with invalid ID %d", id)
+	}
+
+	s.streamLock.Lock()
+	if _, ok := s.streams[id]; ok {
+		s.streamLock.Unlock()
+		return protocolErrorf(hdr, "peer opened duplicate stream %d", id)
+	}
+	// See Open()
+	if s.IsClosed() {
+		s.streamLock.Unlock()
+		return ErrSessionShutdown
+	}
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.streamLock.Unlock()
+
+	select {
+	case s.acceptCh <- st:
+	default:
+		// Backlog exceeded, reset the stream
+		s.removeStream(st)
+		hdr := frame.New(frame.Data, frame.FlagRST, id, 0)
+		s.sendAsync(&hdr, nil)
+	}
+	return nil
+}
+
+// removeStream forgets st. The peer may already have reused its ID
+// for a new stream, which must be left alone.
+func (s *Session) removeStream(st *Stream) {
+	s.streamLock.Lock()
+	if s.streams[st.id] == st {
+		delete(s.streams, st.id)
+	}
+	s.streamLock.Unlock()
+}
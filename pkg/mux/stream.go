@@ -0,0 +1,712 @@
+package mux
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/linuxkit/virtsock/pkg/mux/frame"
+)
+
+// Stream is a single logical connection within a session. It
+// implements net.Conn and supports half-close.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	stateLock    sync.Mutex
+	recvBuf      recvQueue
+	readClosed   bool // CloseRead() was called
+	writeClosed  bool // FIN was sent
+	localClosed  bool // Close() was called
+	remoteClosed bool // FIN was received
+	reset        bool // RST was sent or received
+	sessionGone  bool // the session was shut down
+
+	// recvWindow is the credit the peer has left to send to us,
+	// sendWindow is the credit we have left to send to the peer.
+	recvWindow uint32
+	sendWindow uint32
+
+	recvNotifyCh chan struct{}
+	sendNotifyCh chan struct{}
+
+	deadlineLock  sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// Small writes are collected in wbuf if Config.CoalesceDelay is
+	// set. wbufTimer flushes them once the delay has passed, and an
+	// error doing so is kept in wbufErr and returned by the next
+	// Write.
+	wbufLock  sync.Mutex
+	wbuf      []byte
+	wbufTimer *time.Timer
+	wbufErr   error
+	noDelay   bool
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:           id,
+		session:      s,
+		recvWindow:   initialStreamWindow,
+		sendWindow:   initialStreamWindow,
+		recvNotifyCh: make(chan struct{}, 1),
+		sendNotifyCh: make(chan struct{}, 1),
+	}
+}
+
+// ID returns the ID of the stream
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Session returns the session the stream belongs to
+func (st *Stream) Session() *Session {
+	return st.session
+}
+
+// LocalAddr returns the local address of the stream
+func (st *Stream) LocalAddr() net.Addr {
+	return Addr{Conn: st.session.LocalAddr(), StreamID: st.id}
+}
+
+// RemoteAddr returns the remote address of the stream
+func (st *Stream) RemoteAddr() net.Addr {
+	return Addr{Conn: st.session.RemoteAddr(), StreamID: st.id}
+}
+
+// Read reads data from the stream
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.stateLock.Lock()
+		if st.recvBuf.size > 0 {
+			n := st.recvBuf.read(b)
+			delta := st.windowDelta()
+			st.stateLock.Unlock()
+			if delta > 0 {
+				st.sendWindowUpdate(delta)
+			}
+			return n, nil
+		}
+		// Empty messages are not visible in the byte stream
+		st.recvBuf.reset()
+		err := st.recvErr()
+		st.stateLock.Unlock()
+		if err != nil {
+			return 0, err
+		}
+
+		if err := st.waitRecv(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// ReadMsg reads the payload of the next frame received, preserving
+// the message boundaries of WriteMsg() on the peer. If part of the
+// frame was already consumed by Read, the remainder is returned.
+func (st *Stream) ReadMsg() ([]byte, error) {
+	for {
+		st.stateLock.Lock()
+		if len(st.recvBuf.chunks) > 0 {
+			msg := st.recvBuf.pop()
+			delta := st.windowDelta()
+			st.stateLock.Unlock()
+			if delta > 0 {
+				st.sendWindowUpdate(delta)
+			}
+			return msg, nil
+		}
+		err := st.recvErr()
+		st.stateLock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := st.waitRecv(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// recvErr returns the error to report once all received data has been
+// consumed. It must be called with stateLock held.
+func (st *Stream) recvErr() error {
+	switch {
+	case st.reset:
+		return ErrStreamReset
+	case st.localClosed:
+		return ErrStreamClosed
+	case st.readClosed, st.remoteClosed:
+		return io.EOF
+	case st.sessionGone:
+		return ErrSessionShutdown
+	}
+	return nil
+}
+
+// windowDelta returns the credit to hand back to the peer once enough
+// data has been consumed. It must be called with stateLock held.
+func (st *Stream) windowDelta() uint32 {
+	max := st.session.config.MaxStreamWindowSize
+	delta := max - uint32(st.recvBuf.size) - st.recvWindow
+	// Batch small updates to limit the number of frames, unless the
+	// peer is left with too little credit for a full frame, which
+	// WriteMsg() would wait for forever
+	if delta < max/2 && st.recvWindow >= st.session.config.MaxFrameSize {
+		return 0
+	}
+	st.recvWindow += delta
+	return delta
+}
+
+func (st *Stream) sendWindowUpdate(delta uint32) {
+	hdr := frame.New(frame.WindowUpdate, 0, st.id, delta)
+	st.session.sendCtrl(&hdr, nil, nil)
+}
+
+// waitRecv blocks until there is a change in the receive state or
+// the read deadline expires
+func (st *Stream) waitRecv() error {
+	st.deadlineLock.Lock()
+	deadline := st.readDeadline
+	st.deadlineLock.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		delay := time.Until(deadline)
+		if delay <= 0 {
+			return ErrTimeout
+		}
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-st.recvNotifyCh:
+		return nil
+	case <-timeout:
+		return ErrTimeout
+	}
+}
+
+// Write writes data to the stream, splitting it into frames as needed
+func (st *Stream) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		if !st.session.config.WriteEmptyFrames {
+			return 0, nil
+		}
+		if err := st.Flush(); err != nil {
+			return 0, err
+		}
+		_, err := st.write(b)
+		return 0, err
+	}
+	if st.session.config.CoalesceDelay > 0 {
+		return st.writeCoalesced(b)
+	}
+	return st.writeAll(b)
+}
+
+// writeAll sends all of b, split into as many frames as needed
+func (st *Stream) writeAll(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := st.write(b[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// writeCoalesced buffers b if it fits into the current frame together
+// with previously buffered data. Otherwise the buffer is flushed and b
+// is sent straight away.
+func (st *Stream) writeCoalesced(b []byte) (int, error) {
+	st.wbufLock.Lock()
+	defer st.wbufLock.Unlock()
+
+	if err := st.wbufErr; err != nil {
+		st.wbufErr = nil
+		return 0, err
+	}
+	if !st.noDelay && len(st.wbuf)+len(b) < st.session.maxSendFrameSize() {
+		if len(st.wbuf) == 0 {
+			if st.wbufTimer == nil {
+				st.wbufTimer = time.AfterFunc(st.session.config.CoalesceDelay, st.flushDelayed)
+			} else {
+				st.wbufTimer.Reset(st.session.config.CoalesceDelay)
+			}
+		}
+		st.wbuf = append(st.wbuf, b...)
+		return len(b), nil
+	}
+
+	if err := st.flushLocked(); err != nil {
+		return 0, err
+	}
+	return st.writeAll(b)
+}
+
+// Flush sends data buffered by write coalescing, see
+// Config.CoalesceDelay, without waiting for the delay to pass.
+func (st *Stream) Flush() error {
+	st.wbufLock.Lock()
+	defer st.wbufLock.Unlock()
+	return st.flushLocked()
+}
+
+// SetNoDelay controls whether small writes on this stream are
+// coalesced if Config.CoalesceDelay is set. With noDelay set, every
+// write is sent immediately, and data buffered so far is flushed. It
+// has no effect if coalescing is not enabled for the session.
+func (st *Stream) SetNoDelay(noDelay bool) error {
+	st.wbufLock.Lock()
+	defer st.wbufLock.Unlock()
+	st.noDelay = noDelay
+	if noDelay {
+		return st.flushLocked()
+	}
+	return nil
+}
+
+// flushDelayed is called by wbufTimer once the coalescing delay has
+// passed
+func (st *Stream) flushDelayed() {
+	st.wbufLock.Lock()
+	defer st.wbufLock.Unlock()
+	if err := st.flushLocked(); err != nil && st.wbufErr == nil {
+		st.wbufErr = err
+	}
+}
+
+// flushLocked sends the buffered data. On error the data is dropped.
+// It must be called with wbufLock held.
+func (st *Stream) flushLocked() error {
+	if len(st.wbuf) == 0 {
+		return nil
+	}
+	st.wbufTimer.Stop()
+	_, err := st.writeAll(st.wbuf)
+	st.wbuf = st.wbuf[:0]
+	return err
+}
+
+// WriteMsg sends b as a single frame, so that it is returned in one
+// piece by ReadMsg() on the peer. Unlike Write, which may split data
+// arbitrarily, WriteMsg waits until the peer has granted enough credit
+// for the whole message. The message must not exceed 32 KiB, or the
+// larger frame size negotiated with the peer (see Config.MaxFrameSize).
+// As streams start with a window of 256 KiB, larger messages can only
+// be sent once the peer has read from the stream and granted more.
+func (st *Stream) WriteMsg(b []byte) error {
+	if len(b) > st.session.maxSendFrameSize() {
+		return fmt.Errorf("message too large: %d bytes", len(b))
+	}
+	// Buffered data must be sent first to keep the order
+	st.wbufLock.Lock()
+	defer st.wbufLock.Unlock()
+	if err := st.flushLocked(); err != nil {
+		return err
+	}
+	_, err := st.writeFrame(b, true)
+	return err
+}
+
+func (st *Stream) write(b []byte) (int, error) {
+	return st.writeFrame(b, false)
+}
+
+// writeFrame sends a single data frame with as much of b as the
+// available credit allows. If whole is set it waits until all of b
+// can be sent.
+func (st *Stream) writeFrame(b []byte, whole bool) (int, error) {
+	st.deadlineLock.Lock()
+	deadline := st.writeDeadline
+	st.deadlineLock.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		delay := time.Until(deadline)
+		if delay <= 0 {
+			return 0, ErrTimeout
+		}
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	// Wait for the peer to grant us credit
+	var n int
+	for {
+		st.stateLock.Lock()
+		var err error
+		switch {
+		case st.reset:
+			err = ErrStreamReset
+		case st.writeClosed, st.localClosed:
+			err = ErrStreamClosed
+		case st.sessionGone:
+			err = ErrSessionShutdown
+		}
+		ready := false
+		if err == nil && (st.sendWindow > 0 || len(b) == 0) && (!whole || int(st.sendWindow) >= len(b)) {
+			n = min(min(len(b), st.session.maxSendFrameSize()), int(st.sendWindow))
+			st.sendWindow -= uint32(n)
+			ready = true
+		}
+		st.stateLock.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if ready {
+			break
+		}
+
+		select {
+		case <-st.sendNotifyCh:
+		case <-timeout:
+			return 0, ErrTimeout
+		}
+	}
+
+	hdr := frame.New(frame.Data, 0, st.id, uint32(n))
+	if err := st.session.send(&hdr, b[:n], timeout); err != nil {
+		// The frame was not sent, give the credit back
+		st.stateLock.Lock()
+		st.sendWindow += uint32(n)
+		st.stateLock.Unlock()
+		st.notifySend()
+		return 0, err
+	}
+	return n, nil
+}
+
+// Signal sends a small out-of-band message to the peer, which
+// receives it through its Config.SignalHandler. Signals are not flow
+// controlled and overtake data written to any stream of the session
+// which has not been sent yet, making them suitable for urgent
+// notifications such as cancelling a transfer. The payload must not
+// exceed MaxSignalSize bytes.
+func (st *Stream) Signal(payload []byte) error {
+	if len(payload) > MaxSignalSize {
+		return fmt.Errorf("signal too large: %d bytes", len(payload))
+	}
+
+	st.stateLock.Lock()
+	var err error
+	switch {
+	case st.reset:
+		err = ErrStreamReset
+	case st.localClosed:
+		err = ErrStreamClosed
+	case st.sessionGone:
+		err = ErrSessionShutdown
+	}
+	st.stateLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	hdr := frame.New(frame.Signal, 0, st.id, uint32(len(payload)))
+	return st.session.sendCtrl(&hdr, payload, nil)
+}
+
+// CloseWrite shuts down the writing side of the stream. The peer
+// reads io.EOF once it has consumed all data sent before.
+func (st *Stream) CloseWrite() error {
+	if err := st.Flush(); err != nil {
+		return err
+	}
+	st.stateLock.Lock()
+	if st.writeClosed || st.reset || st.sessionGone {
+		st.stateLock.Unlock()
+		return nil
+	}
+	st.writeClosed = true
+	st.stateLock.Unlock()
+
+	hdr := frame.New(frame.Data, frame.FlagFIN, st.id, 0)
+	return st.session.send(&hdr, nil, nil)
+}
+
+// CloseRead shuts down the reading side of the stream. Buffered and
+// subsequently received data is discarded.
+func (st *Stream) CloseRead() error {
+	st.stateLock.Lock()
+	st.readClosed = true
+	st.discardRecvBuf()
+	st.stateLock.Unlock()
+	st.notifyRecv()
+	return nil
+}
+
+// Close closes both directions of the stream
+func (st *Stream) Close() error {
+	// Send coalesced data while the stream is still open
+	ferr := st.Flush()
+
+	st.stateLock.Lock()
+	if st.localClosed {
+		st.stateLock.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	st.discardRecvBuf()
+	st.stateLock.Unlock()
+	st.notifyRecv()
+	st.notifySend()
+
+	err := st.CloseWrite()
+	st.maybeRemove()
+	if err == nil {
+		err = ferr
+	}
+	if err == ErrSessionShutdown {
+		err = nil
+	}
+	return err
+}
+
+// discardRecvBuf drops unread data and returns the credit for it to
+// the peer. It must be called with stateLock held.
+func (st *Stream) discardRecvBuf() {
+	n := st.recvBuf.size
+	st.recvBuf.reset()
+	if n > 0 && !st.remoteClosed && !st.reset {
+		st.recvWindow += uint32(n)
+		hdr := frame.New(frame.WindowUpdate, 0, st.id, uint32(n))
+		st.session.sendAsync(&hdr, nil)
+	}
+}
+
+// SetDeadline sets the read and write deadlines of the stream
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.deadlineLock.Lock()
+	st.readDeadline = t
+	st.writeDeadline = t
+	st.deadlineLock.Unlock()
+	st.notifyRecv()
+	return nil
+}
+
+// SetReadDeadline sets the deadline for future and pending Read calls
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.deadlineLock.Lock()
+	st.readDeadline = t
+	st.deadlineLock.Unlock()
+	st.notifyRecv()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future Write calls
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.deadlineLock.Lock()
+	st.writeDeadline = t
+	st.deadlineLock.Unlock()
+	return nil
+}
+
+// notifyRecv wakes up a pending Read
+func (st *Stream) notifyRecv() {
+	select {
+	case st.recvNotifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// notifySend wakes up a pending Write
+func (st *Stream) notifySend() {
+	select {
+	case st.sendNotifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// pushData is called by the session with the payload of a data frame.
+// pool is the recvPool buffer backing b, if any, and is owned by the
+// stream from here on.
+func (st *Stream) pushData(b []byte, pool *[]byte) error {
+	st.stateLock.Lock()
+	if uint32(len(b)) > st.recvWindow {
+		st.stateLock.Unlock()
+		putRecvBuf(pool)
+		return ErrRecvWindowExceeded
+	}
+	discard := st.readClosed || st.localClosed
+	if discard {
+		// Nobody is going to read this, hand the credit straight back
+		st.stateLock.Unlock()
+		putRecvBuf(pool)
+		if len(b) == 0 {
+			return nil
+		}
+		hdr := frame.New(frame.WindowUpdate, 0, st.id, uint32(len(b)))
+		st.session.sendAsync(&hdr, nil)
+		return nil
+	}
+	if len(b) == 0 && st.recvBuf.empty >= maxEmptyMessages {
+		st.stateLock.Unlock()
+		return ErrTooManyEmptyMessages
+	}
+	st.recvWindow -= uint32(len(b))
+	st.recvBuf.push(b, pool)
+	st.stateLock.Unlock()
+	st.notifyRecv()
+	return nil
+}
+
+// incrSendWindow is called by the session when the peer granted more
+// credit. It returns false if the window would overflow.
+func (st *Stream) incrSendWindow(delta uint32) bool {
+	st.stateLock.Lock()
+	if st.sendWindow+delta < st.sendWindow {
+		st.stateLock.Unlock()
+		return false
+	}
+	st.sendWindow += delta
+	st.stateLock.Unlock()
+	st.notifySend()
+	return true
+}
+
+// remoteClose is called by the session when the peer sent a FIN
+func (st *Stream) remoteClose() {
+	st.stateLock.Lock()
+	st.remoteClosed = true
+	st.stateLock.Unlock()
+	st.notifyRecv()
+	st.maybeRemove()
+}
+
+// remoteReset is called by the session when the peer sent a RST
+func (st *Stream) remoteReset() {
+	st.stateLock.Lock()
+	st.reset = true
+	st.recvBuf.reset()
+	st.stateLock.Unlock()
+	st.notifyRecv()
+	st.notifySend()
+	st.session.removeStream(st)
+}
+
+// sessionClosed is called by the session when it shuts down. It must
+// not call back into the session.
+func (st *Stream) sessionClosed() {
+	st.stateLock.Lock()
+	st.sessionGone = true
+	st.stateLock.Unlock()
+	st.notifyRecv()
+	st.notifySend()
+}
+
+// maybeRemove removes the stream from the session once both sides
+// have closed it.
+func (st *Stream) maybeRemove() {
+	st.stateLock.Lock()
+	done := st.localClosed && (st.remoteClosed || st.reset)
+	st.stateLock.Unlock()
+	if done {
+		st.session.removeStream(st)
+	}
+}
+
+// Payloads of large data frames are read into buffers from recvPool
+// and returned to it once Read has consumed them, so that bulk
+// transfers do not allocate a new buffer for every frame. Smaller
+// payloads are allocated to size to avoid pinning a large buffer for
+// a few bytes of data.
+const recvPoolMin = frame.MaxPayload / 2
+
+var recvPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, frame.MaxPayload)
+		return &b
+	},
+}
+
+// getRecvBuf returns a buffer for a payload of n bytes. The second
+// return value must be passed to putRecvBuf once the data is consumed.
+func getRecvBuf(n uint32) ([]byte, *[]byte) {
+	if n < recvPoolMin || n > frame.MaxPayload {
+		return make([]byte, n), nil
+	}
+	p := recvPool.Get().(*[]byte)
+	return (*p)[:n], p
+}
+
+func putRecvBuf(p *[]byte) {
+	if p != nil {
+		recvPool.Put(p)
+	}
+}
+
+// recvChunk is the unread part of a received frame payload
+type recvChunk struct {
+	b    []byte
+	pool *[]byte // backing buffer from recvPool, if any
+}
+
+// recvQueue holds the payloads of received data frames in order
+type recvQueue struct {
+	chunks []recvChunk
+	size   int // total number of bytes queued
+	empty  int // number of empty messages queued
+}
+
+func (q *recvQueue) push(b []byte, pool *[]byte) {
+	q.chunks = append(q.chunks, recvChunk{b: b, pool: pool})
+	q.size += len(b)
+	if len(b) == 0 {
+		q.empty++
+	}
+}
+
+// read copies as many bytes as fit into b, crossing frame boundaries
+func (q *recvQueue) read(b []byte) int {
+	n := 0
+	for n < len(b) && len(q.chunks) > 0 {
+		if len(q.chunks[0].b) == 0 {
+			q.empty--
+		}
+		c := copy(b[n:], q.chunks[0].b)
+		n += c
+		q.chunks[0].b = q.chunks[0].b[c:]
+		if len(q.chunks[0].b) == 0 {
+			putRecvBuf(q.chunks[0].pool)
+			q.chunks[0] = recvChunk{}
+			q.chunks = q.chunks[1:]
+		}
+	}
+	q.size -= n
+	return n
+}
+
+// pop removes and returns the next frame payload. The caller owns the
+// returned slice, so its buffer is not returned to the pool.
+func (q *recvQueue) pop() []byte {
+	b := q.chunks[0].b
+	q.chunks[0] = recvChunk{}
+	q.chunks = q.chunks[1:]
+	q.size -= len(b)
+	if len(b) == 0 {
+		q.empty--
+	}
+	return b
+}
+
+func (q *recvQueue) reset() {
+	for _, c := range q.chunks {
+		putRecvBuf(c.pool)
+	}
+	q.chunks = nil
+	q.size = 0
+	q.empty = 0
+}
@@ -0,0 +1,82 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// AuditRecord describes a connection accepted by an audited listener.
+// The remote address identifies the peer, e.g. the VM ID of a hvsock
+// connection or the CID of a vsock connection.
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	Network  string    `json:"network"`
+	Local    string    `json:"local"`
+	Remote   string    `json:"remote"`
+	Accepted bool      `json:"accepted"`
+	// Reason is the error returned by the access check for rejected
+	// connections
+	Reason string `json:"reason,omitempty"`
+}
+
+// AuditConfig configures an audited listener
+type AuditConfig struct {
+	// Allow, if set, decides whether a connection is accepted. A
+	// connection for which it returns an error is closed and not
+	// returned by Accept(). By default all connections are accepted.
+	Allow func(c net.Conn) error
+	// Audit is called with a record for every connection accepted or
+	// rejected. It is called synchronously from Accept() and should
+	// not block.
+	Audit func(AuditRecord)
+}
+
+type auditListener struct {
+	net.Listener
+	config AuditConfig
+}
+
+// AuditListener returns a listener which checks every connection
+// accepted from l with config.Allow and reports the decision to
+// config.Audit, for services which have to keep a record of their
+// peers.
+func AuditListener(l net.Listener, config AuditConfig) net.Listener {
+	return &auditListener{Listener: l, config: config}
+}
+
+func (al *auditListener) Accept() (net.Conn, error) {
+	for {
+		c, err := al.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		var aerr error
+		if al.config.Allow != nil {
+			aerr = al.config.Allow(c)
+		}
+		if al.config.Audit != nil {
+			al.config.Audit(newAuditRecord(c, aerr))
+		}
+		if aerr == nil {
+			return c, nil
+		}
+		c.Close()
+	}
+}
+
+func newAuditRecord(c net.Conn, err error) AuditRecord {
+	r := AuditRecord{
+		Time:     time.Now(),
+		Local:    fmt.Sprint(c.LocalAddr()),
+		Remote:   fmt.Sprint(c.RemoteAddr()),
+		Accepted: err == nil,
+	}
+	if a := c.RemoteAddr(); a != nil {
+		r.Network = a.Network()
+	}
+	if err != nil {
+		r.Reason = err.Error()
+	}
+	return r
+}
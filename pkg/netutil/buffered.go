@@ -0,0 +1,83 @@
+package netutil
+
+import (
+	"bufio"
+	"net"
+	"sync"
+)
+
+// DefaultBufferSize is the write buffer size used by NewBufferedConn()
+// if 0 is passed
+const DefaultBufferSize = 16 * 1024
+
+// BufferedConn wraps a connection and buffers writes, so that many
+// small writes, as issued by chatty RPC protocols, result in fewer
+// syscalls or, for mux streams, fewer frames. Buffered data is sent
+// once the buffer is full or when Flush() is called. Reads are not
+// buffered. A BufferedConn is safe for concurrent use.
+type BufferedConn struct {
+	net.Conn
+
+	lock sync.Mutex
+	w    *bufio.Writer
+}
+
+// NewBufferedConn returns a connection which buffers up to size bytes
+// of writes to c
+func NewBufferedConn(c net.Conn, size int) *BufferedConn {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	return &BufferedConn{
+		Conn: c,
+		w:    bufio.NewWriterSize(c, size),
+	}
+}
+
+// Write buffers p, writing the buffer to the connection as it fills
+// up. An error writing to the connection is returned by all further
+// writes and Flush().
+func (b *BufferedConn) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.w.Write(p)
+}
+
+// Flush writes all buffered data to the connection
+func (b *BufferedConn) Flush() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.w.Flush()
+}
+
+// Buffered returns the number of bytes written but not yet flushed
+func (b *BufferedConn) Buffered() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.w.Buffered()
+}
+
+// CloseRead shuts down the reading side of the connection, if the
+// underlying connection supports half-close
+func (b *BufferedConn) CloseRead() error {
+	return CloseRead(b.Conn)
+}
+
+// CloseWrite flushes buffered data and shuts down the writing side of
+// the connection, if the underlying connection supports half-close
+func (b *BufferedConn) CloseWrite() error {
+	if err := b.Flush(); err != nil {
+		return err
+	}
+	return CloseWrite(b.Conn)
+}
+
+// Close flushes buffered data and closes the connection. The
+// connection is closed even if flushing fails.
+func (b *BufferedConn) Close() error {
+	ferr := b.Flush()
+	if err := b.Conn.Close(); err != nil {
+		return err
+	}
+	return ferr
+}
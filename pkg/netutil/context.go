@@ -0,0 +1,73 @@
+package netutil
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// aLongTimeAgo is a deadline in the past, used to interrupt blocked I/O
+var aLongTimeAgo = time.Unix(1, 0)
+
+// ReadContext reads from c like c.Read(b), but returns early with
+// ctx.Err() if ctx is cancelled or its deadline expires. It works by
+// setting the read deadline of c, so it works with any connection
+// supporting deadlines, including hvsock, vsock and mux connections.
+// The read deadline is cleared when ReadContext returns, and must not
+// be changed concurrently.
+func ReadContext(ctx context.Context, c net.Conn, b []byte) (int, error) {
+	return withContext(ctx, c.SetReadDeadline, func() (int, error) {
+		return c.Read(b)
+	})
+}
+
+// WriteContext writes to c like c.Write(b), but returns early with
+// ctx.Err() if ctx is cancelled or its deadline expires. Data may have
+// been partially written in that case, as reported by the byte count.
+// The write deadline is cleared when WriteContext returns, and must
+// not be changed concurrently.
+func WriteContext(ctx context.Context, c net.Conn, b []byte) (int, error) {
+	return withContext(ctx, c.SetWriteDeadline, func() (int, error) {
+		return c.Write(b)
+	})
+}
+
+// withContext runs op while mapping the cancellation of ctx onto the
+// deadline controlled by setDeadline
+func withContext(ctx context.Context, setDeadline func(time.Time) error, op func() (int, error)) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if d, ok := ctx.Deadline(); ok {
+		if err := setDeadline(d); err != nil {
+			return 0, err
+		}
+	}
+
+	var done, exited chan struct{}
+	if ctx.Done() != nil {
+		done = make(chan struct{})
+		exited = make(chan struct{})
+		go func() {
+			defer close(exited)
+			select {
+			case <-ctx.Done():
+				setDeadline(aLongTimeAgo)
+			case <-done:
+			}
+		}()
+	}
+
+	n, err := op()
+
+	if done != nil {
+		close(done)
+		// Make sure the deadline is not set after we cleared it
+		<-exited
+	}
+	setDeadline(time.Time{})
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return n, err
+}
@@ -0,0 +1,76 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/linuxkit/virtsock/pkg/hvsock"
+	"github.com/linuxkit/virtsock/pkg/vsock"
+)
+
+// AcceptFilter decides from the address of a peer whether a
+// connection from it is accepted. It returns an error explaining why
+// the peer is refused, or nil.
+type AcceptFilter func(peer net.Addr) error
+
+// WithAcceptFilter returns a listener which calls filter with the
+// remote address of every connection accepted from l. Connections
+// refused by filter are closed straight away and not returned by
+// Accept(), so that no data, not even the handshake of a protocol
+// such as pkg/mux or TLS, is exchanged with the peer. It lets hosts
+// running several VMs restrict which of them may talk to a service.
+// Use AuditListener() to also keep a record of the decisions.
+func WithAcceptFilter(l net.Listener, filter AcceptFilter) net.Listener {
+	return AuditListener(l, AuditConfig{
+		Allow: func(c net.Conn) error { return filter(c.RemoteAddr()) },
+	})
+}
+
+// AllowCIDs returns a filter accepting vsock connections from the
+// given CIDs only. Peers of other address families are refused.
+func AllowCIDs(cids ...uint32) AcceptFilter {
+	allowed := make(map[uint32]bool)
+	for _, cid := range cids {
+		allowed[cid] = true
+	}
+	return func(peer net.Addr) error {
+		var cid uint32
+		switch a := peer.(type) {
+		case vsock.Addr:
+			cid = a.CID
+		case *vsock.Addr:
+			cid = a.CID
+		default:
+			return fmt.Errorf("peer %v is not a vsock peer", peer)
+		}
+		if !allowed[cid] {
+			return fmt.Errorf("CID %d is not allowed", cid)
+		}
+		return nil
+	}
+}
+
+// AllowVMIDs returns a filter accepting Hyper-V socket connections
+// from the given VMs only. Peers of other address families are
+// refused.
+func AllowVMIDs(vmids ...hvsock.GUID) AcceptFilter {
+	allowed := make(map[hvsock.GUID]bool)
+	for _, id := range vmids {
+		allowed[id] = true
+	}
+	return func(peer net.Addr) error {
+		var id hvsock.GUID
+		switch a := peer.(type) {
+		case hvsock.Addr:
+			id = a.VMID
+		case *hvsock.Addr:
+			id = a.VMID
+		default:
+			return fmt.Errorf("peer %v is not a hvsock peer", peer)
+		}
+		if !allowed[id] {
+			return fmt.Errorf("VM %s is not allowed", id.String())
+		}
+		return nil
+	}
+}
@@ -0,0 +1,27 @@
+package netutil
+
+import (
+	"fmt"
+	"net"
+)
+
+// CloseRead shuts down the reading side of c, if c supports half-close.
+// It is meant for wrappers of net.Conn which pass CloseRead() through.
+func CloseRead(c net.Conn) error {
+	cr, ok := c.(interface{ CloseRead() error })
+	if !ok {
+		return fmt.Errorf("%T does not support CloseRead", c)
+	}
+	return cr.CloseRead()
+}
+
+// CloseWrite shuts down the writing side of c, if c supports
+// half-close. It is meant for wrappers of net.Conn which pass
+// CloseWrite() through.
+func CloseWrite(c net.Conn) error {
+	cw, ok := c.(interface{ CloseWrite() error })
+	if !ok {
+		return fmt.Errorf("%T does not support CloseWrite", c)
+	}
+	return cw.CloseWrite()
+}
@@ -0,0 +1,126 @@
+package netutil
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// Hooks are callbacks invoked during the lifetime of connections, for
+// accounting, logging or cleanup without wrapping every accept loop.
+// Any of them may be nil. They are called synchronously and should
+// not block.
+type Hooks struct {
+	// OnConnect is called for every connection accepted or dialled
+	OnConnect func(c net.Conn)
+	// OnClose is called once the connection is closed, with the
+	// error returned by Close()
+	OnClose func(c net.Conn, err error)
+	// OnError is called when accepting or dialling fails, with a nil
+	// connection, and for errors other than io.EOF returned by Read or
+	// Write on a connection
+	OnError func(c net.Conn, err error)
+}
+
+func (h *Hooks) connect(c net.Conn) {
+	if h.OnConnect != nil {
+		h.OnConnect(c)
+	}
+}
+
+func (h *Hooks) close(c net.Conn, err error) {
+	if h.OnClose != nil {
+		h.OnClose(c, err)
+	}
+}
+
+func (h *Hooks) fail(c net.Conn, err error) {
+	if err != nil && err != io.EOF && h.OnError != nil {
+		h.OnError(c, err)
+	}
+}
+
+type hookListener struct {
+	net.Listener
+	hooks *Hooks
+}
+
+// HookListener returns a listener which calls hooks for every
+// connection accepted from l. Accepted connections are wrapped with
+// HookConn().
+func HookListener(l net.Listener, hooks *Hooks) net.Listener {
+	return &hookListener{Listener: l, hooks: hooks}
+}
+
+func (hl *hookListener) Accept() (net.Conn, error) {
+	c, err := hl.Listener.Accept()
+	if err != nil {
+		hl.hooks.fail(nil, err)
+		return nil, err
+	}
+	return HookConn(c, hl.hooks), nil
+}
+
+// HookDial calls dial and wraps the resulting connection with
+// HookConn(). A dial error is passed to hooks.OnError.
+func HookDial(hooks *Hooks, dial func() (net.Conn, error)) (net.Conn, error) {
+	c, err := dial()
+	if err != nil {
+		hooks.fail(nil, err)
+		return nil, err
+	}
+	return HookConn(c, hooks), nil
+}
+
+// HookedConn is a connection returned by HookConn()
+type HookedConn struct {
+	net.Conn
+
+	hooks     *Hooks
+	closeOnce sync.Once
+}
+
+// HookConn calls hooks.OnConnect for c and returns a connection which
+// calls the remaining hooks as c is used and closed. The returned
+// connection supports half-close if c does.
+func HookConn(c net.Conn, hooks *Hooks) *HookedConn {
+	hc := &HookedConn{Conn: c, hooks: hooks}
+	hooks.connect(hc)
+	return hc
+}
+
+// Read reads from the connection
+func (hc *HookedConn) Read(b []byte) (int, error) {
+	n, err := hc.Conn.Read(b)
+	hc.hooks.fail(hc, err)
+	return n, err
+}
+
+// Write writes to the connection
+func (hc *HookedConn) Write(b []byte) (int, error) {
+	n, err := hc.Conn.Write(b)
+	hc.hooks.fail(hc, err)
+	return n, err
+}
+
+// CloseRead shuts down the reading side of the connection, if the
+// underlying connection supports half-close
+func (hc *HookedConn) CloseRead() error {
+	return CloseRead(hc.Conn)
+}
+
+// CloseWrite shuts down the writing side of the connection, if the
+// underlying connection supports half-close
+func (hc *HookedConn) CloseWrite() error {
+	return CloseWrite(hc.Conn)
+}
+
+// Close closes the connection. OnClose is only called for the first
+// call.
+func (hc *HookedConn) Close() error {
+	err := hc.Conn.Close()
+	hc.closeOnce.Do(func() {
+		hc.hooks.close(hc, err)
+	})
+	return err
+}
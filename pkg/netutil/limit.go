@@ -0,0 +1,161 @@
+package netutil
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// LimitPolicy decides what a LimitedListener does with connections
+// beyond its limit
+type LimitPolicy int
+
+const (
+	// LimitDelay stops accepting connections while the limit is
+	// reached. Further connections wait in the listen backlog of the
+	// kernel until a connection is closed.
+	LimitDelay LimitPolicy = iota
+	// LimitReject accepts connections beyond the limit and closes
+	// them straight away, so that peers fail fast instead of waiting.
+	LimitReject
+)
+
+// LimitedListener counts the connections accepted which have not been
+// closed yet, and limits their number. It protects services from
+// connection storms, e.g. from a misbehaving guest.
+type LimitedListener struct {
+	net.Listener
+
+	max    int
+	policy LimitPolicy
+
+	// active and rejected are accessed atomically
+	active   int64
+	rejected uint64
+
+	sem       chan struct{} // holds a token per active connection
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+// LimitListener returns a listener accepting at most max concurrent
+// connections from l. If max is 0 or negative, the number of
+// connections is only counted.
+func LimitListener(l net.Listener, max int, policy LimitPolicy) *LimitedListener {
+	ll := &LimitedListener{
+		Listener: l,
+		max:      max,
+		policy:   policy,
+		closeCh:  make(chan struct{}),
+	}
+	if max > 0 {
+		ll.sem = make(chan struct{}, max)
+	}
+	return ll
+}
+
+// Active returns the number of connections accepted which have not
+// been closed yet
+func (ll *LimitedListener) Active() int {
+	return int(atomic.LoadInt64(&ll.active))
+}
+
+// Rejected returns the number of connections closed with LimitReject
+// because the limit was reached
+func (ll *LimitedListener) Rejected() uint64 {
+	return atomic.LoadUint64(&ll.rejected)
+}
+
+// acquire takes a token for a new connection. If wait is not set it
+// returns false instead of waiting when the limit is reached.
+func (ll *LimitedListener) acquire(wait bool) bool {
+	if ll.sem == nil {
+		return true
+	}
+	if !wait {
+		select {
+		case ll.sem <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+	select {
+	case ll.sem <- struct{}{}:
+		return true
+	case <-ll.closeCh:
+		return false
+	}
+}
+
+func (ll *LimitedListener) release() {
+	if ll.sem != nil {
+		<-ll.sem
+	}
+	atomic.AddInt64(&ll.active, -1)
+}
+
+// Accept waits for and returns the next connection. With LimitDelay it
+// blocks while the limit is reached.
+func (ll *LimitedListener) Accept() (net.Conn, error) {
+	if ll.policy == LimitDelay {
+		if !ll.acquire(true) {
+			return nil, ErrListenerClosed
+		}
+		c, err := ll.Listener.Accept()
+		if err != nil {
+			if ll.sem != nil {
+				<-ll.sem
+			}
+			return nil, err
+		}
+		return ll.newConn(c), nil
+	}
+
+	for {
+		c, err := ll.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if ll.acquire(false) {
+			return ll.newConn(c), nil
+		}
+		atomic.AddUint64(&ll.rejected, 1)
+		c.Close()
+	}
+}
+
+// Close closes the listener and unblocks a pending Accept. Connections
+// already accepted are not affected.
+func (ll *LimitedListener) Close() error {
+	ll.closeOnce.Do(func() {
+		close(ll.closeCh)
+	})
+	return ll.Listener.Close()
+}
+
+func (ll *LimitedListener) newConn(c net.Conn) net.Conn {
+	atomic.AddInt64(&ll.active, 1)
+	return &limitedConn{Conn: c, ll: ll}
+}
+
+// limitedConn releases its slot in the listener when closed
+type limitedConn struct {
+	net.Conn
+	ll          *LimitedListener
+	releaseOnce sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.ll.release)
+	return err
+}
+
+func (c *limitedConn) CloseRead() error {
+	return CloseRead(c.Conn)
+}
+
+func (c *limitedConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
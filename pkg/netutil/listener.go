@@ -0,0 +1,118 @@
+// Package netutil provides helpers for connections and listeners
+// which work with the hvsock and vsock packages as well as the net
+// package.
+package netutil
+
+import (
+	"net"
+	"sync"
+)
+
+// ErrListenerClosed is returned by Accept() on a closed listener
+var ErrListenerClosed = net.ErrClosed
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+type parallelListener struct {
+	net.Listener
+
+	acceptCh  chan acceptResult
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	doneCh    chan struct{} // closed once all workers exited
+}
+
+// ParallelListener returns a listener which accepts connections from l
+// in n goroutines, so that a storm of incoming connections, e.g. all
+// guests reconnecting after the host resumed, is absorbed faster.
+// Accepted connections are queued until they are returned by Accept().
+// Errors from l are passed on to Accept(). Other than temporary
+// errors they also stop the worker which got them. Closing the
+// returned listener closes l.
+func ParallelListener(l net.Listener, n int) net.Listener {
+	if n < 1 {
+		n = 1
+	}
+	pl := &parallelListener{
+		Listener: l,
+		acceptCh: make(chan acceptResult, n),
+		closeCh:  make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+	pl.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go pl.worker()
+	}
+	go func() {
+		pl.wg.Wait()
+		close(pl.doneCh)
+	}()
+	return pl
+}
+
+func (pl *parallelListener) worker() {
+	defer pl.wg.Done()
+	for {
+		conn, err := pl.Listener.Accept()
+		select {
+		case pl.acceptCh <- acceptResult{conn, err}:
+		case <-pl.closeCh:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil && !isTemporary(err) {
+			return
+		}
+	}
+}
+
+// Accept returns the next connection accepted by one of the workers
+func (pl *parallelListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-pl.acceptCh:
+		return r.conn, r.err
+	case <-pl.closeCh:
+		return nil, ErrListenerClosed
+	case <-pl.doneCh:
+	}
+	// All workers have stopped, but may have queued connections
+	select {
+	case r := <-pl.acceptCh:
+		return r.conn, r.err
+	default:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close closes the underlying listener and any connections which were
+// accepted but not yet returned by Accept()
+func (pl *parallelListener) Close() error {
+	err := ErrListenerClosed
+	pl.closeOnce.Do(func() {
+		close(pl.closeCh)
+		err = pl.Listener.Close()
+		<-pl.doneCh
+		for {
+			select {
+			case r := <-pl.acceptCh:
+				if r.conn != nil {
+					r.conn.Close()
+				}
+			default:
+				return
+			}
+		}
+	})
+	return err
+}
+
+func isTemporary(err error) bool {
+	t, ok := err.(interface{ Temporary() bool })
+	return ok && t.Temporary()
+}
@@ -0,0 +1,315 @@
+// Package pool maintains a set of warm connections to a service,
+// typically one running in a VM. Connecting to a busy guest can take
+// long enough to dominate the cost of a short request, so RPC-heavy
+// hosts should reuse connections rather than dial for every request.
+//
+// A pool dials connections in the background until Size idle
+// connections are available. Get() hands out an idle connection, or
+// dials a new one if none is available. Once done, the caller returns
+// a healthy connection with Put() or closes it if it is broken:
+//
+//	p, err := pool.New(func(ctx context.Context) (net.Conn, error) {
+//		return hvsock.Dial(hvsock.Addr{VMID: vmid, ServiceID: svcid})
+//	}, nil)
+//	...
+//	c, err := p.Get(ctx)
+//	...
+//	p.Put(c)
+package pool
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrClosed is returned when using a pool which has been closed
+	ErrClosed = errors.New("pool closed")
+)
+
+// DialFunc establishes a new connection to the service
+type DialFunc func(ctx context.Context) (net.Conn, error)
+
+// Config is used to tune a pool.
+type Config struct {
+	// Size is the number of idle connections kept ready. Connections
+	// returned with Put() while Size connections are idle are closed.
+	Size int
+
+	// DialTimeout limits how long a background dial may take.
+	DialTimeout time.Duration
+
+	// CheckInterval is how often idle connections are health checked.
+	// Broken connections are closed and replaced.
+	CheckInterval time.Duration
+
+	// RetryInterval is how long to wait before dialling again after a
+	// failed background dial. It doubles with every consecutive
+	// failure, up to CheckInterval.
+	RetryInterval time.Duration
+
+	// HealthCheck, if set, is called for an idle connection before it
+	// is handed out and periodically while it is idle. A connection
+	// for which it returns an error is closed. The default check
+	// fails if the peer has closed the connection or sent unexpected
+	// data, see IsAlive().
+	HealthCheck func(net.Conn) error
+}
+
+// DefaultConfig returns the configuration used when nil is passed to
+// New().
+func DefaultConfig() *Config {
+	return &Config{
+		Size:          4,
+		DialTimeout:   10 * time.Second,
+		CheckInterval: 30 * time.Second,
+		RetryInterval: 100 * time.Millisecond,
+	}
+}
+
+func verifyConfig(c *Config) error {
+	if c.Size <= 0 {
+		return fmt.Errorf("Size must be positive")
+	}
+	if c.DialTimeout <= 0 {
+		return fmt.Errorf("DialTimeout must be positive")
+	}
+	if c.CheckInterval <= 0 {
+		return fmt.Errorf("CheckInterval must be positive")
+	}
+	if c.RetryInterval <= 0 || c.RetryInterval > c.CheckInterval {
+		return fmt.Errorf("RetryInterval must be positive and at most CheckInterval")
+	}
+	return nil
+}
+
+// Pool is a set of warm connections. It is safe for concurrent use.
+type Pool struct {
+	dial   DialFunc
+	config *Config
+
+	lock   sync.Mutex
+	idle   []net.Conn // most recently returned last
+	closed bool
+
+	wake   chan struct{} // nudges the maintainer to refill
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// New creates a pool which establishes connections with dial. If
+// config is nil, DefaultConfig() is used. Connections are dialled in
+// the background, so New() does not fail if the service is not
+// reachable yet.
+func New(dial DialFunc, config *Config) (*Pool, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if err := verifyConfig(config); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pool{
+		dial:   dial,
+		config: config,
+		wake:   make(chan struct{}, 1),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go p.maintain()
+	return p, nil
+}
+
+// Get returns a healthy idle connection, or dials a new one if none is
+// available. ctx only limits the dial.
+func (p *Pool) Get(ctx context.Context) (net.Conn, error) {
+	for {
+		p.lock.Lock()
+		if p.closed {
+			p.lock.Unlock()
+			return nil, ErrClosed
+		}
+		n := len(p.idle)
+		if n == 0 {
+			p.lock.Unlock()
+			break
+		}
+		c := p.idle[n-1]
+		p.idle[n-1] = nil
+		p.idle = p.idle[:n-1]
+		p.lock.Unlock()
+
+		p.refill()
+		if err := p.check(c); err != nil {
+			c.Close()
+			continue
+		}
+		return c, nil
+	}
+
+	p.refill()
+	c, err := p.dial(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "dial failed")
+	}
+	return c, nil
+}
+
+// Put returns a connection obtained with Get() to the pool. Only
+// healthy connections with no outstanding data should be returned,
+// broken ones must be closed by the caller instead. If the pool is
+// full or closed, c is closed.
+func (p *Pool) Put(c net.Conn) {
+	p.lock.Lock()
+	if p.closed || len(p.idle) >= p.config.Size {
+		p.lock.Unlock()
+		c.Close()
+		return
+	}
+	p.idle = append(p.idle, c)
+	p.lock.Unlock()
+}
+
+// Len returns the number of idle connections
+func (p *Pool) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.idle)
+}
+
+// Close closes all idle connections and stops dialling new ones.
+// Connections currently handed out are not affected, they are closed
+// when they are returned.
+func (p *Pool) Close() error {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return ErrClosed
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.lock.Unlock()
+
+	p.cancel()
+	<-p.done
+	for _, c := range idle {
+		c.Close()
+	}
+	return nil
+}
+
+// refill nudges the maintainer to top up the idle connections
+func (p *Pool) refill() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Pool) check(c net.Conn) error {
+	if p.config.HealthCheck != nil {
+		return p.config.HealthCheck(c)
+	}
+	return IsAlive(c)
+}
+
+// maintain keeps the pool topped up and health checks idle
+// connections until the pool is closed.
+func (p *Pool) maintain() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.config.CheckInterval)
+	defer ticker.Stop()
+
+	retry := p.config.RetryInterval
+	for {
+		if p.fill() {
+			retry = p.config.RetryInterval
+		} else {
+			// Back off, but still serve refill requests once the
+			// retry interval has passed.
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-time.After(retry):
+			}
+			retry *= 2
+			if retry > p.config.CheckInterval {
+				retry = p.config.CheckInterval
+			}
+			continue
+		}
+
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-p.wake:
+		case <-ticker.C:
+			p.checkIdle()
+		}
+	}
+}
+
+// fill dials until Size connections are idle. It returns false if a
+// dial failed.
+func (p *Pool) fill() bool {
+	for {
+		p.lock.Lock()
+		if p.closed || len(p.idle) >= p.config.Size {
+			p.lock.Unlock()
+			return true
+		}
+		p.lock.Unlock()
+
+		ctx, cancel := context.WithTimeout(p.ctx, p.config.DialTimeout)
+		c, err := p.dial(ctx)
+		cancel()
+		if err != nil {
+			return false
+		}
+		p.Put(c)
+	}
+}
+
+// checkIdle health checks all idle connections and closes broken ones
+func (p *Pool) checkIdle() {
+	p.lock.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.lock.Unlock()
+
+	for _, c := range idle {
+		if err := p.check(c); err != nil {
+			c.Close()
+			continue
+		}
+		p.Put(c)
+	}
+}
+
+// IsAlive checks whether an idle connection is still usable. It
+// briefly tries to read from c: a timeout means the connection is
+// alive, while EOF, an error or unexpected data means it is not. If c
+// does not support deadlines it is assumed to be alive.
+func IsAlive(c net.Conn) error {
+	if err := c.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return nil
+	}
+	var b [1]byte
+	n, err := c.Read(b[:])
+	if terr, ok := err.(interface{ Timeout() bool }); ok && terr.Timeout() {
+		return c.SetReadDeadline(time.Time{})
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("unexpected %d bytes on idle connection", n)
+}
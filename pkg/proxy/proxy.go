@@ -0,0 +1,111 @@
+// Package proxy copies data in both directions between two
+// connections, which is the core of every forwarder between TCP or
+// unix domain sockets and Hyper-V or virtio sockets.
+//
+// Data is moved with io.Copy, so connections implementing
+// io.ReaderFrom or io.WriterTo are used efficiently. For example,
+// copying between a Linux vsock connection and a TCP or unix socket
+// uses splice(2).
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Conn is a net.Conn which supports half-close. The hvsock and vsock
+// connections as well as *net.TCPConn and *net.UnixConn implement it.
+type Conn interface {
+	net.Conn
+	CloseRead() error
+	CloseWrite() error
+}
+
+// Stats holds the number of bytes copied in each direction
+type Stats struct {
+	AToB int64
+	BToA int64
+}
+
+// Copy copies data between a and b in both directions until both
+// directions are finished. When one direction reaches EOF, the write
+// side of the destination and the read side of the source are closed,
+// so the peer of the destination sees the half-close. Copy does not
+// close a or b. It returns the number of bytes copied and the first
+// copy error encountered, if any.
+func Copy(a, b Conn) (Stats, error) {
+	var stats Stats
+	var errAToB, errBToA error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		stats.BToA, errBToA = copyHalf(a, b)
+	}()
+	stats.AToB, errAToB = copyHalf(b, a)
+	wg.Wait()
+
+	if errAToB != nil {
+		return stats, errors.Wrap(errAToB, "copy from a to b")
+	}
+	if errBToA != nil {
+		return stats, errors.Wrap(errBToA, "copy from b to a")
+	}
+	return stats, nil
+}
+
+// Proxy is like Copy, but closes both connections when done. If ctx
+// is cancelled before then, both connections are closed to abort the
+// copy and ctx.Err() is returned.
+func Proxy(ctx context.Context, a, b Conn) (Stats, error) {
+	var closeOnce sync.Once
+	var errA, errB error
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			errA = a.Close()
+			errB = b.Close()
+		})
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	cancelled := false
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			cancelled = true
+			closeBoth()
+		case <-done:
+		}
+	}()
+
+	stats, err := Copy(a, b)
+	close(done)
+	<-stopped
+	if cancelled {
+		return stats, ctx.Err()
+	}
+
+	closeBoth()
+	if err == nil && errA != nil {
+		err = errors.Wrap(errA, "close a")
+	}
+	if err == nil && errB != nil {
+		err = errors.Wrap(errB, "close b")
+	}
+	return stats, err
+}
+
+// copyHalf copies from src to dst until EOF and passes the half-close on
+func copyHalf(dst, src Conn) (int64, error) {
+	n, err := io.Copy(dst, src)
+	// Errors are ignored as the peers may have closed their end already
+	dst.CloseWrite()
+	src.CloseRead()
+	return n, err
+}
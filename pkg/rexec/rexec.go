@@ -0,0 +1,265 @@
+// Package rexec runs commands in a VM over a hvsock or vsock
+// connection, streaming their output back to the host and returning
+// their exit status, for provisioning and debugging. The guest runs a
+// server:
+//
+//	l, err := vsock.Listen(vsock.CIDAny, 5556)
+//	...
+//	go (&rexec.Server{Allow: rexec.AllowHost}).Serve(l)
+//
+// and the host runs commands with:
+//
+//	c, err := vsock.Dial(3, 5556)
+//	...
+//	code, err := rexec.Run(c, &rexec.Request{Args: []string{"uname", "-a"}},
+//		nil, os.Stdout, os.Stderr)
+//
+// The host sends the request, a 32 bit big endian length followed by
+// the JSON encoded Request, and the guest replies in the same way with
+// whether the command can be run. The standard streams and the exit
+// status are then exchanged with pkg/execstream.
+//
+// A server refuses all requests unless it is given an Allow policy, as
+// anyone who can connect to it can run commands as its user.
+package rexec
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/linuxkit/virtsock/pkg/execstream"
+	"github.com/linuxkit/virtsock/pkg/hvsock"
+	"github.com/linuxkit/virtsock/pkg/netutil"
+	"github.com/linuxkit/virtsock/pkg/vsock"
+)
+
+const maxMessage = 1 << 20
+
+// Request describes the command to run
+type Request struct {
+	// Args holds the command and its arguments. The command is
+	// looked up in the PATH of the server if it contains no path
+	// separator.
+	Args []string `json:"args"`
+	// Env holds additional environment variables, "KEY=value"
+	Env []string `json:"env,omitempty"`
+	// Dir is the working directory, the server's if empty
+	Dir string `json:"dir,omitempty"`
+}
+
+type reply struct {
+	Error string `json:"error,omitempty"`
+}
+
+// Start sends req to the server at the other end of conn and returns
+// the running process. The caller must read Stdout and Stderr until
+// EOF and then call Wait(), which closes conn. conn is also closed if
+// Start fails.
+func Start(conn net.Conn, req *Request) (*execstream.Process, error) {
+	if err := writeMsg(conn, req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var r reply
+	if err := readMsg(conn, &r); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if r.Error != "" {
+		conn.Close()
+		return nil, errors.New(r.Error)
+	}
+	return execstream.Start(conn)
+}
+
+// Run runs req on the server at the other end of conn, copies stdin to
+// the standard input of the command and its output to stdout and
+// stderr, and returns its exit status. Nil readers and writers are
+// treated as empty and discarding. conn is closed when Run returns.
+func Run(conn net.Conn, req *Request, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	p, err := Start(conn, req)
+	if err != nil {
+		return 0, err
+	}
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	if stdin != nil {
+		go func() {
+			io.Copy(p.Stdin, stdin)
+			p.Stdin.Close()
+		}()
+	} else {
+		p.Stdin.Close()
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		io.Copy(stdout, p.Stdout)
+		wg.Done()
+	}()
+	go func() {
+		io.Copy(stderr, p.Stderr)
+		wg.Done()
+	}()
+	wg.Wait()
+	return p.Wait()
+}
+
+// Server runs the commands requested by clients
+type Server struct {
+	// Allow is called with every request and the request is refused
+	// if it returns an error. All requests are refused if it is nil.
+	// See AllowHost() and AllowAny().
+	Allow func(conn net.Conn, req *Request) error
+	// Env holds environment variables added to those of the server
+	// for every command
+	Env []string
+}
+
+// AllowHost is an Allow policy which runs every command requested by
+// the host, i.e. over vsock from CIDHost or over a Hyper-V socket from
+// the parent partition, and refuses other peers.
+func AllowHost(conn net.Conn, req *Request) error {
+	peer := conn.RemoteAddr()
+	if netutil.AllowCIDs(vsock.CIDHost)(peer) == nil || netutil.AllowVMIDs(hvsock.GUIDParent)(peer) == nil {
+		return nil
+	}
+	return fmt.Errorf("rexec: %v is not the host", peer)
+}
+
+// AllowAny is an Allow policy which runs every command requested. Only
+// use it on listeners which accept trusted peers only, e.g. with
+// netutil.WithAcceptFilter().
+func AllowAny(conn net.Conn, req *Request) error {
+	return nil
+}
+
+// Serve accepts connections from l and runs the command requested on
+// each until Accept() fails, e.g. because l was closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(c)
+	}
+}
+
+// ServeConn runs the command requested on conn and returns once it has
+// exited and its exit status was sent. conn is closed.
+func (s *Server) ServeConn(conn net.Conn) error {
+	var req Request
+	if err := readMsg(conn, &req); err != nil {
+		conn.Close()
+		return err
+	}
+	cmd, err := s.command(conn, &req)
+	if err != nil {
+		writeMsg(conn, reply{Error: err.Error()})
+		conn.Close()
+		return err
+	}
+	if err := writeMsg(conn, reply{}); err != nil {
+		conn.Close()
+		return err
+	}
+	a, err := execstream.Attach(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	return run(cmd, a)
+}
+
+// command prepares the command for req
+func (s *Server) command(conn net.Conn, req *Request) (*exec.Cmd, error) {
+	if len(req.Args) == 0 {
+		return nil, errors.New("rexec: no command given")
+	}
+	if s.Allow == nil {
+		return nil, errors.New("rexec: the server has no Allow policy")
+	}
+	if err := s.Allow(conn, req); err != nil {
+		return nil, err
+	}
+	path, err := exec.LookPath(req.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(path, req.Args[1:]...)
+	cmd.Args[0] = req.Args[0]
+	cmd.Dir = req.Dir
+	cmd.Env = append(append(os.Environ(), s.Env...), req.Env...)
+	return cmd, nil
+}
+
+// run runs cmd connected to a and reports its exit status
+func run(cmd *exec.Cmd, a *execstream.Attached) error {
+	cmd.Stdout, cmd.Stderr = a.Stdout, a.Stderr
+	// Feed stdin ourselves, as exec.Cmd.Wait() would wait for the
+	// host to close it even after the command exited
+	stdin, err := cmd.StdinPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		fmt.Fprintf(a.Stderr, "rexec: %v\n", err)
+		a.Exit(127)
+		return err
+	}
+	go func() {
+		io.Copy(stdin, a.Stdin)
+		stdin.Close()
+	}()
+	err = cmd.Wait()
+	status := 0
+	if err != nil {
+		ee, ok := err.(*exec.ExitError)
+		if !ok {
+			a.Close()
+			return err
+		}
+		status = ee.ExitCode()
+	}
+	return a.Exit(status)
+}
+
+func writeMsg(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	msg := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(msg, uint32(len(b)))
+	_, err = w.Write(append(msg, b...))
+	return err
+}
+
+func readMsg(r io.Reader, v interface{}) error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > maxMessage {
+		return fmt.Errorf("rexec: message too large (%d bytes)", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
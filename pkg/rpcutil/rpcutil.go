@@ -0,0 +1,98 @@
+// Package rpcutil serves net/rpc, and gob streams in general, over
+// Hyper-V and virtio sockets, for host<->guest RPC without any
+// dependencies beyond the standard library:
+//
+//	l, err := vsock.Listen(vsock.CIDAny, 1024)
+//	...
+//	rpc.Register(&Agent{})
+//	go rpcutil.Serve(nil, l)
+//
+//	client, err := rpcutil.Dial(func() (net.Conn, error) {
+//		return vsock.Dial(3, 1024)
+//	})
+//
+// net/rpc and encoding/gob treat io.EOF as the clean end of a stream
+// and everything else as a failure. Peers of hvsock and vsock
+// connections often disappear by resetting the connection, e.g. when
+// the VM is stopped, so the connections are wrapped with Conn() to map
+// that to io.EOF.
+package rpcutil
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+
+	"github.com/linuxkit/virtsock/pkg/hvsock"
+	"github.com/linuxkit/virtsock/pkg/vsock"
+)
+
+// halfCloser is implemented by connections supporting half-close
+type halfCloser interface {
+	CloseWrite() error
+}
+
+type conn struct {
+	net.Conn
+}
+
+// Conn returns c as an io.ReadWriteCloser for net/rpc codecs and gob
+// streams. Reads return io.EOF rather than an error if the peer reset
+// the connection. Close shuts down the write side before closing c, if
+// supported, so that the peer reads everything written before seeing
+// the end of the stream.
+func Conn(c net.Conn) io.ReadWriteCloser {
+	return &conn{c}
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil && isReset(err) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (c *conn) Close() error {
+	if hc, ok := c.Conn.(halfCloser); ok {
+		// Errors are ignored as the peer may have gone already
+		hc.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+func isReset(err error) bool {
+	return errors.Is(err, hvsock.ErrConnReset) || errors.Is(err, vsock.ErrConnReset)
+}
+
+// Serve accepts connections from l and serves srv on each of them
+// until Accept() fails, e.g. because l was closed. If srv is nil,
+// rpc.DefaultServer is used.
+func Serve(srv *rpc.Server, l net.Listener) error {
+	if srv == nil {
+		srv = rpc.DefaultServer
+	}
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.ServeConn(Conn(c))
+	}
+}
+
+// NewClient returns a net/rpc client using c
+func NewClient(c net.Conn) *rpc.Client {
+	return rpc.NewClient(Conn(c))
+}
+
+// Dial connects with dial and returns a net/rpc client for the new
+// connection
+func Dial(dial func() (net.Conn, error)) (*rpc.Client, error) {
+	c, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(c), nil
+}
@@ -0,0 +1,147 @@
+package vmtls
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"time"
+)
+
+// CA issues the certificates of hosts and VMs
+type CA struct {
+	Certificate *x509.Certificate
+	Key         crypto.Signer
+}
+
+// NewCA creates a self-signed certificate authority named name
+func NewCA(name string, validity time.Duration) (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template(validity)
+	if err != nil {
+		return nil, err
+	}
+	tmpl.Subject = pkix.Name{CommonName: name}
+	tmpl.IsCA = true
+	tmpl.BasicConstraintsValid = true
+	tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Certificate: cert, Key: key}, nil
+}
+
+// LoadCA loads a CA saved with Save()
+func LoadCA(certFile, keyFile string) (*CA, error) {
+	kp, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(kp.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", certFile)
+	}
+	key, ok := kp.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type", keyFile)
+	}
+	return &CA{Certificate: cert, Key: key}, nil
+}
+
+// Save writes the certificate and key of the CA to PEM files. The key
+// file is only readable by the owner.
+func (ca *CA) Save(certFile, keyFile string) error {
+	return saveKeyPair(ca.Certificate.Raw, ca.Key, certFile, keyFile)
+}
+
+// Pool returns a pool containing the CA, to verify peers with
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate)
+	return pool
+}
+
+// Issue issues a certificate for id. It can be used by clients as well
+// as servers.
+func (ca *CA) Issue(id Identity, validity time.Duration) (tls.Certificate, error) {
+	u, err := url.Parse(string(id))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("invalid identity %q: %v", id, err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl, err := template(validity)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl.Subject = pkix.Name{CommonName: string(id)}
+	tmpl.URIs = []*url.URL{u}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Certificate, key.Public(), ca.Key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// SaveCertificate writes a certificate issued by Issue() and its key to
+// PEM files. Load it with tls.LoadX509KeyPair().
+func SaveCertificate(cert tls.Certificate, certFile, keyFile string) error {
+	key, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("unsupported key type %T", cert.PrivateKey)
+	}
+	return saveKeyPair(cert.Certificate[0], key, certFile, keyFile)
+}
+
+func saveKeyPair(der []byte, key crypto.Signer, certFile, keyFile string) error {
+	kder, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: kder}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// template returns a certificate template valid from now for validity
+func template(validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		// Allow for clocks of VMs lagging behind
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(validity),
+	}, nil
+}
@@ -0,0 +1,222 @@
+// Package vmtls provides mutually authenticated TLS channels between
+// hosts and VMs. Every host and VM gets a certificate from a common CA
+// which names its socket address as a URI, its Identity, e.g.
+// "vsock://3" for the VM with CID 3 or "hvsock://<VMID>" for a
+// Hyper-V VM. The identity presented by a peer must match the address
+// the connection comes from, which the hypervisor vouches for, so a VM
+// can't use the certificate of another VM:
+//
+//	ca, err := vmtls.NewCA("my cluster", 10*365*24*time.Hour)
+//	guestCert, err := ca.Issue(vmtls.VsockIdentity(3), 365*24*time.Hour)
+//	hostCert, err := ca.Issue(vmtls.VsockIdentity(vsock.CIDHost), 365*24*time.Hour)
+//	...
+//	// guest
+//	l, err := vsock.Listen(vsock.CIDAny, 1024)
+//	l = vmtls.NewListener(l, &vmtls.Config{Certificate: guestCert, Roots: ca.Pool()})
+//
+//	// host
+//	c, err := vsock.Dial(3, 1024)
+//	tc, err := vmtls.Client(c, &vmtls.Config{Certificate: hostCert, Roots: ca.Pool()})
+//
+// Servers learn who they talk to from Conn.PeerIdentity().
+package vmtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/linuxkit/virtsock/pkg/hvsock"
+	"github.com/linuxkit/virtsock/pkg/vsock"
+)
+
+// Identity names a host or VM by its socket address, as a URI:
+// "vsock://<CID>" or "hvsock://<VMID>"
+type Identity string
+
+// VsockIdentity returns the identity of the VM, or host, with cid
+func VsockIdentity(cid uint32) Identity {
+	return Identity(fmt.Sprintf("vsock://%d", cid))
+}
+
+// HvsockIdentity returns the identity of the Hyper-V partition vmid.
+// The host is hvsock.GUIDParent when seen from a VM.
+func HvsockIdentity(vmid hvsock.GUID) Identity {
+	return Identity("hvsock://" + vmid.String())
+}
+
+// IdentityOf returns the identity of the peer of a vsock or hvsock
+// connection with remote address addr
+func IdentityOf(addr net.Addr) (Identity, error) {
+	switch a := addr.(type) {
+	case vsock.Addr:
+		return VsockIdentity(a.CID), nil
+	case *vsock.Addr:
+		return VsockIdentity(a.CID), nil
+	case hvsock.Addr:
+		return HvsockIdentity(a.VMID), nil
+	case *hvsock.Addr:
+		return HvsockIdentity(a.VMID), nil
+	}
+	return "", fmt.Errorf("no identity for %s address %v", addr.Network(), addr)
+}
+
+// ErrIdentityMismatch is wrapped in the handshake error if the peer
+// presents a valid certificate for another identity than expected
+var ErrIdentityMismatch = errors.New("peer identity does not match its address")
+
+// Config configures a channel
+type Config struct {
+	// Certificate is presented to the peer
+	Certificate tls.Certificate
+	// Roots holds the CA certificates peer certificates must be
+	// issued by
+	Roots *x509.CertPool
+	// PeerIdentity returns the identity the peer with the remote
+	// address addr must present. It defaults to IdentityOf(), and
+	// can be set to pin other identities, e.g. for connections
+	// forwarded over TCP.
+	PeerIdentity func(addr net.Addr) (Identity, error)
+	// TLS, if set, is used as the base of the TLS configuration, e.g.
+	// to restrict versions or cipher suites. Certificates and
+	// verification settings are overridden.
+	TLS *tls.Config
+}
+
+// Conn is a TLS connection whose peer presented a certificate for the
+// identity expected
+type Conn struct {
+	*tls.Conn
+	expected Identity
+}
+
+// PeerIdentity returns the verified identity of the peer. It runs the
+// handshake if it has not run yet.
+func (c *Conn) PeerIdentity() (Identity, error) {
+	if err := c.Handshake(); err != nil {
+		return "", err
+	}
+	return c.expected, nil
+}
+
+// Client runs the handshake as a client over c and returns the
+// verified connection. c is closed on error.
+func Client(c net.Conn, config *Config) (*Conn, error) {
+	tc, err := newConn(c, config, false)
+	if err == nil {
+		err = tc.Handshake()
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// Server runs the handshake as a server over c and returns the
+// verified connection. c is closed on error.
+func Server(c net.Conn, config *Config) (*Conn, error) {
+	tc, err := newConn(c, config, true)
+	if err == nil {
+		err = tc.Handshake()
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+type listener struct {
+	net.Listener
+	config *Config
+}
+
+// NewListener returns a listener whose connections are *Conn. As with
+// tls.NewListener(), the handshake runs on first use of a connection,
+// so that a slow peer does not hold up Accept(). Connections whose
+// peer has no identity, e.g. TCP connections without
+// Config.PeerIdentity set, are closed and not returned.
+func NewListener(l net.Listener, config *Config) net.Listener {
+	return &listener{Listener: l, config: config}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		tc, err := newConn(c, l.config, true)
+		if err != nil {
+			c.Close()
+			continue
+		}
+		return tc, nil
+	}
+}
+
+// newConn sets up TLS over c, pinning the identity of the peer
+func newConn(c net.Conn, config *Config, server bool) (*Conn, error) {
+	peerIdentity := config.PeerIdentity
+	if peerIdentity == nil {
+		peerIdentity = IdentityOf
+	}
+	expected, err := peerIdentity(c.RemoteAddr())
+	if err != nil {
+		return nil, err
+	}
+
+	var tlsConfig *tls.Config
+	if config.TLS != nil {
+		tlsConfig = config.TLS.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig.Certificates = []tls.Certificate{config.Certificate}
+	tlsConfig.GetCertificate = nil
+	tlsConfig.GetClientCertificate = nil
+	// The chain is verified along with the identity below, as the
+	// standard verification checks DNS names and IP addresses only
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	roots := config.Roots
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		return verifyPeer(cs.PeerCertificates, roots, expected)
+	}
+
+	if server {
+		return &Conn{Conn: tls.Server(c, tlsConfig), expected: expected}, nil
+	}
+	return &Conn{Conn: tls.Client(c, tlsConfig), expected: expected}, nil
+}
+
+// verifyPeer checks that the peer certificate chains up to roots and
+// names the expected identity
+func verifyPeer(certs []*x509.Certificate, roots *x509.CertPool, expected Identity) error {
+	if len(certs) == 0 {
+		return errors.New("peer presented no certificate")
+	}
+	if roots == nil {
+		return errors.New("no CA configured to verify the peer")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return err
+	}
+	for _, u := range certs[0].URIs {
+		if Identity(u.String()) == expected {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: expected %s, certificate is for %v", ErrIdentityMismatch, expected, certs[0].URIs)
+}
@@ -0,0 +1,8 @@
+// +build !windows
+
+package vscp
+
+import "syscall"
+
+// oNoFollow makes opening a partial file fail if it is a symlink
+const oNoFollow = syscall.O_NOFOLLOW
@@ -0,0 +1,5 @@
+package vscp
+
+// oNoFollow is not available on Windows, where receiveFile relies on
+// checking the partial file with os.Lstat() before opening it
+const oNoFollow = 0
@@ -0,0 +1,642 @@
+// Package vscp copies files and directories between host and guest
+// over a single Hyper-V or virtio socket connection, for guests without
+// networking. The guest runs a server:
+//
+//	l, err := vsock.Listen(vsock.CIDAny, 5555)
+//	...
+//	go (&vscp.Server{Root: "/"}).Serve(l)
+//
+// and the host pushes or pulls files:
+//
+//	c, err := vsock.Dial(3, 5555)
+//	...
+//	err = vscp.Push(c, "build/", "/srv/build", &vscp.Options{Recursive: true})
+//
+// Every file is checksummed with SHA-256 and checked by the receiver
+// before it is moved into place. Files are received into a
+// "<name>.vscp-partial" file first. If a transfer is interrupted,
+// copying the same file again resumes from the data already received,
+// provided the checksum of that prefix still matches the source.
+//
+// Symlinks are copied as they are. The receiver never writes through a
+// symlink, so a peer can't place files outside of the destination, or
+// outside of the Root of a Server, with one.
+package vscp
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PartialSuffix is appended to the name of files being received
+const PartialSuffix = ".vscp-partial"
+
+const (
+	chunkSize  = 32 * 1024
+	maxMessage = 1 << 20
+)
+
+// Message types. Every message is a type byte, a 32 bit big endian
+// length and the payload, which is JSON except for data messages.
+const (
+	msgRequest = 'R' // request, client to server
+	msgAck     = 'A' // result of a request, file or transfer
+	msgError   = 'X' // fatal error, the connection is closed after it
+	msgEntry   = 'E' // file, directory or end of the transfer
+	msgOffset  = 'O' // offset to resume a file from
+	msgData    = 'D' // file data
+	msgFinish  = 'F' // checksum of the file sent
+)
+
+var (
+	// ErrChecksum is returned if a file received does not match the
+	// checksum of the file sent
+	ErrChecksum = errors.New("vscp: checksum mismatch")
+	// ErrReadOnly is returned if files are pushed to a read-only server
+	ErrReadOnly = errors.New("vscp: server is read-only")
+)
+
+// Options control a transfer
+type Options struct {
+	// Recursive must be set to copy directories
+	Recursive bool
+	// Progress, if set, is called after every chunk of file data
+	// sent or received with the local path of the file, the number
+	// of bytes transferred so far and its size. Bytes skipped when
+	// resuming count as transferred.
+	Progress func(path string, done, size int64)
+}
+
+type request struct {
+	Op        string `json:"op"` // "push" or "pull"
+	Path      string `json:"path"`
+	Recursive bool   `json:"recursive,omitempty"`
+}
+
+type ack struct {
+	Error string `json:"error,omitempty"`
+}
+
+// entry describes a file or directory being sent. Path is relative to
+// the destination and empty for the top level.
+type entry struct {
+	Type  string      `json:"type"` // "file", "dir", "symlink" or "end"
+	Path  string      `json:"path,omitempty"`
+	Name  string      `json:"name,omitempty"` // base name of the source
+	Mode  os.FileMode `json:"mode,omitempty"`
+	Size  int64       `json:"size,omitempty"`
+	MTime time.Time   `json:"mtime,omitempty"`
+	Link  string      `json:"link,omitempty"`
+}
+
+type offset struct {
+	Offset int64  `json:"offset"`
+	SHA256 string `json:"sha256,omitempty"` // of the first Offset bytes
+}
+
+type finish struct {
+	SHA256 string `json:"sha256"`
+}
+
+// peer reads and writes messages on a connection
+type peer struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+func newPeer(c io.ReadWriter) *peer {
+	return &peer{r: bufio.NewReader(c), w: c}
+}
+
+func (p *peer) writeRaw(t byte, b []byte) error {
+	var hdr [5]byte
+	hdr[0] = t
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(b)))
+	_, err := p.w.Write(append(hdr[:], b...))
+	return err
+}
+
+func (p *peer) write(t byte, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return p.writeRaw(t, b)
+}
+
+// writeError tells the peer about a fatal error
+func (p *peer) writeError(err error) {
+	p.write(msgError, ack{Error: err.Error()})
+}
+
+// readRaw reads the next message, which must be of type t. An error
+// message from the peer is returned as an error.
+func (p *peer) readRaw(t byte) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(p.r, hdr[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxMessage {
+		return nil, fmt.Errorf("vscp: message too large (%d bytes)", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(p.r, b); err != nil {
+		return nil, err
+	}
+	if hdr[0] == msgError {
+		var a ack
+		json.Unmarshal(b, &a)
+		return nil, peerError(a.Error)
+	}
+	if hdr[0] != t {
+		return nil, fmt.Errorf("vscp: unexpected message %q, expected %q", hdr[0], t)
+	}
+	return b, nil
+}
+
+func (p *peer) read(t byte, v interface{}) error {
+	b, err := p.readRaw(t)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("vscp: invalid %q message: %v", t, err)
+	}
+	return nil
+}
+
+// readAck reads an ack and returns the error it carries
+func (p *peer) readAck() error {
+	var a ack
+	if err := p.read(msgAck, &a); err != nil {
+		return err
+	}
+	if a.Error != "" {
+		return peerError(a.Error)
+	}
+	return nil
+}
+
+// peerError returns the error reported by the peer
+func peerError(msg string) error {
+	for _, err := range []error{ErrChecksum, ErrReadOnly} {
+		if msg == err.Error() {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
+
+// Push copies the local file or directory src to dst on the server at
+// the other end of c. If dst is an existing directory, src is copied
+// into it. c is not closed.
+func Push(c io.ReadWriter, src, dst string, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	p := newPeer(c)
+	if err := p.write(msgRequest, request{Op: "push", Path: dst, Recursive: opts.Recursive}); err != nil {
+		return err
+	}
+	if err := p.readAck(); err != nil {
+		return err
+	}
+	return sendTree(p, src, opts)
+}
+
+// Pull copies the file or directory src on the server at the other end
+// of c to the local path dst. If dst is an existing directory, src is
+// copied into it. c is not closed.
+func Pull(c io.ReadWriter, src, dst string, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	p := newPeer(c)
+	if err := p.write(msgRequest, request{Op: "pull", Path: src, Recursive: opts.Recursive}); err != nil {
+		return err
+	}
+	if err := p.readAck(); err != nil {
+		return err
+	}
+	return receiveTree(p, dst, opts)
+}
+
+// Server serves push and pull requests
+type Server struct {
+	// Root is the directory paths of requests are relative to. Paths
+	// can't refer to files outside of it. It defaults to the current
+	// directory.
+	Root string
+	// ReadOnly refuses pushes
+	ReadOnly bool
+}
+
+// Serve accepts connections from l and serves a request on each until
+// Accept() fails, e.g. because l was closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer c.Close()
+			s.ServeConn(c)
+		}()
+	}
+}
+
+// ServeConn serves a single request on c and returns the error which
+// ended the transfer, if any. c is not closed.
+func (s *Server) ServeConn(c io.ReadWriter) error {
+	p := newPeer(c)
+	var req request
+	if err := p.read(msgRequest, &req); err != nil {
+		return err
+	}
+	local := s.resolve(req.Path)
+	// Symlinks pushed by an earlier request must not lead outside of
+	// Root either
+	if err := checkParents(s.root(), local); err != nil {
+		p.write(msgAck, ack{Error: err.Error()})
+		return err
+	}
+	opts := &Options{Recursive: req.Recursive}
+	switch req.Op {
+	case "push":
+		if s.ReadOnly {
+			p.write(msgAck, ack{Error: ErrReadOnly.Error()})
+			return ErrReadOnly
+		}
+		// Pushing into a directory follows local, unlike pulling it
+		if fi, err := os.Lstat(local); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			err := fmt.Errorf("vscp: %s is a symlink", req.Path)
+			p.write(msgAck, ack{Error: err.Error()})
+			return err
+		}
+		if err := p.write(msgAck, ack{}); err != nil {
+			return err
+		}
+		return receiveTree(p, local, opts)
+	case "pull":
+		if err := p.write(msgAck, ack{}); err != nil {
+			return err
+		}
+		return sendTree(p, local, opts)
+	}
+	err := fmt.Errorf("vscp: unknown request %q", req.Op)
+	p.write(msgAck, ack{Error: err.Error()})
+	return err
+}
+
+// root returns the directory request paths are relative to
+func (s *Server) root() string {
+	if s.Root == "" {
+		return "."
+	}
+	return s.Root
+}
+
+// resolve maps a request path to a local path below s.Root
+func (s *Server) resolve(p string) string {
+	return filepath.Join(s.root(), filepath.FromSlash(path.Clean("/"+p)))
+}
+
+// sendTree sends the file or directory src
+func sendTree(p *peer, src string, opts *Options) error {
+	err := sendTreeEntries(p, src, opts)
+	if err != nil {
+		p.writeError(err)
+		return err
+	}
+	if err := p.write(msgEntry, entry{Type: "end"}); err != nil {
+		return err
+	}
+	return p.readAck()
+}
+
+func sendTreeEntries(p *peer, src string, opts *Options) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() && !opts.Recursive {
+		return fmt.Errorf("vscp: %s is a directory", src)
+	}
+	name := filepath.Base(src)
+	return filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			rel = ""
+		}
+		e := entry{
+			Path:  filepath.ToSlash(rel),
+			Name:  name,
+			Mode:  fi.Mode().Perm(),
+			MTime: fi.ModTime(),
+		}
+		switch {
+		case fi.IsDir():
+			e.Type = "dir"
+			return p.write(msgEntry, e)
+		case fi.Mode()&os.ModeSymlink != 0:
+			e.Type = "symlink"
+			if e.Link, err = os.Readlink(file); err != nil {
+				return err
+			}
+			return p.write(msgEntry, e)
+		case fi.Mode().IsRegular():
+			e.Type, e.Size = "file", fi.Size()
+			return sendFile(p, file, e, opts)
+		}
+		// Skip devices, sockets and pipes
+		return nil
+	})
+}
+
+// sendFile sends a regular file, resuming from the offset the receiver
+// asks for if the data before it matches
+func sendFile(p *peer, file string, e entry, opts *Options) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := p.write(msgEntry, e); err != nil {
+		return err
+	}
+	var o offset
+	if err := p.read(msgOffset, &o); err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	start := int64(0)
+	if o.Offset > 0 && o.Offset <= e.Size {
+		if _, err := io.CopyN(h, f, o.Offset); err != nil {
+			return err
+		}
+		if hex.EncodeToString(h.Sum(nil)) == o.SHA256 {
+			start = o.Offset
+		} else {
+			h.Reset()
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+	}
+	if err := p.write(msgOffset, offset{Offset: start}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, chunkSize)
+	done := start
+	for done < e.Size {
+		n := e.Size - done
+		if n > chunkSize {
+			n = chunkSize
+		}
+		if _, err := io.ReadFull(f, buf[:n]); err != nil {
+			return fmt.Errorf("vscp: %s changed while being sent: %v", file, err)
+		}
+		h.Write(buf[:n])
+		if err := p.writeRaw(msgData, buf[:n]); err != nil {
+			return err
+		}
+		done += n
+		if opts.Progress != nil {
+			opts.Progress(file, done, e.Size)
+		}
+	}
+	if err := p.write(msgFinish, finish{SHA256: hex.EncodeToString(h.Sum(nil))}); err != nil {
+		return err
+	}
+	return p.readAck()
+}
+
+// receiveTree receives the entries of a transfer into dst
+func receiveTree(p *peer, dst string, opts *Options) error {
+	err := receiveTreeEntries(p, dst, opts)
+	if err != nil {
+		p.writeError(err)
+	}
+	return err
+}
+
+func receiveTreeEntries(p *peer, dst string, opts *Options) error {
+	var root, base string
+	for first := true; ; first = false {
+		var e entry
+		if err := p.read(msgEntry, &e); err != nil {
+			return err
+		}
+		if e.Type == "end" {
+			return p.write(msgAck, ack{})
+		}
+		if first {
+			// The first entry is the top level. Copy into dst if
+			// it is an existing directory, like cp.
+			root, base = dst, dst
+			if fi, err := os.Stat(dst); err == nil && fi.IsDir() {
+				if e.Name == "" || strings.ContainsAny(e.Name, `/\`) || e.Name == ".." {
+					return fmt.Errorf("vscp: invalid name %q", e.Name)
+				}
+				base = filepath.Join(dst, e.Name)
+			}
+		}
+		if e.Type == "dir" && e.Path == "" && !opts.Recursive {
+			return fmt.Errorf("vscp: received a directory without Recursive set")
+		}
+		target, err := entryPath(base, e.Path)
+		if err != nil {
+			return err
+		}
+		if err := checkParents(root, target); err != nil {
+			return err
+		}
+		switch e.Type {
+		case "dir":
+			if err := os.MkdirAll(target, e.Mode|0700); err != nil {
+				return err
+			}
+		case "symlink":
+			os.Remove(target)
+			if err := os.Symlink(e.Link, target); err != nil {
+				return err
+			}
+		case "file":
+			if err := receiveFile(p, target, e, opts); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("vscp: unknown entry type %q", e.Type)
+		}
+	}
+}
+
+// entryPath returns the local path of an entry, refusing paths which
+// escape base
+func entryPath(base, rel string) (string, error) {
+	if rel == "" {
+		return base, nil
+	}
+	clean := path.Clean(rel)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") || strings.Contains(rel, `\`) {
+		return "", fmt.Errorf("vscp: invalid path %q", rel)
+	}
+	return filepath.Join(base, filepath.FromSlash(clean)), nil
+}
+
+// checkParents returns an error if a directory between root and p,
+// excluding both, is a symlink. entryPath() only looks at the path, so
+// a peer could otherwise send a symlink to a directory outside of root
+// followed by entries below it, which would be written through it.
+func checkParents(root, p string) error {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return err
+	}
+	dir := root
+	parts := strings.Split(rel, string(filepath.Separator))
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			// Nothing below a directory yet to be created exists
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("vscp: %s is a symlink", dir)
+		}
+	}
+	return nil
+}
+
+// receiveFile receives a regular file into target, resuming a partial
+// file left by an earlier transfer
+func receiveFile(p *peer, target string, e entry, opts *Options) error {
+	partial := target + PartialSuffix
+	// A symlink received earlier must not redirect the data
+	if fi, err := os.Lstat(partial); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("vscp: %s is a symlink", partial)
+	}
+	f, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE|oNoFollow, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	h := sha256.New()
+	have, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if have > e.Size {
+		have = 0
+	}
+	o := offset{Offset: have}
+	if have > 0 {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(h, f, have); err != nil {
+			return err
+		}
+		o.SHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+	if err := p.write(msgOffset, o); err != nil {
+		return err
+	}
+	if err := p.read(msgOffset, &o); err != nil {
+		return err
+	}
+	if o.Offset != have {
+		// The sender starts over
+		o.Offset = 0
+		h.Reset()
+	}
+	if err := f.Truncate(o.Offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(o.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	done := o.Offset
+	for done < e.Size {
+		b, err := p.readRaw(msgData)
+		if err != nil {
+			return err
+		}
+		if int64(len(b)) > e.Size-done {
+			return fmt.Errorf("vscp: %s: more data than announced", target)
+		}
+		if _, err := f.Write(b); err != nil {
+			return err
+		}
+		h.Write(b)
+		done += int64(len(b))
+		if opts.Progress != nil {
+			opts.Progress(target, done, e.Size)
+		}
+	}
+	var fin finish
+	if err := p.read(msgFinish, &fin); err != nil {
+		return err
+	}
+	err = finishFile(f, h, fin, partial, target, e)
+	f = nil
+	if err != nil {
+		return err
+	}
+	return p.write(msgAck, ack{})
+}
+
+// finishFile checks the checksum of a received file and moves it into
+// place. f is closed.
+func finishFile(f *os.File, h hash.Hash, fin finish, partial, target string, e entry) error {
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != fin.SHA256 {
+		os.Remove(partial)
+		return ErrChecksum
+	}
+	if err := os.Chmod(partial, e.Mode); err != nil {
+		return err
+	}
+	if !e.MTime.IsZero() {
+		os.Chtimes(partial, e.MTime, e.MTime)
+	}
+	return os.Rename(partial, target)
+}
@@ -0,0 +1,173 @@
+package vscp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// serve runs srv on one end of a pipe and returns the other
+func serve(t *testing.T, srv *Server) net.Conn {
+	c, s := net.Pipe()
+	go func() {
+		srv.ServeConn(s)
+		s.Close()
+	}()
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// assertEmpty fails the test if anything was written to dir
+func assertEmpty(t *testing.T, dir string) {
+	t.Helper()
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		t.Errorf("%s was written outside of the destination", filepath.Join(dir, fi.Name()))
+	}
+}
+
+func TestPushPull(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "sub", "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Symlinks within the tree are copied as they are
+	if err := os.Symlink("sub/file", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Root: t.TempDir()}
+	opts := &Options{Recursive: true}
+	if err := Push(serve(t, srv), src, "tree", opts); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "tree")
+	if err := Pull(serve(t, srv), "tree", dst, opts); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dst, "link"))
+	if err != nil || string(b) != "data" {
+		t.Fatalf("read %q, %v", b, err)
+	}
+}
+
+// sendEntries plays a malicious sender which sends entries in an
+// order a real tree can't produce. Files contain data.
+func sendEntries(p *peer, entries []entry, data []byte) error {
+	for _, e := range entries {
+		if err := p.write(msgEntry, e); err != nil {
+			return err
+		}
+		if e.Type != "file" {
+			continue
+		}
+		var o offset
+		if err := p.read(msgOffset, &o); err != nil {
+			return err
+		}
+		if err := p.write(msgOffset, offset{}); err != nil {
+			return err
+		}
+		if err := p.writeRaw(msgData, data); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		if err := p.write(msgFinish, finish{SHA256: hex.EncodeToString(sum[:])}); err != nil {
+			return err
+		}
+		if err := p.readAck(); err != nil {
+			return err
+		}
+	}
+	if err := p.write(msgEntry, entry{Type: "end"}); err != nil {
+		return err
+	}
+	return p.readAck()
+}
+
+// TestPullSymlinkEscape checks that a server can't make Pull write
+// outside of the destination through a symlink it sent before
+func TestPullSymlinkEscape(t *testing.T) {
+	data := []byte("root::0:0::/root:/bin/sh\n")
+	tests := []struct {
+		name    string
+		entries func(outside string) []entry
+	}{
+		{"parent", func(outside string) []entry {
+			return []entry{
+				{Type: "dir", Name: "src", Mode: 0755},
+				{Type: "symlink", Path: "a", Name: "src", Link: outside},
+				{Type: "file", Path: "a/passwd", Name: "src", Mode: 0644, Size: int64(len(data))},
+			}
+		}},
+		{"partial file", func(outside string) []entry {
+			return []entry{
+				{Type: "dir", Name: "src", Mode: 0755},
+				{Type: "symlink", Path: "passwd" + PartialSuffix, Name: "src", Link: filepath.Join(outside, "passwd")},
+				{Type: "file", Path: "passwd", Name: "src", Mode: 0644, Size: int64(len(data))},
+			}
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			outside := t.TempDir()
+			c, s := net.Pipe()
+			defer c.Close()
+			go func() {
+				defer s.Close()
+				p := newPeer(s)
+				var req request
+				if err := p.read(msgRequest, &req); err != nil {
+					return
+				}
+				if err := p.write(msgAck, ack{}); err != nil {
+					return
+				}
+				sendEntries(p, tc.entries(outside), data)
+			}()
+
+			dst := filepath.Join(t.TempDir(), "dst")
+			if err := Pull(c, "src", dst, &Options{Recursive: true}); err == nil {
+				t.Error("pull of entries below a symlink succeeded")
+			}
+			assertEmpty(t, outside)
+		})
+	}
+}
+
+// TestServerSymlinkEscape checks that a client can't make a server
+// write outside of Root through a symlink it pushed before
+func TestServerSymlinkEscape(t *testing.T) {
+	outside := t.TempDir()
+	srv := &Server{Root: t.TempDir()}
+	opts := &Options{Recursive: true}
+
+	src := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(src, "evil")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Push(serve(t, srv), filepath.Join(src, "evil"), "evil", opts); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(src, "passwd")
+	if err := ioutil.WriteFile(file, []byte("root::0:0::/root:/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, dst := range []string{"evil", "evil/passwd"} {
+		if err := Push(serve(t, srv), file, dst, opts); err == nil {
+			t.Errorf("push to %s succeeded", dst)
+		}
+	}
+	assertEmpty(t, outside)
+}
@@ -0,0 +1,129 @@
+package vsock
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd
+const listenFdsStart = 3
+
+// FileListener returns a listener for the listening vsock socket f,
+// e.g. one inherited from a parent process. The socket is duplicated,
+// so f may be closed afterwards.
+func FileListener(f *os.File) (net.Listener, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return nil, opError("listen", nil, nil, err)
+	}
+	var fd uintptr
+	var serr error
+	err = rc.Control(func(s uintptr) {
+		var e1 syscall.Errno
+		fd, _, e1 = syscall.Syscall(syscall.SYS_FCNTL, s, syscall.F_DUPFD_CLOEXEC, 0)
+		if e1 != 0 {
+			serr = os.NewSyscallError("fcntl", e1)
+		}
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		return nil, opError("listen", nil, nil, err)
+	}
+	return fdListener(int(fd))
+}
+
+// fdListener takes ownership of fd, which must be a listening vsock
+// socket, and returns a listener for it
+func fdListener(fd int) (net.Listener, error) {
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		_ = closeFD(fd)
+		return nil, opError("listen", nil, nil, os.NewSyscallError("getsockname", err))
+	}
+	local := sockaddrToVsock(sa)
+	if local == nil {
+		_ = closeFD(fd)
+		return nil, opError("listen", nil, nil, fmt.Errorf("fd %d is not a vsock socket", fd))
+	}
+	listening, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ACCEPTCONN)
+	if err == nil && listening == 0 {
+		err = fmt.Errorf("fd %d is not listening", fd)
+	}
+	if err == nil {
+		// The socket must be non-blocking for os.NewFile() to
+		// register it with the runtime poller
+		err = unix.SetNonblock(fd, true)
+	}
+	if err != nil {
+		_ = closeFD(fd)
+		return nil, opError("listen", nil, local, err)
+	}
+
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("vsock-listener:%d", fd))
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, opError("listen", nil, local, err)
+	}
+	return &vsockListener{f, rc, *local}, nil
+}
+
+// ActivationListeners returns listeners for the vsock sockets passed
+// by systemd socket activation, see sd_listen_fds(3). Listeners are
+// keyed by the name set with FileDescriptorName= in the socket unit,
+// or "unknown" if no names were passed. Passed file descriptors which
+// are not vsock sockets are left alone, so that they can be used by
+// other code. It returns no listeners if the process was not socket
+// activated.
+//
+// Socket activation lets guest agents be started on demand and closes
+// the window in which the host may try to connect before the agent is
+// listening.
+func ActivationListeners() (map[string][]net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make(map[string][]net.Listener)
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		sa, err := unix.Getsockname(fd)
+		if err != nil {
+			continue
+		}
+		if _, ok := sa.(*unix.SockaddrVM); !ok {
+			continue
+		}
+		// systemd does not set close-on-exec
+		unix.CloseOnExec(fd)
+
+		l, err := fdListener(fd)
+		if err != nil {
+			for _, ls := range listeners {
+				for _, l := range ls {
+					l.Close()
+				}
+			}
+			return nil, err
+		}
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		listeners[name] = append(listeners[name], l)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,305 @@
+package vsock
+
+// Conformance tests against the C samples in c/. They need the Linux
+// binaries built with "make -C c linux" and vsock loopback, or a peer
+// reachable over vsock, and only run if VIRTSOCK_C_BIN is set:
+//
+//	make -C c linux
+//	VIRTSOCK_C_BIN=$PWD/c/build go test -run Conformance ./pkg/vsock
+//
+// The C samples talk to VIRTSOCK_C_CID, which defaults to
+// VMADDR_CID_LOCAL (1), and the Go side dials the same CID.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// cServicePort is SERVICE_PORT of the C samples
+const cServicePort = 0x3049197c
+
+// cBye is sent by hvecho once the client closed its write side
+const cBye = "Bye!"
+
+// conformanceEnv returns the directory holding the C binaries and the
+// CID to connect to, or skips the test
+func conformanceEnv(t *testing.T) (string, uint32) {
+	dir := os.Getenv("VIRTSOCK_C_BIN")
+	if dir == "" {
+		t.Skip("VIRTSOCK_C_BIN not set")
+	}
+	cid := uint32(1)
+	if s := os.Getenv("VIRTSOCK_C_CID"); s != "" {
+		v, err := strconv.ParseUint(s, 0, 32)
+		if err != nil {
+			t.Fatalf("invalid VIRTSOCK_C_CID %q: %v", s, err)
+		}
+		cid = uint32(v)
+	}
+	return dir, cid
+}
+
+// startC runs one of the C samples until the test ends
+func startC(t *testing.T, dir, name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(filepath.Join(dir, name), args...)
+	out := &bytes.Buffer{}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("%s output:\n%s", name, out)
+		}
+	})
+	return cmd
+}
+
+// dialC connects to a C server, waiting for it to come up
+func dialC(t *testing.T, cid uint32) Conn {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := Dial(cid, cServicePort)
+		if err == nil {
+			return c
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// TestConformanceEchoClient runs a Go client against hvecho -s
+func TestConformanceEchoClient(t *testing.T) {
+	dir, cid := conformanceEnv(t)
+	startC(t, dir, "hvecho", "-s", "-vsock")
+	c := dialC(t, cid)
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+
+	msg := []byte("this is a test")
+	if _, err := c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatalf("echoed %q, sent %q", buf, msg)
+	}
+	// hvecho answers the half-close with a bye
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != cBye {
+		t.Fatalf("received %q after CloseWrite, expected %q", rest, cBye)
+	}
+}
+
+// TestConformanceEchoServer runs hvecho -c against a Go server
+// behaving like hvecho -s
+func TestConformanceEchoServer(t *testing.T) {
+	dir, cid := conformanceEnv(t)
+	l, err := Listen(CIDAny, cServicePort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+		c.Write([]byte(cBye))
+	}()
+
+	out, err := exec.Command(filepath.Join(dir, "hvecho"), "-c", strconv.Itoa(int(cid)), "-vsock").CombinedOutput()
+	if err != nil {
+		t.Fatalf("hvecho failed: %v\n%s", err, out)
+	}
+	if !bytes.Contains(out, []byte("->"+cBye)) {
+		t.Fatalf("hvecho did not receive the bye:\n%s", out)
+	}
+}
+
+// TestConformanceStressClient sends random data over several
+// connections to hvstress -s and checks what comes back
+func TestConformanceStressClient(t *testing.T) {
+	dir, cid := conformanceEnv(t)
+	startC(t, dir, "hvstress", "-s", "-vsock")
+
+	for i, size := range []int{1, 4095, 4096, 4097, 1024 * 1024} {
+		c := dialC(t, cid)
+		c.SetDeadline(time.Now().Add(30 * time.Second))
+		msg := make([]byte, size)
+		rand.Read(msg)
+		werr := make(chan error, 1)
+		go func() {
+			_, err := c.Write(msg)
+			if err == nil {
+				err = c.CloseWrite()
+			}
+			werr <- err
+		}()
+		got, err := ioutil.ReadAll(c)
+		c.Close()
+		if err != nil {
+			t.Fatalf("connection %d: %v", i, err)
+		}
+		if err := <-werr; err != nil {
+			t.Fatalf("connection %d: %v", i, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatalf("connection %d: received %d bytes which differ from the %d sent", i, len(got), len(msg))
+		}
+	}
+}
+
+// TestConformanceStressServer runs hvstress -c with parallel
+// connections against a Go echo server
+func TestConformanceStressServer(t *testing.T) {
+	dir, cid := conformanceEnv(t)
+	l, err := Listen(CIDAny, cServicePort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	out, err := exec.Command(filepath.Join(dir, "hvstress"), "-c", strconv.Itoa(int(cid)), "-vsock",
+		"-i", "20", "-p", "4", "-m", strconv.Itoa(1024*1024), "-a").CombinedOutput()
+	if err != nil {
+		t.Fatalf("hvstress failed: %v\n%s", err, out)
+	}
+}
+
+// vsockPair returns both ends of a connection from the Go side to
+// itself over vsock
+func vsockPair(t *testing.T, cid uint32) (Conn, Conn) {
+	l, err := Listen(CIDAny, cServicePort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- c.(Conn)
+	}()
+	local := dialC(t, cid)
+	peer := <-accepted
+	if peer == nil {
+		local.Close()
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		local.Close()
+		peer.Close()
+	})
+	return local, peer
+}
+
+// TestConformanceHalfClose checks what each end of a vsock connection
+// can still do after the local end shut down one or both directions,
+// matching mux.Stream
+func TestConformanceHalfClose(t *testing.T) {
+	_, cid := conformanceEnv(t)
+	closeRead := func(c Conn) error { return c.CloseRead() }
+	closeWrite := func(c Conn) error { return c.CloseWrite() }
+	closeBoth := func(c Conn) error { return c.Close() }
+
+	tests := []struct {
+		name       string
+		ops        []func(c Conn) error
+		localWrite bool  // the local end can write
+		peerRead   bool  // the peer receives what the local end wrote
+		localRead  error // what the local end reads, nil for data
+	}{
+		{"open", nil, true, true, nil},
+		{"CloseWrite", []func(Conn) error{closeWrite}, false, false, nil},
+		{"CloseWrite twice", []func(Conn) error{closeWrite, closeWrite}, false, false, nil},
+		{"CloseRead", []func(Conn) error{closeRead}, true, true, io.EOF},
+		{"CloseRead twice", []func(Conn) error{closeRead, closeRead}, true, true, io.EOF},
+		{"CloseRead CloseWrite", []func(Conn) error{closeRead, closeWrite}, false, false, io.EOF},
+		{"CloseWrite CloseRead", []func(Conn) error{closeWrite, closeRead}, false, false, io.EOF},
+		{"Close", []func(Conn) error{closeBoth}, false, false, os.ErrClosed},
+		{"CloseWrite Close", []func(Conn) error{closeWrite, closeBoth}, false, false, os.ErrClosed},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			local, peer := vsockPair(t, cid)
+			local.SetDeadline(time.Now().Add(5 * time.Second))
+			peer.SetDeadline(time.Now().Add(5 * time.Second))
+
+			for _, op := range tc.ops {
+				if err := op(local); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err := local.Write([]byte("l"))
+			if (err == nil) != tc.localWrite {
+				t.Errorf("local write returned %v", err)
+			}
+			b := make([]byte, 1)
+			n, err := peer.Read(b)
+			if tc.peerRead && (err != nil || string(b[:n]) != "l") {
+				t.Errorf("peer read %q, %v", b[:n], err)
+			}
+			if !tc.peerRead && err != io.EOF {
+				t.Errorf("peer read %q, %v, expected EOF", b[:n], err)
+			}
+
+			// Unlike a mux stream, the peer of a vsock which shut
+			// down its reading side may get EPIPE, so only check the
+			// reverse direction where it is still open
+			if tc.localRead == nil {
+				if _, err := peer.Write([]byte("p")); err != nil {
+					t.Fatalf("peer write returned %v", err)
+				}
+			}
+			n, err = local.Read(b)
+			if tc.localRead == nil && (err != nil || string(b[:n]) != "p") {
+				t.Errorf("local read %q, %v", b[:n], err)
+			}
+			if tc.localRead != nil && !errors.Is(err, tc.localRead) {
+				t.Errorf("local read %q, %v, expected %v", b[:n], err, tc.localRead)
+			}
+		})
+	}
+}
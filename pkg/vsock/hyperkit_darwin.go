@@ -15,8 +15,6 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-
-	"github.com/pkg/errors"
 )
 
 var (
@@ -46,10 +44,11 @@ func SocketMode(socketMode string) {
 func Dial(cid, port uint32) (Conn, error) {
 	c, err := net.DialUnix("unix", nil, &net.UnixAddr{connectPath, "unix"})
 	if err != nil {
-		return c, errors.Wrapf(err, "failed to dial on %s", connectPath)
+		return nil, &net.OpError{Op: "dial", Net: "vsock", Addr: Addr{cid, port}, Err: err}
 	}
 	if _, err := fmt.Fprintf(c, "%08x.%08x\n", cid, port); err != nil {
-		return c, errors.Wrapf(err, "Failed to write dest (%08x.%08x) to %s", cid, port, connectPath)
+		c.Close()
+		return nil, &net.OpError{Op: "dial", Net: "vsock", Addr: Addr{cid, port}, Err: err}
 	}
 	return c, nil
 }
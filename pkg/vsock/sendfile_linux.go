@@ -0,0 +1,67 @@
+package vsock
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSendfileSize is the largest amount of data sent per sendfile()
+// call. Linux transfers at most 0x7ffff000 bytes per call anyway.
+const maxSendfileSize = 1 << 30
+
+// SendFile sends n bytes of f, starting at offset off, over the
+// connection using sendfile(2), so the data never passes through user
+// space. The file offset of f is not changed. It returns the number of
+// bytes sent, which is less than n only if an error occurred.
+func (v *vsockConn) SendFile(f *os.File, off, n int64) (int64, error) {
+	src, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	dst, err := v.vsock.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var written int64
+	var werr, serr error
+	err = src.Control(func(sfd uintptr) {
+		pos := off
+		werr = dst.Write(func(fd uintptr) bool {
+			for written < n {
+				chunk := n - written
+				if chunk > maxSendfileSize {
+					chunk = maxSendfileSize
+				}
+				m, err := unix.Sendfile(int(fd), int(sfd), &pos, int(chunk))
+				if m > 0 {
+					written += int64(m)
+				}
+				switch {
+				case err == unix.EINTR:
+					continue
+				case err == unix.EAGAIN:
+					// Wait for the socket to become writable
+					return false
+				case err != nil:
+					serr = os.NewSyscallError("sendfile", err)
+					return true
+				case m == 0:
+					// The file is shorter than expected
+					serr = io.ErrUnexpectedEOF
+					return true
+				}
+			}
+			return true
+		})
+	})
+	if err == nil {
+		err = werr
+	}
+	if err == nil {
+		err = serr
+	}
+	return written, v.opError("sendfile", err)
+}
@@ -0,0 +1,250 @@
+package vsock
+
+// Zero-copy support for io.Copy. When data is copied between a vsock
+// connection and another socket or a file, splice(2) moves it through
+// a pipe inside the kernel instead of copying it to user space and
+// back.
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSpliceSize is the amount of data moved per splice() call. It
+// matches the default pipe capacity, so that splicing into the pipe
+// never blocks while it is empty.
+const maxSpliceSize = 64 * 1024
+
+// SyscallConn returns a raw network connection
+func (v *vsockConn) SyscallConn() (syscall.RawConn, error) {
+	return v.vsock.SyscallConn()
+}
+
+// ReadFrom implements io.ReaderFrom. If r is a stream socket or a file
+// the data is spliced into the connection, otherwise it falls back to
+// a regular copy.
+func (v *vsockConn) ReadFrom(r io.Reader) (int64, error) {
+	var remain int64 = 1<<63 - 1
+	lr, ok := r.(*io.LimitedReader)
+	if ok {
+		remain, r = lr.N, lr.R
+		if remain <= 0 {
+			return 0, nil
+		}
+	}
+
+	var n int64
+	if src, ok := spliceConn(r, false); ok {
+		dst, err := v.SyscallConn()
+		if err != nil {
+			return 0, err
+		}
+		var handled bool
+		n, handled, err = splice(dst, src, remain)
+		if lr != nil {
+			lr.N -= n
+		}
+		if handled {
+			return n, v.opError("readfrom", err)
+		}
+	}
+	if lr != nil {
+		r = lr
+	}
+	// Hide ReadFrom from io.Copy to avoid recursing
+	m, err := io.Copy(struct{ io.Writer }{v}, r)
+	return n + m, err
+}
+
+// WriteTo implements io.WriterTo. If w is a stream socket or a file
+// referring to a socket or a pipe the data is spliced from the
+// connection, otherwise it falls back to a regular copy.
+func (v *vsockConn) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	if dst, ok := spliceConn(w, true); ok {
+		src, err := v.SyscallConn()
+		if err != nil {
+			return 0, err
+		}
+		var handled bool
+		n, handled, err = splice(dst, src, 1<<63-1)
+		if handled {
+			return n, v.opError("writeto", err)
+		}
+	}
+	// Hide WriteTo from io.Copy to avoid recursing
+	m, err := io.Copy(w, struct{ io.Reader }{v})
+	return n + m, err
+}
+
+// spliceConn returns the raw connection of x if it is something
+// splice() can be used with. Files are only spliced into if they are
+// sockets or pipes, as splice() fails on e.g. terminals and files
+// opened with O_APPEND.
+func spliceConn(x interface{}, dst bool) (syscall.RawConn, bool) {
+	var sc syscall.Conn
+	switch c := x.(type) {
+	case *vsockConn:
+		sc = c
+	case *net.TCPConn:
+		sc = c
+	case *net.UnixConn:
+		if c.LocalAddr().Network() != "unix" {
+			// Datagram sockets would lose message boundaries
+			return nil, false
+		}
+		sc = c
+	case *os.File:
+		sc = c
+	default:
+		return nil, false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, false
+	}
+	if _, ok := x.(*os.File); ok && dst && !isSocketOrPipe(rc) {
+		return nil, false
+	}
+	return rc, true
+}
+
+// isSocketOrPipe returns true if rc refers to a socket or a pipe
+func isSocketOrPipe(rc syscall.RawConn) bool {
+	var st unix.Stat_t
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = unix.Fstat(int(fd), &st)
+	}); err != nil || serr != nil {
+		return false
+	}
+	mode := st.Mode & unix.S_IFMT
+	return mode == unix.S_IFSOCK || mode == unix.S_IFIFO
+}
+
+// splice moves up to max bytes from src to dst through a pipe until
+// src reaches EOF. handled is false if splice() is not supported for
+// the pair, in which case the caller should fall back to a regular
+// copy for the rest of the data. written bytes were moved by then.
+func splice(dst, src syscall.RawConn, max int64) (written int64, handled bool, err error) {
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_CLOEXEC); err != nil {
+		return 0, false, nil
+	}
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+
+	for max > 0 {
+		// Fill the pipe from src
+		chunk := maxSpliceSize
+		if int64(chunk) > max {
+			chunk = int(max)
+		}
+		var n int64
+		var serr error
+		err = src.Read(func(fd uintptr) bool {
+			for {
+				n, serr = unix.Splice(int(fd), nil, p[1], nil, chunk, unix.SPLICE_F_MOVE)
+				if serr != unix.EINTR {
+					break
+				}
+			}
+			// Wait for src to become readable on EAGAIN
+			return serr != unix.EAGAIN
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			if written == 0 && (err == unix.EINVAL || err == unix.ENOSYS) {
+				return 0, false, nil
+			}
+			return written, true, os.NewSyscallError("splice", err)
+		}
+		if n == 0 {
+			// EOF
+			break
+		}
+
+		// Drain the pipe into dst
+		for inPipe := n; inPipe > 0; {
+			var m int64
+			err = dst.Write(func(fd uintptr) bool {
+				for {
+					m, serr = unix.Splice(p[0], nil, int(fd), nil, int(inPipe), unix.SPLICE_F_MOVE)
+					if serr != unix.EINTR {
+						break
+					}
+				}
+				// Wait for dst to become writable on EAGAIN
+				return serr != unix.EAGAIN
+			})
+			if err == nil {
+				err = serr
+			}
+			if err == unix.EINVAL || err == unix.ENOSYS {
+				// dst does not support splice() after all, copy
+				// what is in the pipe so that it is not lost
+				m, err = drainPipe(dst, p[0], inPipe)
+				written += m
+				if err != nil {
+					return written, true, err
+				}
+				return written, false, nil
+			}
+			if err != nil {
+				return written, true, os.NewSyscallError("splice", err)
+			}
+			inPipe -= m
+			written += m
+		}
+		max -= n
+	}
+	return written, true, nil
+}
+
+// drainPipe copies n bytes from the read end of a pipe to dst with
+// read() and write()
+func drainPipe(dst syscall.RawConn, pipe int, n int64) (int64, error) {
+	buf := make([]byte, maxSpliceSize)
+	var written int64
+	for written < n {
+		chunk := buf
+		if rest := n - written; rest < int64(len(chunk)) {
+			chunk = chunk[:rest]
+		}
+		m, err := unix.Read(pipe, chunk)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return written, os.NewSyscallError("read", err)
+		}
+		for b := chunk[:m]; len(b) > 0; {
+			var k int
+			var werr error
+			err = dst.Write(func(fd uintptr) bool {
+				for {
+					k, werr = unix.Write(int(fd), b)
+					if werr != unix.EINTR {
+						break
+					}
+				}
+				return werr != unix.EAGAIN
+			})
+			if err == nil {
+				err = werr
+			}
+			if err != nil {
+				return written, os.NewSyscallError("write", err)
+			}
+			b = b[k:]
+			written += int64(k)
+		}
+	}
+	return written, nil
+}
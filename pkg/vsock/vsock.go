@@ -12,9 +12,11 @@
 package vsock
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"syscall"
 )
 
 const (
@@ -26,6 +28,11 @@ const (
 	CIDHost = 2
 )
 
+// ErrConnReset is matched, using errors.Is(), by errors returned on
+// Linux when the peer aborted the connection, e.g. because the VM was
+// killed. The error also wraps the errno reported by the system.
+var ErrConnReset = errors.New("connection reset by peer")
+
 // Addr represents the address of a vsock end point.
 type Addr struct {
 	CID  uint32
@@ -42,10 +49,40 @@ func (a Addr) String() string {
 	return fmt.Sprintf("%08x.%08x", a.CID, a.Port)
 }
 
-// Conn is a vsock connection which supports half-close.
+// Conn is a vsock connection which supports half-close. Connections
+// are plain byte streams: a zero-length Write sends nothing and a
+// zero-length Read returns immediately.
+//
+// As in the net package, errors other than io.EOF are returned as a
+// *net.OpError wrapping the underlying error, so errors.Is() can be
+// used to check for a particular errno, os.ErrDeadlineExceeded or
+// ErrConnReset.
 type Conn interface {
 	net.Conn
 	CloseRead() error
 	CloseWrite() error
 	File() (*os.File, error)
 }
+
+// connResetError marks an error reported because the peer reset the
+// connection. It matches ErrConnReset with errors.Is() while still
+// unwrapping to the underlying *os.SyscallError and errno.
+type connResetError struct {
+	err error
+}
+
+func (e *connResetError) Error() string { return e.err.Error() }
+
+func (e *connResetError) Is(target error) bool { return target == ErrConnReset }
+
+func (e *connResetError) Unwrap() error { return e.err }
+
+// isConnReset returns whether err is an errno, possibly wrapped in a
+// *os.SyscallError, reporting that the peer reset the connection
+func isConnReset(err error) bool {
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	errno, ok := err.(syscall.Errno)
+	return ok && errno == syscall.ECONNRESET
+}
@@ -3,9 +3,12 @@
 package vsock
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"runtime/trace"
 	"syscall"
 	"time"
 
@@ -13,6 +16,10 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// errSelfConnect is returned by Dial() if the connection ended up
+// connected to itself
+var errSelfConnect = errors.New("connected to itself")
+
 // SocketMode is a NOOP on Linux
 func SocketMode(m string) {
 }
@@ -26,6 +33,40 @@ func sockaddrToVsock(sa unix.Sockaddr) *Addr {
 	return nil
 }
 
+// opError wraps err in a *net.OpError, the way the net package reports
+// errors, so that callers can inspect the operation and addresses and
+// use errors.Is/As on the underlying error. Errors from os.File are
+// unwrapped first, so that callers see the errno or
+// os.ErrDeadlineExceeded rather than a *os.PathError, and using a
+// closed connection reports net.ErrClosed. A reset by the peer matches
+// ErrConnReset.
+func opError(op string, source, addr *Addr, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+		if errno, ok := err.(syscall.Errno); ok {
+			err = os.NewSyscallError(pe.Op, errno)
+		}
+	}
+	if err == os.ErrClosed {
+		err = net.ErrClosed
+	}
+	if isConnReset(err) {
+		err = &connResetError{err}
+	}
+	oe := &net.OpError{Op: op, Net: "vsock", Err: err}
+	// Avoid storing typed nil pointers in the net.Addr interfaces
+	if source != nil {
+		oe.Source = source
+	}
+	if addr != nil {
+		oe.Addr = addr
+	}
+	return oe
+}
+
 // Closes fd, retrying EINTR
 func closeFD(fd int) error {
 	for {
@@ -42,63 +83,96 @@ func closeFD(fd int) error {
 
 // Dial connects to the CID.Port via virtio sockets
 func Dial(cid, port uint32) (Conn, error) {
-	fd, err := syscall.Socket(unix.AF_VSOCK, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	fd, err := syscall.Socket(unix.AF_VSOCK, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, 0)
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to create AF_VSOCK socket")
+		return nil, opError("dial", nil, &Addr{cid, port}, os.NewSyscallError("socket", err))
 	}
+	v := newVsockConn(uintptr(fd), nil, &Addr{cid, port})
 	sa := &unix.SockaddrVM{CID: cid, Port: port}
-	// Retry connect in a loop if EINTR is encountered.
-	for {
-		if err := unix.Connect(fd, sa); err != nil {
-			if errno, ok := err.(syscall.Errno); ok && errno == syscall.EINTR {
-				continue
-			}
-			// Trying not to leak fd here
-			_ = closeFD(fd)
-			return nil, errors.Wrapf(err, "failed connect() to %08x.%08x", cid, port)
-		}
-		break
+	if err := v.connect(sa); err != nil {
+		// Trying not to leak fd here
+		_ = v.Close()
+		return nil, opError("dial", nil, v.remote, err)
 	}
-	return newVsockConn(uintptr(fd), nil, &Addr{cid, port}), nil
+	local, err := v.getsockname()
+	if err != nil {
+		_ = v.Close()
+		return nil, opError("dial", nil, v.remote, err)
+	}
+	v.local = local
+	// Like with TCP, dialling a local port in the ephemeral range may
+	// connect the socket to itself if a listener is not bound yet
+	if *v.local == *v.remote {
+		_ = v.Close()
+		return nil, opError("dial", v.local, v.remote, errSelfConnect)
+	}
+	return v, nil
 }
 
 // Listen returns a net.Listener which can accept connections on the given port
 func Listen(cid, port uint32) (net.Listener, error) {
-	fd, err := syscall.Socket(unix.AF_VSOCK, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	local := Addr{cid, port}
+	fd, err := syscall.Socket(unix.AF_VSOCK, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, 0)
 	if err != nil {
-		return nil, err
+		return nil, opError("listen", nil, &local, os.NewSyscallError("socket", err))
 	}
 
 	sa := &unix.SockaddrVM{CID: cid, Port: port}
 	if err = unix.Bind(fd, sa); err != nil {
-		return nil, errors.Wrapf(err, "bind() to %08x.%08x failed", cid, port)
+		_ = closeFD(fd)
+		return nil, opError("listen", nil, &local, os.NewSyscallError("bind", err))
 	}
 
 	err = syscall.Listen(fd, syscall.SOMAXCONN)
 	if err != nil {
-		return nil, errors.Wrapf(err, "listen() on %08x.%08x failed", cid, port)
+		_ = closeFD(fd)
+		return nil, opError("listen", nil, &local, os.NewSyscallError("listen", err))
 	}
-	return &vsockListener{fd, Addr{cid, port}}, nil
+	// The socket is non-blocking, so os.NewFile() registers it with
+	// the runtime poller
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("vsock-listener:%d", fd))
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, opError("listen", nil, &local, err)
+	}
+	return &vsockListener{f, rc, local}, nil
 }
 
 type vsockListener struct {
-	fd    int
+	file  *os.File
+	rc    syscall.RawConn
 	local Addr
 }
 
 // Accept accepts an incoming call and returns the new connection.
 func (v *vsockListener) Accept() (net.Conn, error) {
-	fd, sa, err := unix.Accept(v.fd)
+	var fd int
+	var sa unix.Sockaddr
+	var aerr error
+	err := v.rc.Read(func(s uintptr) bool {
+		for {
+			fd, sa, aerr = unix.Accept4(int(s), unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+			if aerr != unix.EINTR {
+				break
+			}
+		}
+		// Wait for the next connection on EAGAIN
+		return aerr != unix.EAGAIN
+	})
+	if err == nil && aerr != nil {
+		err = os.NewSyscallError("accept4", aerr)
+	}
 	if err != nil {
-		return nil, err
+		return nil, opError("accept", nil, &v.local, err)
 	}
 	return newVsockConn(uintptr(fd), &v.local, sockaddrToVsock(sa)), nil
 }
 
-// Close closes the listening connection
+// Close closes the listening connection. Pending Accept calls are
+// unblocked and return an error.
 func (v *vsockListener) Close() error {
-	// Note this won't cause the Accept to unblock.
-	return unix.Close(v.fd)
+	return opError("close", nil, &v.local, v.file.Close())
 }
 
 // Addr returns the address the Listener is listening on
@@ -108,15 +182,97 @@ func (v *vsockListener) Addr() net.Addr {
 
 // a wrapper around FileConn which supports CloseRead and CloseWrite
 type vsockConn struct {
+	// The socket is owned by the os.File, which makes sure it is
+	// closed once and not used afterwards
 	vsock  *os.File
-	fd     uintptr
 	local  *Addr
 	remote *Addr
 }
 
+// newVsockConn wraps a connected socket. fd must be in non-blocking
+// mode so that os.NewFile() registers it with the runtime poller,
+// which means blocked Read and Write calls do not tie up a thread and
+// deadlines are supported.
 func newVsockConn(fd uintptr, local, remote *Addr) *vsockConn {
 	vsock := os.NewFile(fd, fmt.Sprintf("vsock:%d", fd))
-	return &vsockConn{vsock: vsock, fd: fd, local: local, remote: remote}
+	return &vsockConn{vsock: vsock, local: local, remote: remote}
+}
+
+// connect connects the socket to sa. The socket is non-blocking, so
+// connect() usually returns EINPROGRESS and we wait in the poller for
+// the socket to become writable, which signals completion.
+func (v *vsockConn) connect(sa unix.Sockaddr) error {
+	rc, err := v.vsock.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var cerr error
+	err = rc.Control(func(fd uintptr) {
+		for {
+			cerr = unix.Connect(int(fd), sa)
+			if cerr != unix.EINTR {
+				break
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	switch cerr {
+	case nil:
+		return nil
+	case unix.EINPROGRESS, unix.EALREADY:
+	default:
+		return os.NewSyscallError("connect", cerr)
+	}
+
+	err = rc.Write(func(fd uintptr) bool {
+		var errno int
+		errno, cerr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR)
+		if cerr != nil {
+			return true
+		}
+		switch e := syscall.Errno(errno); e {
+		case unix.EINPROGRESS, unix.EALREADY, unix.EINTR:
+			return false
+		case 0, unix.EISCONN:
+			// The socket may be reported writable before the
+			// connection is established
+			_, perr := unix.Getpeername(int(fd))
+			return perr != unix.ENOTCONN
+		default:
+			cerr = e
+			return true
+		}
+	})
+	if err == nil && cerr != nil {
+		err = os.NewSyscallError("connect", cerr)
+	}
+	return err
+}
+
+// getsockname returns the address the socket is bound to
+func (v *vsockConn) getsockname() (*Addr, error) {
+	rc, err := v.vsock.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var sa unix.Sockaddr
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		sa, serr = unix.Getsockname(int(fd))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, os.NewSyscallError("getsockname", serr)
+	}
+	local := sockaddrToVsock(sa)
+	if local == nil {
+		return nil, fmt.Errorf("unexpected socket address %T", sa)
+	}
+	return local, nil
 }
 
 // LocalAddr returns the local address of a connection
@@ -131,48 +287,87 @@ func (v *vsockConn) RemoteAddr() net.Addr {
 
 // Close closes the connection
 func (v *vsockConn) Close() error {
-	return v.vsock.Close()
+	return v.opError("close", v.vsock.Close())
 }
 
 // CloseRead shuts down the reading side of a vsock connection
 func (v *vsockConn) CloseRead() error {
-	return syscall.Shutdown(int(v.fd), syscall.SHUT_RD)
+	return v.shutdown(syscall.SHUT_RD)
 }
 
 // CloseWrite shuts down the writing side of a vsock connection
 func (v *vsockConn) CloseWrite() error {
-	return syscall.Shutdown(int(v.fd), syscall.SHUT_WR)
+	return v.shutdown(syscall.SHUT_WR)
+}
+
+// shutdown calls shutdown(2) through the os.File, so that it fails
+// once the connection is closed rather than hitting an unrelated
+// socket which reused the fd
+func (v *vsockConn) shutdown(how int) error {
+	rc, err := v.vsock.SyscallConn()
+	if err != nil {
+		return v.opError("close", err)
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.Shutdown(int(fd), how)
+	})
+	if err == nil && serr != nil {
+		err = os.NewSyscallError("shutdown", serr)
+	}
+	return v.opError("close", err)
 }
 
 // Read reads data from the connection
 func (v *vsockConn) Read(buf []byte) (int, error) {
-	return v.vsock.Read(buf)
+	defer trace.StartRegion(context.Background(), "vsock.Read").End()
+	n, err := v.vsock.Read(buf)
+	return n, v.opError("read", err)
 }
 
 // Write writes data over the connection
 func (v *vsockConn) Write(buf []byte) (int, error) {
-	return v.vsock.Write(buf)
+	defer trace.StartRegion(context.Background(), "vsock.Write").End()
+	n, err := v.vsock.Write(buf)
+	return n, v.opError("write", err)
+}
+
+// opError wraps an error from an operation on the connection
+func (v *vsockConn) opError(op string, err error) error {
+	return opError(op, v.local, v.remote, err)
 }
 
 // SetDeadline sets the read and write deadlines associated with the connection
 func (v *vsockConn) SetDeadline(t time.Time) error {
-	return nil // FIXME
+	return v.vsock.SetDeadline(t)
 }
 
 // SetReadDeadline sets the deadline for future Read calls.
 func (v *vsockConn) SetReadDeadline(t time.Time) error {
-	return nil // FIXME
+	return v.vsock.SetReadDeadline(t)
 }
 
 // SetWriteDeadline sets the deadline for future Write calls
 func (v *vsockConn) SetWriteDeadline(t time.Time) error {
-	return nil // FIXME
+	return v.vsock.SetWriteDeadline(t)
 }
 
 // File duplicates the underlying socket descriptor and returns it.
 func (v *vsockConn) File() (*os.File, error) {
-	// This is equivalent to dup(2) but creates the new fd with CLOEXEC already set.
-	r0, _, e1 := syscall.Syscall(syscall.SYS_FCNTL, uintptr(v.vsock.Fd()), syscall.F_DUPFD_CLOEXEC, 0)
+	// Don't use v.vsock.Fd() as it puts the socket into blocking mode
+	rc, err := v.vsock.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var r0 uintptr
+	var e1 syscall.Errno
+	err = rc.Control(func(fd uintptr) {
+		// This is equivalent to dup(2) but creates the new fd with CLOEXEC already set.
+		r0, _, e1 = syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_DUPFD_CLOEXEC, 0)
+	})
+	if err != nil {
+		return nil, err
+	}
 	if e1 != 0 {
 		return nil, os.NewSyscallError("fcntl", e1)
 	}